@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
 	"syscall"
 
 	natsUtil "github.com/adoublef/pinkpink/internal/nats"
+	"github.com/adoublef/pinkpink/internal/smtp"
 	smtpHTTP "github.com/adoublef/pinkpink/internal/smtp/http"
 	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"github.com/nats-io/nats.go"
 )
 
 var (
@@ -20,6 +23,37 @@ var (
 	natsNKey = os.Getenv("NATS_NKEY")
 
 	port = os.Getenv("PORT")
+
+	// adminToken lets those with it into /inbox/ and /api/templates/,
+	// as a bearer token or basic auth password, which are only served
+	// with it
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	// inbox is the bucket the worker catches mail in, when
+	// SMTP_URL is catch://<bucket>, so it can be viewed at /inbox/
+	inbox = os.Getenv("SMTP_INBOX")
+
+	// unsubscribeURL is this server's /api/unsubscribe, its links
+	// are signed with unsubscribeKey which the worker shares
+	unsubscribeURL = os.Getenv("UNSUBSCRIBE_URL")
+	unsubscribeKey = os.Getenv("UNSUBSCRIBE_KEY")
+
+	// bounceKey is what bounces are posted to /api/bounces with, as
+	// a bearer token or basic auth password, which is only served with it
+	bounceKey = os.Getenv("BOUNCE_KEY")
+	// suppressionsBucket is where the addresses that hard bounced
+	// or unsubscribed are kept, which the worker shares
+	suppressionsBucket = os.Getenv("SMTP_SUPPRESSIONS")
+
+	// templatesBucket is where the worker loads templates from,
+	// which are managed at /api/templates/
+	templatesBucket = os.Getenv("TEMPLATES_BUCKET")
+	// testTo is who /api/templates/{name}/test sends to, as a
+	// comma separated list of addresses
+	testTo = os.Getenv("TEMPLATES_TEST_TO")
+	// catalogDir has the messages templates are previewed with,
+	// the same as the worker's SMTP_CATALOG
+	catalogDir = os.Getenv("SMTP_CATALOG")
 )
 
 func init() {
@@ -52,14 +86,45 @@ func run(ctx context.Context) error {
 	}
 	defer nc.Close()
 
-	p, err := smtpNATS.NewProducer(nc, 2, 1024)
+	p, err := smtpNATS.NewProducer(nc, nats.WorkQueuePolicy, smtpNATS.DefaultMaxBytes)
 	if err != nil {
 		return fmt.Errorf("js.NewProducer: %w", err)
 	}
 
-	formatHTTP := smtpHTTP.New(p)
+	mux := http.NewServeMux()
+	var u *smtp.Unsubscriber
+	if unsubscribeKey != "" {
+		u = &smtp.Unsubscriber{URL: unsubscribeURL, Key: []byte(unsubscribeKey)}
+	}
+
+	sup, err := smtpNATS.NewSuppressions(nc, suppressionsBucket)
+	if err != nil {
+		return fmt.Errorf("smtpNATS.NewSuppressions: %w", err)
+	}
+	if bounceKey == "" {
+		log.Printf("not serving /api/bounces without BOUNCE_KEY")
+	}
 
-	srv := &http.Server{Addr: ":" + port, Handler: formatHTTP}
+	mux.Handle("/", smtpHTTP.New(p, u, sup, bounceKey))
+
+	if adminToken == "" {
+		log.Printf("not serving /api/templates/ without ADMIN_TOKEN")
+	} else if err := mountTemplates(mux, nc, p); err != nil {
+		return err
+	}
+
+	switch {
+	case inbox != "" && adminToken == "":
+		log.Printf("not serving /inbox/ without ADMIN_TOKEN")
+	case inbox != "":
+		box, err := smtpNATS.NewMailbox(nc, inbox)
+		if err != nil {
+			return fmt.Errorf("smtpNATS.NewMailbox: %w", err)
+		}
+		mux.Handle("/inbox/", http.StripPrefix("/inbox", smtpHTTP.NewInbox(box, adminToken)))
+	}
+
+	srv := &http.Server{Addr: ":" + port, Handler: mux}
 
 	e := make(chan error, 1)
 	go func() { log.Printf("listening to :%s...", port); e <- srv.ListenAndServe() }()
@@ -76,3 +141,29 @@ func run(ctx context.Context) error {
 		return nil
 	}
 }
+
+// mountTemplates serves the template API at /api/templates/.
+func mountTemplates(mux *http.ServeMux, nc *nats.Conn, p smtpNATS.Producer) error {
+	tmpls, err := smtpNATS.NewTemplates(nc, templatesBucket)
+	if err != nil {
+		return fmt.Errorf("smtpNATS.NewTemplates: %w", err)
+	}
+	th := smtpHTTP.NewTemplates(tmpls, adminToken)
+	th.Producer = p
+	if testTo != "" {
+		addrs, err := mail.ParseAddressList(testTo)
+		if err != nil {
+			return fmt.Errorf("mail.ParseAddressList: %w", err)
+		}
+		for _, a := range addrs {
+			th.TestTo = append(th.TestTo, smtp.Address(*a))
+		}
+	}
+	if catalogDir != "" {
+		if th.Catalog, err = smtp.LoadCatalog(os.DirFS(catalogDir)); err != nil {
+			return err
+		}
+	}
+	mux.Handle("/api/templates/", http.StripPrefix("/api/templates", th))
+	return nil
+}
@@ -3,19 +3,49 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	natsUtil "github.com/adoublef/pinkpink/internal/nats"
+	"github.com/adoublef/pinkpink/internal/smtp"
 	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"github.com/nats-io/nats.go"
 )
 
 var (
 	natsURL  = os.Getenv("NATS_URL")
 	natsJWT  = os.Getenv("NATS_USER_JWT")
 	natsNKey = os.Getenv("NATS_NKEY")
+
+	smtpURL = os.Getenv("SMTP_URL")
+	// returnPath is where bounces go, which should be piped
+	// to cmd/web's /api/bounces with its BOUNCE_KEY
+	returnPath = os.Getenv("SMTP_RETURN_PATH")
+	// suppressionsBucket is where the addresses that aren't sent
+	// to are kept, which cmd/web shares
+	suppressionsBucket = os.Getenv("SMTP_SUPPRESSIONS")
+	// unsubscribeURL is cmd/web's /api/unsubscribe, which
+	// shares the unsubscribeKey the links are signed with
+	unsubscribeURL = os.Getenv("UNSUBSCRIBE_URL")
+	unsubscribeKey = os.Getenv("UNSUBSCRIBE_KEY")
+
+	// templatesBucket is the object store templates are loaded from
+	templatesBucket = os.Getenv("TEMPLATES_BUCKET")
+	// layoutFile is an html/template that wraps Markdown
+	// emails with a header and footer, when set
+	layoutFile = os.Getenv("SMTP_LAYOUT")
+	// catalogDir has the messages shared between templates, a JSON
+	// file for each locale such as fr-CA.json, when set
+	catalogDir = os.Getenv("SMTP_CATALOG")
+
+	// port serves the readiness probe, when set
+	port = os.Getenv("PORT")
 )
 
 func init() {
@@ -44,13 +74,72 @@ func run(ctx context.Context) error {
 	}
 	defer nc.Close()
 
+	s, err := newSender(nc, smtpURL)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	// bad credentials are caught now rather than once messages pile up
+	if v, ok := s.(smtp.Verifier); ok {
+		vctx, cancel := context.WithTimeout(ctx, smtp.DefaultDialTimeout)
+		caps, err := v.Verify(vctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("smtp.Verify: %w", err)
+		}
+		if caps != nil {
+			log.Printf("smtp verified, tls=%t auth=%v", caps.TLS, caps.Auth)
+		}
+	}
+
+	m := &smtp.Mailer{Sender: s, Mode: smtp.ModeIndividual, ReturnPath: returnPath}
+	if unsubscribeKey != "" {
+		m.Unsubscribe = &smtp.Unsubscriber{URL: unsubscribeURL, Key: []byte(unsubscribeKey)}
+	}
+	if m.Templates, err = smtpNATS.NewTemplates(nc, templatesBucket); err != nil {
+		return fmt.Errorf("js.NewTemplates: %w", err)
+	}
+	if layoutFile != "" {
+		b, err := os.ReadFile(layoutFile)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile: %w", err)
+		}
+		if m.Layout, err = smtp.ParseLayout(string(b)); err != nil {
+			return err
+		}
+	}
+	if catalogDir != "" {
+		if m.Catalog, err = smtp.LoadCatalog(os.DirFS(catalogDir)); err != nil {
+			return err
+		}
+	}
+
+	p, err := smtpNATS.NewProducer(nc, nats.WorkQueuePolicy, smtpNATS.DefaultMaxBytes)
+	if err != nil {
+		return fmt.Errorf("js.NewProducer: %w", err)
+	}
+
 	w, err := smtpNATS.NewWorker(nc, 2, 1, "worker", smtpNATS.SubjectSubscribe) // quantity of workers
 	if err != nil {
 		return fmt.Errorf("js.NewWorker: %w", err)
 	}
 
-	e := make(chan error, 1)
-	go func() { log.Printf("consumer running..."); e <- w.Listen(ctx) }()
+	sup, err := smtpNATS.NewSuppressions(nc, suppressionsBucket)
+	if err != nil {
+		return fmt.Errorf("js.NewSuppressions: %w", err)
+	}
+
+	e := make(chan error, 2)
+	go func() { log.Printf("consumer running..."); e <- w.Listen(ctx, deliver(m, p, sup)) }()
+
+	if port != "" {
+		srv := &http.Server{Addr: ":" + port, Handler: ready(ctx, s)}
+		defer srv.Close()
+		go func() { log.Printf("readiness probe on :%s...", port); e <- srv.ListenAndServe() }()
+	}
 
 	select {
 	case err := <-e:
@@ -62,5 +151,156 @@ func run(ctx context.Context) error {
 		}
 		return nil
 	}
+}
 
+// newSender returns a Router over the connection strings, which fail
+// over to one another. A single catch:// url keeps the mail in a NATS
+// KV bucket for cmd/web's inbox instead of sending it.
+func newSender(nc *nats.Conn, s string) (smtp.Sender, error) {
+	if cfg, err := smtp.ParseURL(s); err == nil && cfg.Scheme == "catch" {
+		box, err := smtpNATS.NewMailbox(nc, cfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("smtpNATS.NewMailbox: %w", err)
+		}
+		return smtp.NewCatcher(box, cfg), nil
+	}
+
+	r, err := smtp.ParseRouter(s)
+	if err != nil {
+		return nil, fmt.Errorf("smtp.ParseRouter: %w", err)
+	}
+	return r, nil
+}
+
+// verifyEvery is how often the readiness probe verifies the Sender.
+const verifyEvery = time.Minute
+
+// ready is the readiness probe, which fails while the Sender can't be
+// verified. It reports the last time it was, in the background, so
+// each probe doesn't open a session with the server.
+func ready(ctx context.Context, s smtp.Sender) http.Handler {
+	var mu sync.Mutex
+	var last error
+
+	if v, ok := s.(smtp.Verifier); ok {
+		go func() {
+			t := time.NewTicker(verifyEvery)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+
+				vctx, cancel := context.WithTimeout(ctx, smtp.DefaultDialTimeout)
+				_, err := v.Verify(vctx)
+				cancel()
+
+				mu.Lock()
+				last = err
+				mu.Unlock()
+			}
+		}()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		err := last
+		mu.Unlock()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// deliver sends the email to each recipient, logging those that failed
+// and publishing an event for each. The email is retried when nobody got
+// it and every failure was temporary, otherwise it is sent again to just
+// those it failed for temporarily, so nobody gets it twice. Addresses
+// without a mailbox are suppressed so they aren't sent to again, whereas
+// other refusals, such as bad credentials or a broken template, fail the
+// email without blaming the recipients.
+func deliver(m *smtp.Mailer, p smtpNATS.Producer, sup smtp.Suppressions) smtpNATS.Handler {
+	return func(ctx context.Context, e *smtp.Email) error {
+		if e.RetryAt != nil && time.Now().Before(*e.RetryAt) {
+			return smtpNATS.RetryAfter(time.Until(*e.RetryAt))
+		}
+
+		rcpt := e.Recipients[:0:0]
+		for _, r := range e.Recipients {
+			if e.Test {
+				rcpt = append(rcpt, r)
+				continue
+			}
+			ok, err := sup.Suppressed(ctx, r.Address.Address)
+			if err != nil {
+				return fmt.Errorf("deliver: %w", err)
+			}
+			if ok {
+				log.Printf("deliver to %s: suppressed", r.Address.Address)
+				continue
+			}
+			rcpt = append(rcpt, r)
+		}
+		if len(rcpt) == 0 {
+			return nil
+		}
+		ee := *e
+		ee.Recipients = rcpt
+
+		var sent, permanent int
+		var temporary []smtp.Recipient
+		for _, s := range m.Deliver(ctx, &ee) {
+			ev := s.Event()
+			ev.Test = ee.Test
+			if err := p.Publish(smtpNATS.SubjectEvents, ev); err != nil {
+				log.Printf("publish event: %v", err)
+			}
+
+			switch {
+			case s.Err == nil:
+				sent++
+				log.Printf("delivered to %s: %s", s.Recipient.Address.Address, s.Result.Response)
+			case smtp.IsBadMailbox(s.Err) && !ee.Test:
+				permanent++
+				if err := sup.Suppress(ctx, ev); err != nil {
+					log.Printf("suppress %s: %v", s.Recipient.Address.Address, err)
+				}
+				log.Printf("deliver to %s: %v, suppressing", s.Recipient.Address.Address, s.Err)
+			case smtp.IsTemporary(s.Err):
+				temporary = append(temporary, s.Recipient)
+				log.Printf("deliver to %s: %v", s.Recipient.Address.Address, s.Err)
+			default:
+				permanent++
+				log.Printf("deliver to %s: %v", s.Recipient.Address.Address, s.Err)
+			}
+		}
+
+		switch {
+		case len(temporary) == 0 && sent == 0:
+			return fmt.Errorf("deliver: %w", smtpNATS.ErrTerm)
+		case len(temporary) == 0:
+			return nil
+		case sent == 0 && permanent == 0:
+			// redelivered with a backoff, until MaxDeliver
+			return fmt.Errorf("deliver: %d temporary failures", len(temporary))
+		case ee.Attempt+1 >= smtpNATS.MaxDeliver:
+			log.Printf("deliver: giving up on %d recipients after %d attempts", len(temporary), ee.Attempt+1)
+			return nil
+		}
+
+		ee.Recipients = temporary
+		ee.Attempt++
+		at := time.Now().Add(smtpNATS.Backoff(ee.Attempt))
+		ee.RetryAt = &at
+		if err := p.Publish(smtpNATS.SubjectSubscribe, &ee); err != nil {
+			// those who got it may again, which beats the rest never
+			return fmt.Errorf("deliver: %w", err)
+		}
+		return nil
+	}
 }
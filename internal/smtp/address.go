@@ -0,0 +1,93 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Internationalised addresses, RFC 6530, either have a non-ASCII local
+// part, which can only be sent to servers that offer SMTPUTF8, or just
+// a non-ASCII domain, which can be sent anywhere once it is converted
+// to its ASCII, punycode, form.
+
+// asciiAddress converts the address' domain to its ASCII form.
+func asciiAddress(addr string) (string, error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || isASCII(addr[i+1:]) {
+		return addr, nil
+	}
+
+	domain, err := idna.Lookup.ToASCII(addr[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("idna.ToASCII: %w", err)
+	}
+	return addr[:i+1] + domain, nil
+}
+
+// needsSMTPUTF8 reports whether the address has a non-ASCII local part.
+func needsSMTPUTF8(addr string) bool {
+	local := addr
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		local = addr[:i]
+	}
+	return !isASCII(local)
+}
+
+// toASCII returns a copy of the message with the domains of its
+// addresses in their ASCII form, for when SMTPUTF8 can't be used.
+func (m *Message) toASCII() (*Message, error) {
+	mm := *m
+
+	var err error
+	convert := func(addrs []Address) []Address {
+		if addrs == nil {
+			return nil
+		}
+		out := make([]Address, len(addrs))
+		for i, a := range addrs {
+			out[i] = a
+			if err == nil {
+				out[i].Address, err = asciiAddress(a.Address)
+			}
+		}
+		return out
+	}
+
+	mm.From = convert([]Address{m.From})[0]
+	mm.ReplyTo = convert(m.ReplyTo)
+	mm.To = convert(m.To)
+	mm.Cc = convert(m.Cc)
+	mm.Bcc = convert(m.Bcc)
+	if err == nil && m.ReturnPath != "" {
+		mm.ReturnPath, err = asciiAddress(m.ReturnPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mm, nil
+}
+
+// needsSMTPUTF8 returns the first of the message's addresses,
+// in the envelope or headers, that can only be sent with
+// SMTPUTF8, if any.
+func (m *Message) needsSMTPUTF8() (string, bool) {
+	addrs := append([]Address{m.From, {Address: m.returnPath()}}, m.ReplyTo...)
+	for _, a := range append(addrs, m.Recipients()...) {
+		if needsSMTPUTF8(a.Address) {
+			return a.Address, true
+		}
+	}
+	return "", false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"encoding/json"
+	"strconv"
 	"testing"
 )
 
@@ -9,7 +10,7 @@ import (
 func TestEncoding(t *testing.T) {
 	// Test unmarshaling
 	data := `"kristopherab@gmail.com"`
-	
+
 	var addr Address
 	if err := json.Unmarshal([]byte(data), &addr); err != nil {
 		t.Fatal(err)
@@ -25,4 +26,48 @@ func TestEncoding(t *testing.T) {
 	if err := json.Unmarshal([]byte(data), &addr); err == nil {
 		t.Fatal("Expected error")
 	}
-}
\ No newline at end of file
+}
+
+func TestAddressName(t *testing.T) {
+	for _, s := range []string{
+		`"Zoë O'Brien" <zoe@example.com>`,
+		`"Doe, \"JD\" Jane" <jane@example.com>`,
+		`"用户" <用户@例子.广告>`,
+	} {
+		var addr Address
+		if err := json.Unmarshal([]byte(strconv.Quote(s)), &addr); err != nil {
+			t.Fatalf("Unmarshal %s: %v", s, err)
+		}
+
+		p, err := json.Marshal(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var again Address
+		if err := json.Unmarshal(p, &again); err != nil {
+			t.Fatalf("Unmarshal %s: %v", p, err)
+		}
+		if again != addr {
+			t.Fatalf("Expected %+v, got %+v", addr, again)
+		}
+	}
+}
+
+func TestASCIIAddress(t *testing.T) {
+	for addr, want := range map[string]string{
+		"jane@example.com":     "jane@example.com",
+		"jane@bücher.de":       "jane@xn--bcher-kva.de",
+		"用户@例え.テスト":            "用户@xn--r8jz45g.xn--zckzah",
+		"jane@EXAMPLE.com":     "jane@EXAMPLE.com",
+		"zoë@xn--bcher-kva.de": "zoë@xn--bcher-kva.de",
+	} {
+		got, err := asciiAddress(addr)
+		if err != nil {
+			t.Fatalf("asciiAddress %s: %v", addr, err)
+		}
+		if got != want {
+			t.Fatalf("Expected %s, got %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp/dkim"
+)
+
+// NewSender returns the Sender for the Config's Scheme, so the transport
+// can be picked by the URL given to ParseURL. SMTP schemes, and a Config
+// without a Scheme, get a Client.
+func NewSender(cfg *Config) (Sender, error) {
+	switch cfg.Scheme {
+	case "sendgrid":
+		return NewSendGrid(cfg), nil
+	case "mailgun":
+		return NewMailgun(cfg), nil
+	case "postmark":
+		return NewPostmark(cfg), nil
+	case "ses":
+		return NewSES(cfg), nil
+	case "log":
+		if cfg.Path == "stderr" {
+			return NewWriter(os.Stderr, cfg), nil
+		}
+		return NewWriter(os.Stdout, cfg), nil
+	case "file":
+		return NewDir(cfg), nil
+	case "maildir":
+		return NewMaildir(cfg), nil
+	case "mbox":
+		return NewMbox(cfg), nil
+	case "catch":
+		// only seen in this process, see NewCatcher to share them
+		return NewCatcher(NewMemoryMailbox(), cfg), nil
+	}
+
+	if _, ok := presets[cfg.Scheme]; ok || cfg.Scheme == "" || cfg.Scheme == "smtp" || cfg.Scheme == "smtps" {
+		return NewClient(cfg), nil
+	}
+	return nil, fmt.Errorf("unknown scheme: %s", cfg.Scheme)
+}
+
+// apiClient makes the requests for the HTTP API transports.
+type apiClient struct {
+	transport string
+	endpoint  string
+	client    *http.Client
+}
+
+func newAPIClient(transport string, cfg *Config, endpoint string) *apiClient {
+	if cfg.Endpoint != "" {
+		endpoint = cfg.Endpoint
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &apiClient{
+		transport: transport,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// newJSONRequest makes a request with v encoded as the body.
+func (a *apiClient) newJSONRequest(ctx context.Context, path string, v any) (*http.Request, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+path, bytes.NewReader(p))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	return r, nil
+}
+
+// do sends the request, decoding a successful response into v.
+// Failed responses become an Error, with the message picked
+// out of the body by errMsg.
+func (a *apiClient) do(r *http.Request, v any, errMsg func([]byte) string) (*http.Response, error) {
+	resp, err := a.client.Do(r)
+	if err != nil {
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+		// the API could not be reached, which is worth trying again
+		return nil, &Error{Transport: a.transport, Phase: PhaseDial, Message: err.Error(), Err: err}
+	}
+	defer resp.Body.Close()
+
+	p, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s: io.ReadAll: %w", a.transport, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, httpError(a.transport, resp.StatusCode, errMsg(p))
+	}
+
+	if v != nil && len(p) > 0 {
+		if err := json.Unmarshal(p, v); err != nil {
+			return nil, fmt.Errorf("%s: json.Unmarshal: %w", a.transport, err)
+		}
+	}
+	return resp, nil
+}
+
+// withDefaults fills in the From address, Date and Message-ID
+// before a message is handed to an API, so the Result has one.
+func withDefaults(m *Message, from string) (*Message, error) {
+	mm := *m
+	if mm.From.Address == "" {
+		a, err := parseAddress(from)
+		if err != nil {
+			return nil, err
+		}
+		mm.From = a
+	}
+	if mm.Date.IsZero() {
+		mm.Date = time.Now()
+	}
+	if err := mm.validate(); err != nil {
+		return nil, err
+	}
+	m, err := mm.withAlternative()
+	if err != nil {
+		return nil, err
+	}
+	// there is no telling whether the API supports SMTPUTF8
+	if m, err = m.toASCII(); err != nil {
+		return nil, err
+	}
+	if m.MessageID == "" {
+		m.MessageID = newMessageID(m.From)
+	}
+	return m, nil
+}
+
+// apiTo is who a message is addressed to, as the APIs need someone.
+// A message only sent Bcc is addressed to its sender, so none of
+// the recipients see each other.
+func apiTo(m *Message) []Address {
+	if len(m.To) == 0 && len(m.Cc) == 0 {
+		return []Address{m.From}
+	}
+	return m.To
+}
+
+// render writes the message, signing it when there are DKIM options,
+// for transports that send it as is. The MessageID is set so it can
+// be reported back.
+func render(m *Message, opts *dkim.Options) ([]byte, error) {
+	if m.MessageID == "" {
+		m.MessageID = newMessageID(m.From)
+	}
+
+	p, err := m.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		return dkim.Sign(p, opts)
+	}
+	return p, nil
+}
+
+func addressStrings(addrs []Address) []string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = formatAddress(a)
+	}
+	return s
+}
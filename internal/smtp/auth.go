@@ -0,0 +1,264 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthMechanism is an SMTP AUTH mechanism.
+type AuthMechanism string
+
+const (
+	AuthPlain   AuthMechanism = "PLAIN"
+	AuthLogin   AuthMechanism = "LOGIN"
+	AuthCRAMMD5 AuthMechanism = "CRAM-MD5"
+	AuthXOAUTH2 AuthMechanism = "XOAUTH2"
+)
+
+// GoogleTokenURL is where Google's OAuth tokens are refreshed.
+const GoogleTokenURL = "https://oauth2.googleapis.com/token"
+
+// preference is the order mechanisms are picked in when the
+// Config does not name one. Those that refuse to send without
+// TLS are skipped over when there isn't any, see refusesPlaintext.
+var preference = []AuthMechanism{AuthXOAUTH2, AuthPlain, AuthLogin, AuthCRAMMD5}
+
+// auth authenticates the session, unless there are no credentials
+// as with a local relay.
+func auth(s *smtp.Client, cfg *Config) error {
+	if cfg.Username == "" && cfg.Password == "" && cfg.TokenSource == nil {
+		return nil
+	}
+
+	ok, params := s.Extension("AUTH")
+	if !ok {
+		return fmt.Errorf("server %s does not support AUTH", cfg.Hostname)
+	}
+
+	offered := make(map[AuthMechanism]bool)
+	for _, m := range strings.Fields(params) {
+		offered[AuthMechanism(strings.ToUpper(m))] = true
+	}
+
+	_, secure := s.TLSConnectionState()
+
+	mech := cfg.Auth
+	if mech == "" {
+		// a TokenSource means XOAUTH2, a password means anything else
+		for _, m := range preference {
+			if offered[m] && (m == AuthXOAUTH2) == (cfg.TokenSource != nil) && (secure || !refusesPlaintext(m, cfg.Hostname)) {
+				mech = m
+				break
+			}
+		}
+		if mech == "" {
+			return fmt.Errorf("no supported auth mechanism in %q", params)
+		}
+	} else if !offered[mech] {
+		return fmt.Errorf("server %s does not support AUTH %s", cfg.Hostname, mech)
+	}
+
+	a, err := newAuth(mech, cfg)
+	if err != nil {
+		return err
+	}
+	return s.Auth(a)
+}
+
+// refusesPlaintext reports whether the mechanism refuses to send
+// the password as is to the host without TLS. net/smtp's PLAIN
+// only makes an exception for localhost, 127.0.0.1 and ::1.
+func refusesPlaintext(mech AuthMechanism, host string) bool {
+	switch mech {
+	case AuthPlain:
+		return host != "localhost" && host != "127.0.0.1" && host != "::1"
+	case AuthLogin, AuthXOAUTH2:
+		return !isLocalhost(host)
+	}
+	return false
+}
+
+func newAuth(mech AuthMechanism, cfg *Config) (smtp.Auth, error) {
+	switch mech {
+	case AuthPlain:
+		return smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Hostname), nil
+	case AuthLogin:
+		return &loginAuth{cfg.Username, cfg.Password, cfg.Hostname}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(cfg.Username, cfg.Password), nil
+	case AuthXOAUTH2:
+		if cfg.TokenSource == nil {
+			return nil, fmt.Errorf("auth %s needs a TokenSource", mech)
+		}
+		return &xoauth2Auth{cfg.Username, cfg.TokenSource}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mechanism: %s", mech)
+	}
+}
+
+// loginAuth implements the LOGIN mechanism which, like PLAIN,
+// sends the password as is and so refuses to without TLS.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return string(AuthLogin), nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch prompt := strings.ToLower(string(fromServer)); {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
+
+// xoauth2Auth implements Google and Microsoft's XOAUTH2 mechanism.
+type xoauth2Auth struct {
+	username string
+	ts       TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	tok, err := a.ts.Token()
+	if err != nil {
+		return "", nil, fmt.Errorf("ts.Token: %w", err)
+	}
+
+	resp := "user=" + a.username + "\x01auth=Bearer " + tok.AccessToken + "\x01\x01"
+	return string(AuthXOAUTH2), []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends the reason as a challenge, replying with
+		// nothing gets us the error that goes with it
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// Token is an OAuth access token.
+type Token struct {
+	AccessToken string
+	// Expiry is when the token stops working.
+	// The zero value means it does not expire.
+	Expiry time.Time
+}
+
+// valid reports whether the token can still be used, leaving a
+// minute spare so it does not expire part way through a handshake.
+func (t *Token) valid() bool {
+	return t != nil && t.AccessToken != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > time.Minute)
+}
+
+// TokenSource supplies the access tokens used by XOAUTH2.
+type TokenSource interface {
+	Token() (*Token, error)
+}
+
+// StaticTokenSource always returns the same token.
+type StaticTokenSource string
+
+func (s StaticTokenSource) Token() (*Token, error) {
+	return &Token{AccessToken: string(s)}, nil
+}
+
+// RefreshTokenSource swaps a refresh token for access tokens,
+// keeping the current one until it is about to expire.
+type RefreshTokenSource struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	// TokenURL defaults to GoogleTokenURL.
+	TokenURL string
+	// Client defaults to a client with a 30 second timeout.
+	Client *http.Client
+
+	mu  sync.Mutex
+	tok *Token
+}
+
+func (s *RefreshTokenSource) Token() (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok.valid() {
+		return s.tok, nil
+	}
+
+	tok, err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+func (s *RefreshTokenSource) refresh() (*Token, error) {
+	tokenURL := s.TokenURL
+	if tokenURL == "" {
+		tokenURL = GoogleTokenURL
+	}
+
+	c := s.Client
+	if c == nil {
+		c = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	resp, err := c.PostForm(tokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("c.PostForm: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("json.NewDecoder: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return nil, fmt.Errorf("refresh token: %s %s: %s", resp.Status, body.Error, body.Description)
+	}
+
+	tok := &Token{AccessToken: body.AccessToken}
+	if body.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
@@ -0,0 +1,128 @@
+package smtp_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/adoublef/pinkpink/internal/smtp/smtptest"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestClientAuth(t *testing.T) {
+	tt := []struct {
+		name    string
+		offered []string
+		auth    smtp.AuthMechanism
+		token   smtp.TokenSource
+		pass    string
+		want    string
+	}{
+		{name: "prefer plain", offered: []string{"CRAM-MD5", "LOGIN", "PLAIN"}, want: "PLAIN"},
+		{name: "login", offered: []string{"LOGIN"}, want: "LOGIN"},
+		{name: "cram-md5", offered: []string{"CRAM-MD5"}, want: "CRAM-MD5"},
+		{name: "configured", offered: []string{"PLAIN", "LOGIN"}, auth: smtp.AuthLogin, want: "LOGIN"},
+		{name: "xoauth2", offered: []string{"PLAIN", "XOAUTH2"}, token: smtp.StaticTokenSource("token"), want: "XOAUTH2"},
+		{name: "not offered", offered: []string{"PLAIN"}, auth: smtp.AuthCRAMMD5},
+		{name: "no common mechanism", offered: []string{"GSSAPI"}},
+		{name: "wrong password", offered: []string{"LOGIN"}, pass: "guess"},
+		{name: "expired token", offered: []string{"XOAUTH2"}, token: smtp.StaticTokenSource("expired")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			srv := newTestServer(t, func(s *smtptest.Server) { s.Auth = tc.offered })
+			cfg := srv.Config()
+			cfg.Auth, cfg.TokenSource = tc.auth, tc.token
+			if tc.pass != "" {
+				cfg.Password = tc.pass
+			}
+
+			c := smtp.NewClient(cfg)
+			t.Cleanup(func() { c.Close() })
+
+			_, err := c.Send(context.Background(), newTestMessage())
+			if tc.want == "" {
+				is.True(err != nil) // authentication should fail
+				return
+			}
+			is.NoErr(err) // send email
+
+			mechs := srv.Mechanisms()
+			is.Equal(len(mechs), 1)
+			is.Equal(mechs[0], tc.want) // mechanism used
+		})
+	}
+
+	t.Run("plaintext", func(t *testing.T) {
+		is := is.New(t)
+
+		// net/smtp refuses PLAIN without TLS to anything but
+		// localhost, 127.0.0.1 and ::1, CRAM-MD5 doesn't
+		srv := newTestServer(t, func(s *smtptest.Server) {
+			s.Auth = []string{"PLAIN", "CRAM-MD5"}
+			s.NoStartTLS = true
+		})
+		cfg := srv.Config()
+		cfg.Hostname, cfg.TLS = "::ffff:127.0.0.1", smtp.TLSOpportunistic
+
+		c := smtp.NewClient(cfg)
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), newTestMessage())
+		is.NoErr(err) // send email
+		is.Equal(srv.Mechanisms(), []string{"CRAM-MD5"})
+	})
+}
+
+func TestRefreshTokenSource(t *testing.T) {
+	var n int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Bad Request"}`)
+			return
+		}
+		n++
+		// a token that expires within the minute is always refreshed
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":%s,"token_type":"Bearer"}`, n, r.FormValue("client_id"))
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Run("cache token", func(t *testing.T) {
+		is := is.New(t)
+
+		n = 0
+		ts := &smtp.RefreshTokenSource{ClientID: "3600", RefreshToken: "refresh", TokenURL: srv.URL}
+		for i := 0; i < 2; i++ {
+			tok, err := ts.Token()
+			is.NoErr(err) // get token
+			is.Equal(tok.AccessToken, "token-1")
+		}
+	})
+
+	t.Run("refresh expiring token", func(t *testing.T) {
+		is := is.New(t)
+
+		n = 0
+		ts := &smtp.RefreshTokenSource{ClientID: "30", RefreshToken: "refresh", TokenURL: srv.URL}
+		for i := 1; i <= 2; i++ {
+			tok, err := ts.Token()
+			is.NoErr(err) // get token
+			is.Equal(tok.AccessToken, fmt.Sprintf("token-%d", i))
+		}
+	})
+
+	t.Run("invalid grant", func(t *testing.T) {
+		is := is.New(t)
+
+		ts := &smtp.RefreshTokenSource{RefreshToken: "revoked", TokenURL: srv.URL}
+		_, err := ts.Token()
+		is.True(err != nil) // refresh rejected
+	})
+}
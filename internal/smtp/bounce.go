@@ -0,0 +1,342 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// ErrNotBounce is returned by ParseBounce for mail that
+// doesn't look like a bounce, such as an auto-reply.
+var ErrNotBounce = errors.New("not a bounce")
+
+// BounceType is whether a bounce is worth retrying.
+type BounceType string
+
+const (
+	// BounceHard is a mailbox that doesn't exist, the same failures
+	// IsBadMailbox is for. The address shouldn't be sent to again.
+	BounceHard BounceType = "hard"
+	// BounceSoft is any other failure, such as a full mailbox, a
+	// delay warning or the message being refused as spam, which
+	// says nothing about the address itself.
+	BounceSoft BounceType = "soft"
+	// BounceUndetermined is a bounce without a status code, so
+	// there is no telling why it bounced.
+	BounceUndetermined BounceType = "undetermined"
+)
+
+// Bounce is a single recipient that a message couldn't be delivered to.
+type Bounce struct {
+	// Recipient is the address the message was sent to.
+	Recipient string `json:"recipient"`
+	// MessageID is the Message-ID of the message that bounced,
+	// when it could be found.
+	MessageID string     `json:"messageId,omitempty"`
+	Type      BounceType `json:"type"`
+	// Status is the enhanced status code, such as "5.1.1", or
+	// empty when the bounce didn't have one.
+	Status string `json:"status,omitempty"`
+	// Diagnostic is what the remote server said, when it is known.
+	Diagnostic string `json:"diagnostic,omitempty"`
+}
+
+// ParseBounce reads the bounces out of a delivery status notification,
+// as described by RFC 3464, or from the plain text bounces sent by
+// servers such as Exim, Postfix and qmail. When the bounce was sent
+// to a VERP return path the recipient and message are taken from it,
+// as they can be trusted more than the report.
+func ParseBounce(r io.Reader) ([]Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("mail.ReadMessage: %w", err)
+	}
+
+	var status, text []byte
+	var original mail.Header
+	err = walkParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body,
+		func(mediaType string, p []byte) {
+			switch mediaType {
+			case "message/delivery-status", "message/global-delivery-status":
+				status = p
+			case "message/rfc822", "message/global", "text/rfc822-headers", "message/global-headers":
+				if m, err := mail.ReadMessage(bytes.NewReader(p)); err == nil {
+					original = m.Header
+				}
+			case "text/plain":
+				if text == nil {
+					text = p
+				}
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var bounces []Bounce
+	if status != nil {
+		bounces = parseDeliveryStatus(status)
+	} else {
+		if !looksLikeBounce(msg.Header) {
+			return nil, ErrNotBounce
+		}
+		bounces = parsePlainBounce(msg.Header, text)
+	}
+
+	id, rcpt, ok := bounceVERP(msg.Header)
+	if ok {
+		// servers that forward mail report the final address, which
+		// isn't one that was sent to
+		switch len(bounces) {
+		case 0:
+			bounces = append(bounces, plainStatus(msg.Header, text, rcpt))
+		case 1:
+			bounces[0].Recipient = rcpt
+		}
+	}
+	if len(bounces) == 0 {
+		return nil, ErrNotBounce
+	}
+
+	var messageID string
+	if original != nil {
+		messageID = strings.Trim(original.Get("Message-Id"), "<> ")
+	}
+	if messageID == "" && ok {
+		messageID = id
+	}
+	for i := range bounces {
+		bounces[i].MessageID = messageID
+	}
+	return bounces, nil
+}
+
+// parseDeliveryStatus reads the per-recipient fields of a delivery
+// status, skipping those that were delivered after all.
+func parseDeliveryStatus(p []byte) []Bounce {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(p)))
+
+	// the blocks are split by blank lines
+	var blocks []textproto.MIMEHeader
+	for {
+		h, err := tp.ReadMIMEHeader()
+		if len(h) > 0 {
+			blocks = append(blocks, h)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	var bounces []Bounce
+	// the first block is about the message rather than a recipient
+	for i := 1; i < len(blocks); i++ {
+		if b, ok := recipientStatus(blocks[i]); ok {
+			bounces = append(bounces, b)
+		}
+	}
+	return bounces
+}
+
+func recipientStatus(h textproto.MIMEHeader) (Bounce, bool) {
+	action := strings.ToLower(strings.TrimSpace(h.Get("Action")))
+	if action != "failed" && action != "delayed" {
+		return Bounce{}, false
+	}
+
+	rcpt := h.Get("Original-Recipient")
+	if rcpt == "" {
+		rcpt = h.Get("Final-Recipient")
+	}
+	// the address type, usually rfc822, comes first
+	if _, addr, ok := strings.Cut(rcpt, ";"); ok {
+		rcpt = addr
+	}
+
+	b := Bounce{Recipient: strings.Trim(rcpt, "<> \t"), Status: strings.TrimSpace(h.Get("Status"))}
+	if s, _, ok := strings.Cut(b.Status, " "); ok {
+		b.Status = s
+	}
+	if _, d, ok := strings.Cut(h.Get("Diagnostic-Code"), ";"); ok {
+		b.Diagnostic = strings.TrimSpace(d)
+	}
+	if b.Status == "" {
+		b.Status = codeStatus(b.Diagnostic, action == "delayed")
+	}
+
+	b.Type = bounceType(b.Status)
+	if action == "delayed" {
+		b.Type = BounceSoft
+	}
+	return b, b.Recipient != ""
+}
+
+// bounceType is hard only for a mailbox that doesn't exist, as
+// policy and spam rejections are about the message, not the address.
+func bounceType(status string) BounceType {
+	switch {
+	case status == "":
+		return BounceUndetermined
+	case badMailbox[status]:
+		return BounceHard
+	}
+	return BounceSoft
+}
+
+var (
+	// bounceSubject matches the subjects of common bounces.
+	bounceSubject = regexp.MustCompile(`(?i)undeliver|undelivered|delivery (status|failure|has failed|notification)|returned (mail|to sender)|failure notice|mail delivery|delayed mail|delivery delayed`)
+	// delaySubject matches warnings that are retried by the server.
+	delaySubject = regexp.MustCompile(`(?i)delay`)
+	// replyCode matches a failed smtp reply, with its enhanced code if it has one.
+	replyCode = regexp.MustCompile(`\b([45]\d\d)[ -](?:([45]\.\d{1,3}\.\d{1,3})\b)?`)
+	// bracketed matches the "<user@example.com>:" lines of Postfix and qmail.
+	bracketed = regexp.MustCompile(`(?m)^\s*<([^\s<>]+@[^\s<>]+)>:`)
+	// indented matches the lone, indented addresses of Exim.
+	indented = regexp.MustCompile(`(?m)^[ \t]+([^\s<>:]+@[^\s<>:]+)[ \t]*$`)
+)
+
+// looksLikeBounce reports whether a message without a delivery
+// status is still a bounce.
+func looksLikeBounce(h mail.Header) bool {
+	if h.Get("X-Failed-Recipients") != "" {
+		return true
+	}
+	if addr, err := mail.ParseAddress(h.Get("From")); err == nil {
+		local, _, _ := strings.Cut(strings.ToLower(addr.Address), "@")
+		if local == "mailer-daemon" || local == "postmaster" {
+			return true
+		}
+	}
+	return bounceSubject.MatchString(h.Get("Subject"))
+}
+
+// parsePlainBounce finds the recipients in the X-Failed-Recipients
+// header or else the body, giving them all the same status.
+func parsePlainBounce(h mail.Header, text []byte) []Bounce {
+	var rcpts []string
+	for _, r := range strings.Split(h.Get("X-Failed-Recipients"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			rcpts = append(rcpts, r)
+		}
+	}
+	if len(rcpts) == 0 {
+		for _, re := range []*regexp.Regexp{bracketed, indented} {
+			for _, m := range re.FindAllSubmatch(text, -1) {
+				rcpts = append(rcpts, string(m[1]))
+			}
+			if len(rcpts) > 0 {
+				break
+			}
+		}
+	}
+
+	bounces := make([]Bounce, 0, len(rcpts))
+	for _, r := range rcpts {
+		bounces = append(bounces, plainStatus(h, text, r))
+	}
+	return bounces
+}
+
+// plainStatus takes the status from the first smtp reply in the text,
+// guessing from the subject when there isn't one.
+func plainStatus(h mail.Header, text []byte, rcpt string) Bounce {
+	delayed := delaySubject.MatchString(h.Get("Subject"))
+
+	b := Bounce{Recipient: rcpt}
+	for _, line := range strings.Split(string(text), "\n") {
+		if replyCode.MatchString(line) {
+			b.Diagnostic = strings.TrimSpace(line)
+			break
+		}
+	}
+	b.Status = codeStatus(b.Diagnostic, delayed)
+
+	b.Type = bounceType(b.Status)
+	if delayed {
+		b.Type = BounceSoft
+	}
+	return b
+}
+
+// codeStatus is the enhanced status code in the diagnostic, or the
+// class of its reply code when it doesn't have one. Without either
+// there is no status, unless the bounce is only a delay.
+func codeStatus(diagnostic string, delayed bool) string {
+	m := replyCode.FindStringSubmatch(diagnostic)
+	switch {
+	case m != nil && m[2] != "":
+		return m[2]
+	case m != nil:
+		return m[1][:1] + ".0.0"
+	case delayed:
+		return "4.0.0"
+	default:
+		return ""
+	}
+}
+
+// verpAddress matches the local part of a VERP return path.
+var verpAddress = regexp.MustCompile(`\+([0-9A-Za-z]+)-(.+)=([^=@]+)$`)
+
+// VERP returns the return path that a message, with the id, sent to
+// rcpt should use so its bounces can be matched back to them:
+//
+//	VERP("bounces@example.com", "1a2b", "jo@example.org") == "bounces+1a2b-jo=example.org@example.com"
+//
+// The id should be letters and digits only.
+func VERP(returnPath, id, rcpt string) string {
+	local, domain, _ := strings.Cut(returnPath, "@")
+	return local + "+" + id + "-" + strings.Replace(rcpt, "@", "=", 1) + "@" + domain
+}
+
+// ParseVERP undoes VERP, returning the id and recipient.
+func ParseVERP(addr string) (id, rcpt string, ok bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", "", false
+	}
+
+	m := verpAddress.FindStringSubmatch(addr[:i])
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2] + "@" + m[3], true
+}
+
+// bounceVERP finds the VERP return path the bounce was sent to,
+// returning the Message-ID the Mailer gave to the message.
+func bounceVERP(h mail.Header) (messageID, rcpt string, ok bool) {
+	for _, k := range []string{"X-Original-To", "Delivered-To", "Envelope-To", "X-Envelope-To", "To"} {
+		addr, err := mail.ParseAddress(h.Get(k))
+		if err != nil {
+			continue
+		}
+		if id, rcpt, ok := ParseVERP(addr.Address); ok {
+			return verpMessageID(id, addr.Address), rcpt, true
+		}
+	}
+	return "", "", false
+}
+
+// newVERPID returns an id for VERP.
+func newVERPID() string {
+	p := make([]byte, 8)
+	rand.Read(p)
+	return hex.EncodeToString(p)
+}
+
+// verpMessageID is the Message-ID of a message with the VERP id,
+// which shares the domain of its return path.
+func verpMessageID(id, returnPath string) string {
+	_, domain, _ := strings.Cut(returnPath, "@")
+	return id + "@" + domain
+}
@@ -0,0 +1,188 @@
+package smtp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+// dsn is a delivery status notification as Postfix sends them.
+const dsn = "From: MAILER-DAEMON@mx.example.org (Mail Delivery System)\r\n" +
+	"To: news@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"Arrival-Date: Mon, 19 Oct 2026 12:00:00 +0000\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; gone@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <gone@example.org>: Recipient address rejected\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; full@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.2.2\r\n" +
+	"Diagnostic-Code: smtp; 552 5.2.2 Mailbox full\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; slow@example.org\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; fine@example.org\r\n" +
+	"Action: delivered\r\n" +
+	"Status: 2.0.0\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: news@example.com\r\n" +
+	"Message-ID: <1.abc@example.com>\r\n" +
+	"Subject: Newsletter\r\n" +
+	"--b1--\r\n"
+
+func TestParseBounce(t *testing.T) {
+	t.Run("delivery status", func(t *testing.T) {
+		is := is.New(t)
+
+		bounces, err := smtp.ParseBounce(strings.NewReader(dsn))
+		is.NoErr(err)             // parse bounce
+		is.Equal(len(bounces), 3) // delivered recipient skipped
+
+		is.Equal(bounces[0], smtp.Bounce{
+			Recipient:  "gone@example.org",
+			MessageID:  "1.abc@example.com",
+			Type:       smtp.BounceHard,
+			Status:     "5.1.1",
+			Diagnostic: "550 5.1.1 <gone@example.org>: Recipient address rejected",
+		})
+		is.Equal(bounces[1].Type, smtp.BounceSoft) // full mailbox
+		is.Equal(bounces[2].Type, smtp.BounceSoft) // delayed
+		is.Equal(bounces[2].Status, "4.4.1")
+	})
+
+	t.Run("exim", func(t *testing.T) {
+		is := is.New(t)
+
+		bounce := "From: Mail Delivery System <Mailer-Daemon@mx.example.org>\r\n" +
+			"Subject: Mail delivery failed: returning message to sender\r\n" +
+			"X-Failed-Recipients: gone@example.org\r\n" +
+			"\r\n" +
+			"This message was created automatically by mail delivery software.\r\n" +
+			"\r\n" +
+			"  gone@example.org\r\n" +
+			"    SMTP error from remote mail server after RCPT TO:<gone@example.org>:\r\n" +
+			"    550 No such user here\r\n"
+
+		bounces, err := smtp.ParseBounce(strings.NewReader(bounce))
+		is.NoErr(err) // parse bounce
+		is.Equal(len(bounces), 1)
+		is.Equal(bounces[0].Recipient, "gone@example.org")
+		is.Equal(bounces[0].Status, "5.0.0") // from the reply code
+		// which isn't enough to say the mailbox doesn't exist
+		is.Equal(bounces[0].Type, smtp.BounceSoft)
+		is.Equal(bounces[0].Diagnostic, "550 No such user here")
+	})
+
+	t.Run("qmail", func(t *testing.T) {
+		is := is.New(t)
+
+		bounce := "From: MAILER-DAEMON@mx.example.org\r\n" +
+			"Subject: failure notice\r\n" +
+			"\r\n" +
+			"Hi. This is the qmail-send program at mx.example.org.\r\n" +
+			"\r\n" +
+			"<gone@example.org>:\r\n" +
+			"Sorry, no mailbox here by that name. (#5.1.1)\r\n" +
+			"Remote host said: 550 5.1.1 unknown user\r\n"
+
+		bounces, err := smtp.ParseBounce(strings.NewReader(bounce))
+		is.NoErr(err) // parse bounce
+		is.Equal(len(bounces), 1)
+		is.Equal(bounces[0].Recipient, "gone@example.org")
+		is.Equal(bounces[0].Status, "5.1.1")
+		is.Equal(bounces[0].Type, smtp.BounceHard)
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		is := is.New(t)
+
+		bounce := "From: MAILER-DAEMON@mx.example.org\r\n" +
+			"Subject: Undelivered Mail Returned to Sender\r\n" +
+			"X-Failed-Recipients: jo@example.org\r\n" +
+			"\r\n" +
+			"550 5.7.1 Message rejected as spam\r\n"
+
+		bounces, err := smtp.ParseBounce(strings.NewReader(bounce))
+		is.NoErr(err) // parse bounce
+		is.Equal(bounces[0].Status, "5.7.1")
+		is.Equal(bounces[0].Type, smtp.BounceSoft) // the address is fine
+	})
+
+	t.Run("undetermined", func(t *testing.T) {
+		is := is.New(t)
+
+		bounce := "From: MAILER-DAEMON@mx.example.org\r\n" +
+			"Subject: failure notice\r\n" +
+			"\r\n" +
+			"<jo@example.org>:\r\n" +
+			"Sorry, it didn't work out.\r\n"
+
+		bounces, err := smtp.ParseBounce(strings.NewReader(bounce))
+		is.NoErr(err) // parse bounce
+		is.Equal(bounces[0].Status, "")
+		is.Equal(bounces[0].Type, smtp.BounceUndetermined)
+	})
+
+	t.Run("verp", func(t *testing.T) {
+		is := is.New(t)
+
+		// the report names the address the mail was forwarded to
+		p := strings.Replace(dsn, "To: news@example.com", "To: "+smtp.VERP("bounces@example.com", "f00d", "jo@example.net"), 1)
+		p = strings.Replace(p, "Message-ID: <1.abc@example.com>\r\n", "", 1)
+		p = p[:strings.Index(p, "Final-Recipient: rfc822; full")] + p[strings.Index(p, "--b1\r\nContent-Type: text/rfc822"):]
+
+		bounces, err := smtp.ParseBounce(strings.NewReader(p))
+		is.NoErr(err) // parse bounce
+		is.Equal(len(bounces), 1)
+		is.Equal(bounces[0].Recipient, "jo@example.net")
+		is.Equal(bounces[0].MessageID, "f00d@example.com")
+	})
+
+	t.Run("not a bounce", func(t *testing.T) {
+		is := is.New(t)
+
+		reply := "From: jo@example.net\r\n" +
+			"Subject: Re: Newsletter\r\n" +
+			"\r\n" +
+			"Thanks!\r\n"
+
+		_, err := smtp.ParseBounce(strings.NewReader(reply))
+		is.True(errors.Is(err, smtp.ErrNotBounce))
+	})
+}
+
+func TestVERP(t *testing.T) {
+	is := is.New(t)
+
+	addr := smtp.VERP("bounces@example.com", "1a2b", "jo+news@example.net")
+	is.Equal(addr, "bounces+1a2b-jo+news=example.net@example.com")
+
+	id, rcpt, ok := smtp.ParseVERP(addr)
+	is.True(ok) // verp address
+	is.Equal(id, "1a2b")
+	is.Equal(rcpt, "jo+news@example.net")
+
+	_, _, ok = smtp.ParseVERP("bounces@example.com")
+	is.True(!ok) // plain address
+}
@@ -0,0 +1,225 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp/dkim"
+)
+
+// ErrNotFound is returned by a Mailbox for a message it doesn't have.
+var ErrNotFound = errors.New("message not found")
+
+// Caught is a message kept by a Catcher rather than sent.
+type Caught struct {
+	// ID is unique to the Mailbox, unlike the Message-ID.
+	ID        string    `json:"id"`
+	MessageID string    `json:"messageId"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject"`
+	Date      time.Time `json:"date"`
+	// Raw is the message as it would have been sent.
+	Raw []byte `json:"raw"`
+}
+
+// Body picks the plain text and html bodies out of the message,
+// whichever of them it has.
+func (c *Caught) Body() (text, html string, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(c.Raw))
+	if err != nil {
+		return "", "", fmt.Errorf("mail.ReadMessage: %w", err)
+	}
+
+	err = walkParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body,
+		func(mediaType string, p []byte) {
+			switch {
+			case mediaType == "text/plain" && text == "":
+				text = string(p)
+			case mediaType == "text/html" && html == "":
+				html = string(p)
+			}
+		})
+	return text, html, err
+}
+
+// walkParts calls f with each decoded part that isn't multipart.
+func walkParts(contentType, encoding string, r io.Reader, f func(mediaType string, p []byte)) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			// NextRawPart leaves the transfer encoding to be undone here
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("mr.NextRawPart: %w", err)
+			}
+			if err := walkParts(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p, f); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	p, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: %w", err)
+	}
+	f(mediaType, p)
+	return nil
+}
+
+// Mailbox is where a Catcher keeps the messages it catches.
+type Mailbox interface {
+	Put(ctx context.Context, c *Caught) error
+	// Get returns ErrNotFound if there is no message with the id.
+	Get(ctx context.Context, id string) (*Caught, error)
+	// List returns every message, newest first.
+	List(ctx context.Context) ([]*Caught, error)
+	// Delete returns ErrNotFound if there is no message with the id.
+	Delete(ctx context.Context, id string) error
+	// Clear deletes every message.
+	Clear(ctx context.Context) error
+}
+
+var _ Sender = (*Catcher)(nil)
+
+// Catcher keeps messages in a Mailbox instead of sending them,
+// so they can be looked at without real inboxes.
+type Catcher struct {
+	box  Mailbox
+	from string
+	dkim *dkim.Options
+}
+
+// NewCatcher returns a Sender that keeps messages in the Mailbox.
+func NewCatcher(box Mailbox, cfg *Config) *Catcher {
+	return &Catcher{box: box, from: cfg.From, dkim: cfg.DKIM}
+}
+
+func (c *Catcher) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, p, err := devRender(m, c.from, c.dkim)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+
+	caught := &Caught{
+		ID:        hex.EncodeToString(id),
+		MessageID: m.MessageID,
+		From:      m.From.Address,
+		Subject:   m.Subject,
+		Date:      m.Date,
+		Raw:       p,
+	}
+	for _, a := range m.Recipients() {
+		caught.To = append(caught.To, a.Address)
+	}
+
+	if err := c.box.Put(ctx, caught); err != nil {
+		return nil, fmt.Errorf("box.Put: %w", err)
+	}
+	return &Result{MessageID: m.MessageID, QueueID: caught.ID, Code: 250, Response: "caught as " + caught.ID}, nil
+}
+
+var _ Mailbox = (*MemoryMailbox)(nil)
+
+// MemoryMailbox keeps messages in memory, for tests and
+// for when the Catcher and inbox share a process.
+type MemoryMailbox struct {
+	mu   sync.Mutex
+	msgs map[string]*Caught
+}
+
+func NewMemoryMailbox() *MemoryMailbox {
+	return &MemoryMailbox{msgs: make(map[string]*Caught)}
+}
+
+func (b *MemoryMailbox) Put(ctx context.Context, c *Caught) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs[c.ID] = c
+	return nil
+}
+
+func (b *MemoryMailbox) Get(ctx context.Context, id string) (*Caught, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.msgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return c, nil
+}
+
+func (b *MemoryMailbox) List(ctx context.Context) ([]*Caught, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := make([]*Caught, 0, len(b.msgs))
+	for _, c := range b.msgs {
+		list = append(list, c)
+	}
+	SortCaught(list)
+	return list, nil
+}
+
+func (b *MemoryMailbox) Delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.msgs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(b.msgs, id)
+	return nil
+}
+
+func (b *MemoryMailbox) Clear(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs = make(map[string]*Caught)
+	return nil
+}
+
+// SortCaught sorts the messages newest first.
+func SortCaught(list []*Caught) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Date.Equal(list[j].Date) {
+			return list[i].ID > list[j].ID
+		}
+		return list[i].Date.After(list[j].Date)
+	})
+}
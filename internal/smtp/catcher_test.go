@@ -0,0 +1,57 @@
+package smtp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestCatcher(t *testing.T) {
+	is := is.New(t)
+
+	box := smtp.NewMemoryMailbox()
+	c := smtp.NewCatcher(box, &smtp.Config{From: "news@example.com"})
+
+	m := newTestMessage()
+	m.Text = "Hello World"
+	m.Attach("a.txt", []byte("attached"))
+
+	res, err := c.Send(context.Background(), m)
+	is.NoErr(err) // send email
+
+	caught, err := box.Get(context.Background(), res.QueueID)
+	is.NoErr(err) // get caught message
+	is.Equal(caught.From, "news@example.com")
+	is.Equal(caught.To, []string{"to@example.com"})
+	is.Equal(caught.Subject, "Subject")
+	is.Equal(caught.MessageID, res.MessageID)
+
+	text, html, err := caught.Body()
+	is.NoErr(err) // read body
+	is.Equal(text, "Hello World")
+	is.Equal(html, "<h1>Hello World</h1>")
+
+	_, err = c.Send(context.Background(), newTestMessage())
+	is.NoErr(err) // send another
+
+	// catch://inbox has no from, nor does the worker's mailer
+	res2, err := smtp.NewCatcher(box, parseURL(t, "catch://inbox")).Send(context.Background(), newTestMessage())
+	is.NoErr(err) // send without a from
+	caught, err = box.Get(context.Background(), res2.QueueID)
+	is.NoErr(err) // get caught message
+	is.Equal(caught.From, smtp.DevFrom)
+
+	list, err := box.List(context.Background())
+	is.NoErr(err) // list messages
+	is.Equal(len(list), 3)
+
+	is.NoErr(box.Delete(context.Background(), res.QueueID))                             // delete message
+	is.True(errors.Is(box.Delete(context.Background(), res.QueueID), smtp.ErrNotFound)) // already deleted
+
+	is.NoErr(box.Clear(context.Background())) // clear mailbox
+	list, _ = box.List(context.Background())
+	is.Equal(len(list), 0)
+}
@@ -1,31 +1,92 @@
 package smtp
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/x509"
 	"fmt"
-	"net/smtp"
-	"net/url"
-	"strings"
+	"sync"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp/dkim"
+)
+
+// defaults used when the Config leaves them unset
+const (
+	DefaultMaxConns    = 2
+	DefaultMaxMessages = 100
+	DefaultIdleTimeout = 30 * time.Second
+	DefaultDialTimeout = 30 * time.Second
+	DefaultTimeout     = 5 * time.Minute
 )
 
+// TLSMode decides how a session is secured.
+type TLSMode string
+
 const (
-	GoogleHost = "smtp.gmail.com"
+	// TLSStartTLS requires the server to support STARTTLS.
+	// This is the default.
+	TLSStartTLS TLSMode = "starttls"
+	// TLSOpportunistic upgrades with STARTTLS when the server offers it
+	// and otherwise carries on in plaintext.
+	TLSOpportunistic TLSMode = "opportunistic"
+	// TLSImplicit connects over TLS from the start (SMTPS),
+	// usually on port 465.
+	TLSImplicit TLSMode = "implicit"
+	// TLSNone never uses TLS and is only allowed for local hosts.
+	TLSNone TLSMode = "none"
 )
 
 // Sender is an interface for sending emails.
 type Sender interface {
-	// Send sends an email to the given recipients.
-	Send(subject string, msg string, to ...string) error
+	// Send sends the message to its recipients, giving up
+	// when the context is done.
+	Send(ctx context.Context, m *Message) (*Result, error)
 }
 
+// Result is what the server said after accepting a message.
+type Result struct {
+	// MessageID is the Message-ID the message was sent with.
+	MessageID string
+	// QueueID is the id the server queued the message under,
+	// when it says what that is.
+	QueueID string
+	// Code is the reply code, such as 250.
+	Code int
+	// Response is the text of the reply, such as "2.0.0 Ok: queued as 4F1A".
+	Response string
+	// Rejected are the recipients the server refused,
+	// the message was sent to the rest.
+	Rejected []Rejection
+}
+
+// Rejection is a recipient the server refused.
+type Rejection struct {
+	Address string
+	Err     error
+}
+
+var _ Sender = (*Client)(nil)
+
 // Client is a client for sending emails.
 // All fields are exported in-case, you want to set them manually.
+//
+// Authenticated sessions are kept open and reused between calls to Send,
+// so a Client should be closed once it is no longer needed.
 type Client struct {
 	cfg *Config
+
+	// sem limits the number of sessions that can be open at once
+	sem chan struct{}
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
 }
 
 type Config struct {
+	// Scheme is the transport the Config is for, as set by ParseURL.
+	// NewSender uses it to pick the Sender, empty means SMTP.
+	Scheme string
 	// Username is client's email address Username
 	Username string
 	// Password is client's app Password for their email
@@ -36,107 +97,301 @@ type Config struct {
 	Hostname string
 	// Port is the Port that the smtp server is listening on
 	Port string
+	// MaxConns is the maximum number of sessions kept open at once.
+	// Defaults to DefaultMaxConns.
+	MaxConns int
+	// MaxMessages is the number of messages sent over a session
+	// before it is closed and a new one is dialed.
+	// Defaults to DefaultMaxMessages.
+	MaxMessages int
+	// IdleTimeout is how long a session can sit unused in the pool
+	// before it is closed. Defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// TLS is how the session is secured. Defaults to TLSStartTLS.
+	TLS TLSMode
+	// RootCAs are used to verify the server's certificate.
+	// When nil the host's root CAs are used.
+	RootCAs *x509.CertPool
+	// Auth is the mechanism used to authenticate. When empty one is
+	// picked from those the server advertises. No authentication is
+	// done when there is no Username, Password or TokenSource.
+	Auth AuthMechanism
+	// TokenSource supplies the access tokens for AuthXOAUTH2.
+	TokenSource TokenSource
+	// From is the envelope sender and From header.
+	// Defaults to Username.
+	From string
+	// HeloName is the name sent with EHLO. Defaults to "localhost".
+	HeloName string
+	// DialTimeout limits how long connecting, securing and
+	// authenticating a session can take. Defaults to DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Timeout limits how long a single mail transaction can take.
+	// Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// DKIM signs each message when set.
+	DKIM *dkim.Options
+	// APIKey authenticates with the HTTP API transports.
+	APIKey string
+	// Endpoint overrides the base URL of the HTTP API transports.
+	Endpoint string
+	// Domain is the Mailgun sending domain.
+	Domain string
+	// Region is the SES region, or "eu" for Mailgun's EU endpoint.
+	Region string
+	// Path is where the file, maildir and mbox transports write to.
+	Path string
+}
+
+// NewClient returns a new Client based on the connection string
+// which should be in the format:
+//
+//	`<scheme>://<username>:<password>@<host>:<port>`
+func NewClient(cfg *Config) *Client {
+	n := cfg.MaxConns
+	if n <= 0 {
+		n = DefaultMaxConns
+	}
+
+	return &Client{cfg: cfg, sem: make(chan struct{}, n)}
+}
+
+// Verifier is a Sender that can check it is able to send,
+// without sending anything.
+type Verifier interface {
+	Verify(ctx context.Context) (*Capabilities, error)
+}
+
+var _ Verifier = (*Client)(nil)
+
+// Capabilities are what the server said it supports.
+type Capabilities struct {
+	// Extensions are the EHLO keywords and their parameters,
+	// such as "SIZE": "35882577".
+	Extensions map[string]string
+	// Auth are the mechanisms the server offered.
+	Auth []string
+	// TLS is whether the session was secured.
+	TLS bool
 }
 
-func ParseURL(s string) (*Config, error) {
-	u, err := url.Parse(s)
+// Verify dials a new session, securing and authenticating it as Send
+// would, then asks for the server's capabilities and quits without
+// sending anything. Pooled sessions are left alone, so bad
+// credentials are found even while old sessions still work.
+func (c *Client) Verify(ctx context.Context) (*Capabilities, error) {
+	cn, err := dial(ctx, c.cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	password, _ := u.User.Password()
-	if password == "" {
-		return nil, fmt.Errorf("password is required")
+	var caps *Capabilities
+	err = cn.do(ctx, c.timeout(), func() error {
+		// EHLO again as net/smtp doesn't share what it was told
+		if caps, err = cn.ehlo(c.cfg.HeloName); err != nil {
+			return err
+		}
+		return cn.c.Noop()
+	})
+	if err != nil {
+		cn.close()
+		return nil, err
+	}
+
+	return caps, cn.quit()
+}
+
+// Send sends the message over a pooled session, dialing a new one
+// if none are available. The From address defaults to the Config's.
+func (c *Client) Send(ctx context.Context, m *Message) (*Result, error) {
+	// the message is copied so the defaults don't leak back to the caller
+	mm := *m
+	if mm.From.Address == "" {
+		from, err := parseAddress(c.from())
+		if err != nil {
+			return nil, err
+		}
+		mm.From = from
+	}
+	if mm.MessageID == "" {
+		mm.MessageID = newMessageID(mm.From)
+	}
+
+	if err := mm.validate(); err != nil {
+		return nil, err
 	}
 
-	var hostname string
-	switch u.Scheme {
-	case "google":
-		hostname = GoogleHost
-	default:
-		return nil, fmt.Errorf("unknown scheme: %s", u.Scheme)
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Config{
-		Username: u.User.Username() + "@" + u.Hostname(),
-		Password: password,
-		Hostname: hostname,
-		Port:     u.Port(),
-	}, nil
+	msg, p, err := c.render(cn, &mm)
+	if err != nil {
+		c.put(cn, nil)
+		return nil, err
+	}
+
+	var rcpt []string
+	for _, a := range msg.Recipients() {
+		rcpt = append(rcpt, a.Address)
+	}
+
+	res, err := cn.send(ctx, msg.returnPath(), rcpt, p, c.timeout())
+	c.put(cn, err)
+	if err != nil {
+		return nil, err
+	}
+
+	res.MessageID = msg.MessageID
+	return res, nil
 }
 
-// NewClient returns a new Client based on the connection string
-// which should be in the format:
-//
-//	`<scheme>://<username>:<password>@<host>:<port>`
-func NewClient(cfg *Config) Sender {
-	return &Client{cfg}
-}
-
-func (c *Client) build(subject, msg string, to ...string) []byte {
-	var buf bytes.Buffer
-	// **** From: <email address> \r\n ****
-	buf.WriteString(fmt.Sprintf("From: %s", c.cfg.Username))
-	buf.WriteString("\r\n")
-	// **** To: <email address> \r\n ****
-	buf.WriteString(fmt.Sprintf("To: %s", strings.Join(to, ",")))
-	buf.WriteString("\r\n")
-	// **** Subject: <subject> \r\n ****
-	buf.WriteString(fmt.Sprintf("Subject: %s", subject))
-	buf.WriteString("\r\n")
-	// **** header fields ****
-	hdr := []string{"MIME-version: 1.0;", "Content-Type: text/html; charset=\"UTF-8\";"}
-	buf.WriteString(strings.Join(hdr, "\r\n"))
-	// **** \r\n\r\n ****
-	buf.WriteString("\r\n")
-	buf.WriteString("\r\n")
-	// **** <message> ****
-	buf.WriteString(msg)
-
-	return buf.Bytes()
-}
-
-// MEthod for pinging the client, rather than sending an email.
-
-func (c *Client) Send(subject, msg string, to ...string) error {
-	s, err := smtp.Dial(c.cfg.Hostname + ":" + c.cfg.Port)
+// render writes the message for the session. Servers without SMTPUTF8
+// are sent the ASCII form of the domains and can't be sent addresses
+// with non-ASCII local parts at all.
+func (c *Client) render(cn *conn, m *Message) (*Message, []byte, error) {
+	m, err := m.withAlternative()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer s.Close()
 
-	tls := &tls.Config{InsecureSkipVerify: true, ServerName: c.cfg.Hostname}
-	if err = s.StartTLS(tls); err != nil {
-		return err
+	if ok, _ := cn.c.Extension("SMTPUTF8"); !ok {
+		if addr, ok := m.needsSMTPUTF8(); ok {
+			return nil, nil, &Error{
+				Transport:    "smtp",
+				Phase:        PhaseMail,
+				Code:         553,
+				EnhancedCode: "5.6.7",
+				Message:      "server does not support SMTPUTF8, needed for " + addr,
+			}
+		}
+
+		if m, err = m.toASCII(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	a := smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, c.cfg.Hostname)
-	if err := s.Auth(a); err != nil {
-		return err
+	p, err := render(m, c.cfg.DKIM)
+	if err != nil {
+		return nil, nil, err
 	}
+	return m, p, nil
+}
+
+// Close ends every idle session. Sessions that are in use
+// are closed when they are returned to the pool.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle, c.closed = nil, true
+	c.mu.Unlock()
 
-	if err := s.Mail(c.cfg.Username); err != nil {
-		return err
+	var err error
+	for _, cn := range idle {
+		if e := cn.quit(); e != nil && err == nil {
+			err = e
+		}
 	}
-	
-	for _, r := range to {
-		if err := s.Rcpt(r); err != nil {
-			return err
+	return err
+}
+
+// get takes a session from the pool, blocking while all MaxConns
+// sessions are in use. Sessions that have expired or stopped
+// responding are thrown away.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			<-c.sem
+			return nil, fmt.Errorf("client is closed")
+		}
+		n := len(c.idle)
+		if n == 0 {
+			c.mu.Unlock()
+			break
+		}
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+
+		if cn.expired(c.idleTimeout(), c.maxMessages()) {
+			cn.quit()
+			continue
+		}
+		// a session the server has dropped fails the NOOP
+		if err := cn.noop(ctx, c.timeout()); err != nil {
+			cn.close()
+			continue
 		}
+		return cn, nil
 	}
 
-	w, err := s.Data()
+	cn, err := dial(ctx, c.cfg)
 	if err != nil {
-		return err
+		<-c.sem
+		return nil, err
 	}
+	return cn, nil
+}
+
+// put returns the session to the pool. The session is closed instead
+// if the send failed in a way that leaves it unusable.
+func (c *Client) put(cn *conn, err error) {
+	defer func() { <-c.sem }()
 
-	if _, err = w.Write(c.build(subject, msg, to...)); err != nil {
-		return err
+	if err != nil && !isReplyError(err) {
+		cn.close()
+		return
 	}
 
-	if err = w.Close(); err != nil {
-		return err
+	if err := cn.reset(context.Background(), c.timeout()); err != nil {
+		cn.close()
+		return
 	}
+	cn.used = time.Now()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		cn.quit()
+		return
+	}
+	c.idle = append(c.idle, cn)
+	c.mu.Unlock()
+}
 
-	return s.Quit()
+func (c *Client) from() string {
+	if c.cfg.From != "" {
+		return c.cfg.From
+	}
+	return c.cfg.Username
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.cfg.Timeout > 0 {
+		return c.cfg.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.cfg.IdleTimeout > 0 {
+		return c.cfg.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (c *Client) maxMessages() int {
+	if c.cfg.MaxMessages > 0 {
+		return c.cfg.MaxMessages
+	}
+	return DefaultMaxMessages
 }
@@ -0,0 +1,308 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// conn is a single authenticated session with the smtp server.
+type conn struct {
+	nc net.Conn
+	c  *smtp.Client
+	// sent is the number of messages sent over the session
+	sent int
+	// used is when the session was last returned to the pool
+	used time.Time
+}
+
+// dial opens a new session, securing it as the Config's TLSMode
+// asks and authenticating before it is handed out.
+func dial(ctx context.Context, cfg *Config) (*conn, error) {
+	mode := cfg.TLS
+	if mode == "" {
+		mode = TLSStartTLS
+	}
+
+	if mode == TLSNone && !isLocalhost(cfg.Hostname) {
+		return nil, phaseError(PhaseDial, fmt.Errorf("tls mode %q is only allowed for local hosts, not %s", mode, cfg.Hostname))
+	}
+
+	timeout := cfg.DialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	addr := net.JoinHostPort(cfg.Hostname, cfg.Port)
+	d := &net.Dialer{Timeout: timeout}
+
+	var nc net.Conn
+	var err error
+	switch mode {
+	case TLSImplicit:
+		nc, err = (&tls.Dialer{NetDialer: d, Config: tlsConfig(cfg)}).DialContext(ctx, "tcp", addr)
+	case TLSStartTLS, TLSOpportunistic, TLSNone:
+		nc, err = d.DialContext(ctx, "tcp", addr)
+	default:
+		return nil, phaseError(PhaseDial, fmt.Errorf("unknown tls mode: %s", mode))
+	}
+	if err != nil {
+		return nil, phaseError(PhaseDial, err)
+	}
+
+	cn := &conn{nc: nc, used: time.Now()}
+
+	// the whole handshake has to fit in the dial timeout
+	err = cn.do(ctx, timeout, func() error {
+		s, err := smtp.NewClient(nc, cfg.Hostname)
+		if err != nil {
+			return phaseError(PhaseDial, err)
+		}
+		cn.c = s
+
+		if cfg.HeloName != "" {
+			if err := s.Hello(cfg.HeloName); err != nil {
+				return phaseError(PhaseDial, err)
+			}
+		}
+
+		if err := startTLS(s, cfg, mode); err != nil {
+			return phaseError(PhaseTLS, err)
+		}
+
+		return phaseError(PhaseAuth, auth(s, cfg))
+	})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+// startTLS upgrades the session when the mode calls for it.
+func startTLS(s *smtp.Client, cfg *Config, mode TLSMode) error {
+	ok, _ := s.Extension("STARTTLS")
+
+	switch mode {
+	case TLSStartTLS:
+		if !ok {
+			return fmt.Errorf("server %s does not support STARTTLS", cfg.Hostname)
+		}
+	case TLSOpportunistic:
+		if !ok {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	return s.StartTLS(tlsConfig(cfg))
+}
+
+// tlsConfig verifies the server's certificate against the
+// Config's root CAs, or the host's when none are set.
+func tlsConfig(cfg *Config) *tls.Config {
+	return &tls.Config{
+		ServerName: cfg.Hostname,
+		RootCAs:    cfg.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// isLocalhost reports whether host refers to this machine.
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// send runs a single mail transaction over the session,
+// returning the server's reply to the message.
+func (cn *conn) send(ctx context.Context, from string, to []string, msg []byte, timeout time.Duration) (*Result, error) {
+	var res *Result
+	err := cn.do(ctx, timeout, func() error {
+		if err := cn.c.Mail(from); err != nil {
+			return phaseError(PhaseMail, err)
+		}
+
+		// a refused recipient doesn't stop the others being sent to
+		var rejected []Rejection
+		for _, r := range to {
+			if err := cn.c.Rcpt(r); err != nil {
+				if !isReplyError(err) {
+					return phaseError(PhaseRcpt, err)
+				}
+				rejected = append(rejected, Rejection{r, phaseError(PhaseRcpt, err)})
+			}
+		}
+		if len(rejected) == len(to) {
+			return rejected[0].Err
+		}
+
+		// net/smtp's Data hides the reply, so DATA is done by hand
+		code, text, err := cn.data(msg)
+		if err != nil {
+			return phaseError(PhaseData, err)
+		}
+
+		res = &Result{QueueID: queueID(text), Code: code, Response: text, Rejected: rejected}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cn.sent++
+	return res, nil
+}
+
+// data sends the message, returning the server's reply to it.
+func (cn *conn) data(msg []byte) (int, string, error) {
+	if _, _, err := cn.cmd(354, "DATA"); err != nil {
+		return 0, "", err
+	}
+
+	w := cn.c.Text.DotWriter()
+	if _, err := w.Write(msg); err != nil {
+		return 0, "", err
+	}
+	if err := w.Close(); err != nil {
+		return 0, "", err
+	}
+
+	return cn.c.Text.ReadResponse(250)
+}
+
+// cmd sends a command and reads the reply, as net/smtp does.
+func (cn *conn) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	id, err := cn.c.Text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	cn.c.Text.StartResponse(id)
+	defer cn.c.Text.EndResponse(id)
+	return cn.c.Text.ReadResponse(expectCode)
+}
+
+// do runs f with the session's deadline set to the earlier of the
+// timeout and the context's deadline. I/O is interrupted if the
+// context is cancelled, after which the session should be closed.
+func (cn *conn) do(ctx context.Context, timeout time.Duration, f func() error) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.nc.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			cn.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err := f()
+	close(stop)
+	<-done
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ehlo asks the server for its capabilities. The greeting's
+// domain is dropped and the keywords are upper cased.
+func (cn *conn) ehlo(name string) (*Capabilities, error) {
+	if name == "" {
+		name = "localhost"
+	}
+
+	_, text, err := cn.cmd(250, "EHLO %s", name)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &Capabilities{Extensions: make(map[string]string)}
+	_, caps.TLS = cn.c.TLSConnectionState()
+
+	lines := strings.Split(text, "\n")
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		caps.Extensions[strings.ToUpper(k)] = v
+	}
+	if v, ok := caps.Extensions["AUTH"]; ok {
+		caps.Auth = strings.Fields(v)
+	}
+	return caps, nil
+}
+
+// noop checks the server is still there.
+func (cn *conn) noop(ctx context.Context, timeout time.Duration) error {
+	return cn.do(ctx, timeout, cn.c.Noop)
+}
+
+// reset aborts the current mail transaction so the session
+// can be used for the next message.
+func (cn *conn) reset(ctx context.Context, timeout time.Duration) error {
+	return cn.do(ctx, timeout, cn.c.Reset)
+}
+
+// expired reports whether the session has been idle for too long
+// or has sent its share of messages.
+func (cn *conn) expired(idle time.Duration, max int) bool {
+	return time.Since(cn.used) > idle || cn.sent >= max
+}
+
+// quit ends the session politely, giving up
+// if the server takes more than a few seconds.
+func (cn *conn) quit() error {
+	cn.nc.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := cn.c.Quit(); err != nil {
+		cn.c.Close()
+		return err
+	}
+	return nil
+}
+
+func (cn *conn) close() error { return cn.c.Close() }
+
+// queueIDs match the queue id in the replies of common servers.
+var queueIDs = []*regexp.Regexp{
+	// Postfix, Exim and most others
+	regexp.MustCompile(`(?i)queued as ([^\s;,]+)`),
+	regexp.MustCompile(`(?i)\bid=([^\s;,]+)`),
+	// Gmail replies with a timestamp followed by the id
+	regexp.MustCompile(`(?i)^2\.0\.0 OK\s+\d+\s+(\S+)`),
+}
+
+// queueID finds the queue id in the reply to DATA, if there is one.
+func queueID(text string) string {
+	for _, re := range queueIDs {
+		if m := re.FindStringSubmatch(text); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// isReplyError reports whether err is a reply from the server,
+// in which case the session can still be used after a RSET.
+func isReplyError(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr)
+}
@@ -0,0 +1,313 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Mode is how an Email is delivered to its Recipients.
+type Mode int
+
+const (
+	// ModeIndividual sends each recipient their own message,
+	// addressed only to them.
+	ModeIndividual Mode = iota
+	// ModeBCC sends a single message with the recipients hidden in
+	// the envelope, for bulk mail that isn't personalised.
+	ModeBCC
+)
+
+// Status is the outcome of delivering to a single recipient.
+type Status struct {
+	Recipient Recipient
+	// Result is nil when the delivery failed.
+	Result *Result
+	Err    error
+	// Template is the name and version of the template the
+	// message was rendered with, if any.
+	Template        string
+	TemplateVersion int
+}
+
+// Mailer delivers Emails through a Sender.
+type Mailer struct {
+	Sender Sender
+	// From defaults to the Sender's own address.
+	From Address
+	Mode Mode
+	// ReturnPath is where bounces go, such as "bounces@example.com".
+	// When set with ModeIndividual each message is sent from a VERP
+	// address at it, so ParseBounce can match bounces back to the
+	// message and recipient.
+	ReturnPath string
+	// Unsubscribe adds signed one-click unsubscribe links to each
+	// message when set. Only ModeIndividual can have them, as the
+	// link is the recipient's own.
+	Unsubscribe *Unsubscriber
+	// Templates are where an Email's Template is loaded from.
+	Templates TemplateSource
+	// Catalog has the messages shared between templates.
+	Catalog *Catalog
+	// Layout wraps the HTML rendered from an Email's Markdown,
+	// when set.
+	Layout *Layout
+}
+
+// Deliver sends the email to each of its recipients,
+// reporting how it went for every one of them.
+func (m *Mailer) Deliver(ctx context.Context, e *Email) []Status {
+	if e.Template == "" {
+		return m.deliver(ctx, e, e.Recipients, nil)
+	}
+
+	// recipients get the template for their own locale, so
+	// those with the same locale are delivered to together
+	var locales []string
+	byLocale := make(map[string][]int)
+	for i, r := range e.Recipients {
+		if _, ok := byLocale[r.Locale]; !ok {
+			locales = append(locales, r.Locale)
+		}
+		byLocale[r.Locale] = append(byLocale[r.Locale], i)
+	}
+
+	statuses := make([]Status, len(e.Recipients))
+	for _, locale := range locales {
+		rs := make([]Recipient, len(byLocale[locale]))
+		for j, i := range byLocale[locale] {
+			rs[j] = e.Recipients[i]
+		}
+
+		var ss []Status
+		if t, err := m.template(ctx, e, locale); err != nil {
+			ss = make([]Status, len(rs))
+			for j, r := range rs {
+				ss[j] = Status{Recipient: r, Err: err, Template: e.Template}
+			}
+		} else {
+			ss = m.deliver(ctx, e, rs, t)
+			for j := range ss {
+				ss[j].Template, ss[j].TemplateVersion = t.Name, t.Version
+			}
+		}
+
+		for j, i := range byLocale[locale] {
+			statuses[i] = ss[j]
+		}
+	}
+	return statuses
+}
+
+func (m *Mailer) deliver(ctx context.Context, e *Email, rs []Recipient, t *Template) []Status {
+	if m.Mode == ModeBCC {
+		return m.deliverBCC(ctx, e, rs, t)
+	}
+	return m.deliverEach(ctx, e, rs, t)
+}
+
+func (m *Mailer) deliverEach(ctx context.Context, e *Email, rs []Recipient, t *Template) []Status {
+	statuses := make([]Status, len(rs))
+	for i, r := range rs {
+		statuses[i].Recipient = r
+		if err := ctx.Err(); err != nil {
+			statuses[i].Err = err
+			continue
+		}
+
+		msg, err := m.message(e, r, t)
+		if err != nil {
+			statuses[i].Err = err
+			continue
+		}
+		statuses[i].Result, statuses[i].Err = m.Sender.Send(ctx, msg)
+	}
+	return statuses
+}
+
+func (m *Mailer) deliverBCC(ctx context.Context, e *Email, rs []Recipient, t *Template) []Status {
+	// nobody in particular, as everyone gets the same message,
+	// though they all have the same locale
+	var locale string
+	if len(rs) > 0 {
+		locale = rs[0].Locale
+	}
+	msg, err := m.content(e, Recipient{Locale: locale}, t)
+	if err != nil {
+		statuses := make([]Status, len(rs))
+		for i, r := range rs {
+			statuses[i] = Status{Recipient: r, Err: err}
+		}
+		return statuses
+	}
+
+	msg.From, msg.ReturnPath = m.From, m.ReturnPath
+	msg.Undisclosed = true
+	for _, r := range rs {
+		msg.Bcc = append(msg.Bcc, r.Address)
+	}
+
+	res, err := m.Sender.Send(ctx, msg)
+
+	rejected := make(map[string]error)
+	if res != nil {
+		for _, r := range res.Rejected {
+			rejected[rejectedKey(r.Address)] = r.Err
+		}
+	}
+
+	statuses := make([]Status, len(rs))
+	for i, r := range rs {
+		statuses[i].Recipient = r
+		switch rerr, ok := rejected[rejectedKey(r.Address.Address)]; {
+		case err != nil:
+			statuses[i].Err = err
+		case ok:
+			statuses[i].Err = rerr
+		default:
+			statuses[i].Result = res
+		}
+	}
+	return statuses
+}
+
+// rejectedKey matches a recipient to the server rejecting them, which
+// is of the address as it was sent, with its domain in punycode.
+func rejectedKey(addr string) string {
+	if a, err := asciiAddress(addr); err == nil {
+		addr = a
+	}
+	return strings.ToLower(addr)
+}
+
+// message is the email addressed to a single recipient, by name.
+func (m *Mailer) message(e *Email, r Recipient, t *Template) (*Message, error) {
+	to := r.Address
+	if name := r.Name(); name != "" {
+		to.Name = name
+	}
+
+	msg, err := m.content(e, r, t)
+	if err != nil {
+		return nil, err
+	}
+	msg.From, msg.To = m.From, []Address{to}
+
+	if m.ReturnPath != "" {
+		id := newVERPID()
+		msg.ReturnPath = VERP(m.ReturnPath, id, to.Address)
+		msg.MessageID = verpMessageID(id, m.ReturnPath)
+	}
+	if m.Unsubscribe != nil {
+		m.Unsubscribe.SetHeaders(msg, to.Address)
+	}
+	return msg, nil
+}
+
+// template loads the email's template for the locale.
+func (m *Mailer) template(ctx context.Context, e *Email, locale string) (*Template, error) {
+	if m.Templates == nil {
+		return nil, &TemplateError{e.Template, errors.New("mailer has no templates")}
+	}
+	if e.TemplateVersion != 0 {
+		// the version is the one being tried out, whatever the
+		// locale, so a translation is tried out by its own name
+		store, ok := m.Templates.(TemplateStore)
+		if !ok {
+			return nil, &TemplateError{e.Template, errors.New("mailer's templates have no versions")}
+		}
+		return LoadTemplateVersion(ctx, store, e.Template, e.TemplateVersion)
+	}
+	return LoadLocalTemplate(ctx, m.Templates, e.Template, locale)
+}
+
+// content is the subject and body of the email for the recipient,
+// rendered from the template or Markdown when there is one.
+func (m *Mailer) content(e *Email, r Recipient, t *Template) (*Message, error) {
+	if t == nil && e.Markdown != "" {
+		html, text, err := RenderMarkdown(e.Markdown)
+		if err != nil {
+			return nil, err
+		}
+		if m.Layout != nil {
+			if html, err = m.Layout.Wrap(e.Subject, html); err != nil {
+				return nil, err
+			}
+		}
+		return &Message{Subject: e.Subject, HTML: html, Text: text}, nil
+	}
+	if t == nil {
+		return &Message{Subject: e.Subject, HTML: e.Message}, nil
+	}
+
+	data := e.TemplateData(r)
+	data.Catalog = m.Catalog
+	return t.Render(data)
+}
+
+// TemplateData is what the email's template is rendered with for the
+// recipient, whose own data wins over the email's.
+func (e *Email) TemplateData(r Recipient) *TemplateData {
+	data := make(map[string]any, len(e.Data)+len(r.Data))
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	for k, v := range r.Data {
+		data[k] = v
+	}
+	return &TemplateData{Recipient: r, Data: data}
+}
+
+// Name is the recipient's full name.
+func (r Recipient) Name() string {
+	return strings.TrimSpace(r.FirstName + " " + r.LastName)
+}
+
+// EventType is what happened to a message.
+type EventType string
+
+const (
+	EventDelivered EventType = "delivered"
+	EventFailed    EventType = "failed"
+	EventBounced   EventType = "bounced"
+	// EventUnsubscribed is when the recipient asks not to be sent
+	// to again, there is no message.
+	EventUnsubscribed EventType = "unsubscribed"
+)
+
+// Event is something that happened to a message sent to a recipient.
+type Event struct {
+	Type      EventType `json:"type"`
+	Recipient string    `json:"recipient"`
+	MessageID string    `json:"messageId,omitempty"`
+	Time      time.Time `json:"time"`
+	// Response is the server's reply, or the error, when
+	// the message was delivered or failed.
+	Response string `json:"response,omitempty"`
+	// Bounce is set when the message bounced.
+	Bounce *Bounce `json:"bounce,omitempty"`
+	// Template and TemplateVersion are what the message was
+	// rendered with, so what the recipient got can be told.
+	Template        string `json:"template,omitempty"`
+	TemplateVersion int    `json:"templateVersion,omitempty"`
+	// Test is set when the message was a test send, so it
+	// isn't counted along with what subscribers were sent.
+	Test bool `json:"test,omitempty"`
+}
+
+// Event is the delivered or failed event for the status.
+func (s Status) Event() *Event {
+	e := &Event{Recipient: s.Recipient.Address.Address, Time: time.Now(), Template: s.Template, TemplateVersion: s.TemplateVersion}
+	if s.Err != nil {
+		e.Type, e.Response = EventFailed, s.Err.Error()
+		return e
+	}
+	e.Type, e.MessageID, e.Response = EventDelivered, s.Result.MessageID, s.Result.Response
+	return e
+}
+
+// Event is the bounced event for the bounce.
+func (b Bounce) Event() *Event {
+	return &Event{Type: EventBounced, Recipient: b.Recipient, MessageID: b.MessageID, Time: time.Now(), Bounce: &b}
+}
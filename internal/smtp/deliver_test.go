@@ -0,0 +1,280 @@
+package smtp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/adoublef/pinkpink/internal/smtp/smtptest"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestMailer(t *testing.T) {
+	email := &smtp.Email{
+		Subject: "Newsletter",
+		Message: "<h1>Hello World</h1>",
+		Recipients: []smtp.Recipient{
+			{Address: smtp.Address{Address: "ada@example.com"}, FirstName: "Ada", LastName: "Lovelace"},
+			{Address: smtp.Address{Address: "bad@example.com"}, FirstName: "Bad"},
+			{Address: smtp.Address{Address: "grace@example.com"}, FirstName: "Grace"},
+		},
+	}
+
+	t.Run("individual", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t, func(s *smtptest.Server) { s.Reject = []string{"bad@example.com"} })
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeIndividual}
+		statuses := m.Deliver(context.Background(), email)
+		is.Equal(len(statuses), 3)
+		is.NoErr(statuses[0].Err)          // ada delivered
+		is.True(statuses[1].Err != nil)    // bad rejected
+		is.NoErr(statuses[2].Err)          // grace delivered after a rejection
+		is.True(statuses[0].Result != nil) // result recorded
+
+		msgs := srv.Messages()
+		is.Equal(len(msgs), 2)
+
+		// each message is only addressed to its recipient
+		for i, want := range []string{`"Ada Lovelace" <ada@example.com>`, `"Grace" <grace@example.com>`} {
+			msg, err := mail.ReadMessage(bytes.NewReader(msgs[i].Data))
+			is.NoErr(err) // parse message
+			is.Equal(msg.Header.Get("To"), want)
+			is.Equal(len(msgs[i].To), 1)
+		}
+	})
+
+	t.Run("bcc", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t, func(s *smtptest.Server) { s.Reject = []string{"bad@example.com"} })
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeBCC}
+		statuses := m.Deliver(context.Background(), email)
+		is.Equal(len(statuses), 3)
+		is.NoErr(statuses[0].Err)       // ada delivered
+		is.True(statuses[1].Err != nil) // bad rejected
+		is.NoErr(statuses[2].Err)       // grace delivered
+
+		msgs := srv.Messages()
+		is.Equal(len(msgs), 1)       // a single message
+		is.Equal(len(msgs[0].To), 2) // to everyone accepted
+
+		msg, err := mail.ReadMessage(bytes.NewReader(msgs[0].Data))
+		is.NoErr(err) // parse message
+		is.Equal(msg.Header.Get("To"), "undisclosed-recipients:;")
+		is.Equal(msg.Header.Get("Bcc"), "")
+	})
+
+	t.Run("bcc idn", func(t *testing.T) {
+		is := is.New(t)
+
+		// the server is given the domain in punycode
+		srv := newTestServer(t, func(s *smtptest.Server) { s.Reject = []string{"jo@xn--bcher-kva.example"} })
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeBCC}
+		statuses := m.Deliver(context.Background(), &smtp.Email{Subject: "Newsletter", Message: "Hi", Recipients: []smtp.Recipient{
+			{Address: smtp.Address{Address: "ada@example.com"}},
+			{Address: smtp.Address{Address: "jo@bücher.example"}},
+		}})
+		is.NoErr(statuses[0].Err)       // ada delivered
+		is.True(statuses[1].Err != nil) // jo rejected
+	})
+
+	t.Run("return path", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeIndividual, ReturnPath: "bounces@example.com"}
+		statuses := m.Deliver(context.Background(), email)
+		is.NoErr(statuses[0].Err) // ada delivered
+
+		msgs := srv.Messages()
+		id, rcpt, ok := smtp.ParseVERP(msgs[0].From)
+		is.True(ok) // verp return path
+		is.Equal(rcpt, "ada@example.com")
+		is.Equal(id+"@example.com", statuses[0].Result.MessageID)
+
+		// a bounce sent to the return path finds its way back
+		bounce := "From: MAILER-DAEMON@mx.example.org\r\n" +
+			"To: " + msgs[0].From + "\r\n" +
+			"Subject: Undelivered Mail Returned to Sender\r\n" +
+			"\r\n" +
+			"550 5.1.1 No such user\r\n"
+		bounces, err := smtp.ParseBounce(strings.NewReader(bounce))
+		is.NoErr(err) // parse bounce
+		is.Equal(bounces[0].Recipient, "ada@example.com")
+		is.Equal(bounces[0].MessageID, statuses[0].Result.MessageID)
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		u := &smtp.Unsubscriber{URL: "https://example.com/api/unsubscribe", Key: []byte("secret")}
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeIndividual, Unsubscribe: u}
+		m.Deliver(context.Background(), email)
+
+		// each recipient gets their own link
+		for i, rcpt := range []string{"ada@example.com", "bad@example.com", "grace@example.com"} {
+			msg, err := mail.ReadMessage(bytes.NewReader(srv.Messages()[i].Data))
+			is.NoErr(err) // parse message
+			is.Equal(msg.Header.Get("List-Unsubscribe"), "<"+u.Link(rcpt)+">")
+			is.Equal(msg.Header.Get("List-Unsubscribe-Post"), "List-Unsubscribe=One-Click")
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		fsys := fstest.MapFS{
+			"welcome/subject.txt": {Data: []byte("Welcome {{.FirstName}}")},
+			"welcome/body.txt":    {Data: []byte("You are on the {{.Data.plan}} plan.")},
+		}
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeIndividual, Templates: smtp.NewFSTemplates(fsys)}
+
+		e := &smtp.Email{
+			Template: "welcome",
+			Data:     map[string]any{"plan": "free"},
+			Recipients: []smtp.Recipient{
+				{Address: smtp.Address{Address: "ada@example.com"}, FirstName: "Ada"},
+				{Address: smtp.Address{Address: "grace@example.com"}, FirstName: "Grace", Data: map[string]any{"plan": "pro"}},
+			},
+		}
+		statuses := m.Deliver(context.Background(), e)
+		is.NoErr(statuses[0].Err) // ada delivered
+		is.NoErr(statuses[1].Err) // grace delivered
+		is.Equal(statuses[0].Event().Template, "welcome")
+
+		for i, want := range []string{"Welcome Ada", "Welcome Grace"} {
+			msg, err := mail.ReadMessage(bytes.NewReader(srv.Messages()[i].Data))
+			is.NoErr(err) // parse message
+			is.Equal(msg.Header.Get("Subject"), want)
+		}
+		// the recipient's data wins
+		is.True(bytes.Contains(srv.Messages()[1].Data, []byte("pro plan")))
+
+		// a missing template fails every recipient
+		statuses = m.Deliver(context.Background(), &smtp.Email{Template: "missing", Recipients: e.Recipients})
+		var terr *smtp.TemplateError
+		is.True(errors.As(statuses[0].Err, &terr))
+		is.True(errors.Is(statuses[1].Err, smtp.ErrTemplateNotFound))
+		is.Equal(len(srv.Messages()), 2)
+	})
+
+	t.Run("locale", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		fsys := fstest.MapFS{
+			"welcome/subject.txt":    {Data: []byte("Welcome {{.FirstName}}")},
+			"welcome/body.txt":       {Data: []byte("Hi")},
+			"welcome.fr/subject.txt": {Data: []byte("Bienvenue {{.FirstName}}")},
+			"welcome.fr/body.txt":    {Data: []byte("Salut")},
+		}
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeBCC, Templates: smtp.NewFSTemplates(fsys)}
+
+		e := &smtp.Email{
+			Template: "welcome",
+			Recipients: []smtp.Recipient{
+				{Address: smtp.Address{Address: "ada@example.com"}, Locale: "fr-CA"},
+				{Address: smtp.Address{Address: "grace@example.com"}, Locale: "en"},
+				{Address: smtp.Address{Address: "marie@example.com"}, Locale: "fr-CA"},
+			},
+		}
+		statuses := m.Deliver(context.Background(), e)
+		for i := range statuses {
+			is.NoErr(statuses[i].Err) // delivered
+			is.Equal(statuses[i].Recipient, e.Recipients[i])
+		}
+
+		// a message for each locale, to everyone with it
+		msgs := srv.Messages()
+		is.Equal(len(msgs), 2)
+		is.Equal(msgs[0].To, []string{"ada@example.com", "marie@example.com"})
+		is.Equal(msgs[0].Header.Get("Subject"), "Bienvenue")
+		is.Equal(msgs[1].To, []string{"grace@example.com"})
+		is.Equal(msgs[1].Header.Get("Subject"), "Welcome")
+	})
+
+	t.Run("template version", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		tmpls := smtp.NewMemoryTemplates()
+		tmpls.Put(context.Background(), "welcome", &smtp.TemplateFiles{Subject: "One", Text: "One"})
+		tmpls.Put(context.Background(), "welcome", &smtp.TemplateFiles{Subject: "Two", Text: "Two"})
+		is.NoErr(tmpls.Publish(context.Background(), "welcome", 2)) // publish
+
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeIndividual, Templates: tmpls}
+		statuses := m.Deliver(context.Background(), &smtp.Email{Template: "welcome", Recipients: email.Recipients[:1]})
+		is.NoErr(statuses[0].Err) // delivered
+
+		// the event says which version was sent
+		e := statuses[0].Event()
+		is.Equal(e.Template, "welcome")
+		is.Equal(e.TemplateVersion, 2)
+
+		// a version can be sent before it is published
+		statuses = m.Deliver(context.Background(), &smtp.Email{Template: "welcome", TemplateVersion: 1, Recipients: email.Recipients[:1]})
+		is.NoErr(statuses[0].Err) // delivered
+		is.Equal(statuses[0].TemplateVersion, 1)
+		msg, err := mail.ReadMessage(bytes.NewReader(srv.Messages()[1].Data))
+		is.NoErr(err) // parse message
+		is.Equal(msg.Header.Get("Subject"), "One")
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		is := is.New(t)
+
+		box := smtp.NewMemoryMailbox()
+		c := smtp.NewCatcher(box, &smtp.Config{From: "news@example.com"})
+
+		l, err := smtp.ParseLayout(`<div class="layout">{{.Body}}</div>`)
+		is.NoErr(err) // parse layout
+
+		m := &smtp.Mailer{Sender: c, Mode: smtp.ModeIndividual, Layout: l}
+		e := &smtp.Email{Subject: "News", Markdown: "Hello **world**", Recipients: email.Recipients[:1]}
+		statuses := m.Deliver(context.Background(), e)
+		is.NoErr(statuses[0].Err) // delivered
+
+		list, err := box.List(context.Background())
+		is.NoErr(err) // list caught
+		msg, err := mail.ReadMessage(bytes.NewReader(list[0].Raw))
+		is.NoErr(err) // parse message
+		is.True(strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/alternative"))
+
+		text, html, err := list[0].Body()
+		is.NoErr(err) // read bodies
+		is.Equal(strings.TrimSpace(text), "Hello world")
+		is.True(strings.HasPrefix(html, `<div class="layout"><p>Hello <strong>world</strong></p>`)) // html in the layout
+	})
+}
@@ -0,0 +1,231 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp/dkim"
+)
+
+// The development transports write the rendered message rather than
+// sending it, so the exact bytes that would go out can be looked at.
+// Without a from they are sent from DevFrom.
+var (
+	_ Sender = (*Writer)(nil)
+	_ Sender = (*Dir)(nil)
+	_ Sender = (*Maildir)(nil)
+	_ Sender = (*Mbox)(nil)
+)
+
+// Writer writes each message to an io.Writer, such as os.Stdout,
+// between a pair of separator lines.
+type Writer struct {
+	w    io.Writer
+	from string
+	dkim *dkim.Options
+
+	mu sync.Mutex
+}
+
+// NewWriter returns a Sender that writes to w.
+func NewWriter(w io.Writer, cfg *Config) *Writer {
+	return &Writer{w: w, from: cfg.From, dkim: cfg.DKIM}
+}
+
+func (w *Writer) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, p, err := devRender(m, w.from, w.dkim)
+	if err != nil {
+		return nil, err
+	}
+
+	rcpt := make([]string, 0, len(m.Recipients()))
+	for _, a := range m.Recipients() {
+		rcpt = append(rcpt, a.Address)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "----- %s from %s to %s -----\n", m.MessageID, m.returnPath(), strings.Join(rcpt, ", "))
+	buf.Write(p)
+	buf.WriteString("\n----- end of " + m.MessageID + " -----\n")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := buf.WriteTo(w.w); err != nil {
+		return nil, fmt.Errorf("buf.WriteTo: %w", err)
+	}
+	return &Result{MessageID: m.MessageID, Code: 250, Response: "written"}, nil
+}
+
+// Dir writes each message to its own .eml file in a directory.
+type Dir struct {
+	path string
+	from string
+	dkim *dkim.Options
+}
+
+// NewDir returns a Sender that writes to the Config's Path.
+func NewDir(cfg *Config) *Dir {
+	return &Dir{path: cfg.Path, from: cfg.From, dkim: cfg.DKIM}
+}
+
+func (d *Dir) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, p, err := devRender(m, d.from, d.dkim)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(d.path, 0o755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	// named so they list in the order they were sent
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), safeName(m.MessageID))
+	if err := os.WriteFile(filepath.Join(d.path, name), p, 0o644); err != nil {
+		return nil, fmt.Errorf("os.WriteFile: %w", err)
+	}
+	return &Result{MessageID: m.MessageID, QueueID: name, Code: 250, Response: "written to " + name}, nil
+}
+
+// Maildir delivers each message into a maildir, which mail clients
+// such as mutt can open.
+type Maildir struct {
+	path string
+	from string
+	dkim *dkim.Options
+}
+
+// NewMaildir returns a Sender that delivers to the maildir at the
+// Config's Path, creating it if need be.
+func NewMaildir(cfg *Config) *Maildir {
+	return &Maildir{path: cfg.Path, from: cfg.From, dkim: cfg.DKIM}
+}
+
+// maildirCount keeps names unique within a second.
+// DevFrom is who messages are from when a development transport
+// isn't given a from, as there is nobody to turn them away.
+const DevFrom = "dev@localhost"
+
+var maildirCount atomic.Int64
+
+func (md *Maildir) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, p, err := devRender(m, md.from, md.dkim)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(md.path, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("os.MkdirAll: %w", err)
+		}
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), maildirCount.Add(1), safeName(host))
+
+	// written to tmp first so readers never see half a message
+	tmp := filepath.Join(md.path, "tmp", name)
+	if err := os.WriteFile(tmp, p, 0o600); err != nil {
+		return nil, fmt.Errorf("os.WriteFile: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(md.path, "new", name)); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("os.Rename: %w", err)
+	}
+	return &Result{MessageID: m.MessageID, QueueID: name, Code: 250, Response: "delivered to new/" + name}, nil
+}
+
+// Mbox appends each message to an mbox file, quoting lines
+// that start with "From " as mboxrd does.
+type Mbox struct {
+	path string
+	from string
+	dkim *dkim.Options
+
+	mu sync.Mutex
+}
+
+// NewMbox returns a Sender that appends to the file at the Config's Path.
+func NewMbox(cfg *Config) *Mbox {
+	return &Mbox{path: cfg.Path, from: cfg.From, dkim: cfg.DKIM}
+}
+
+// fromLine matches lines that would be read as the start of a message.
+var fromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+func (mb *Mbox) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, p, err := devRender(m, mb.from, mb.dkim)
+	if err != nil {
+		return nil, err
+	}
+
+	// mbox files use the local line ending
+	p = bytes.ReplaceAll(p, []byte("\r\n"), []byte("\n"))
+	p = fromLine.ReplaceAll(p, []byte(">$1"))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", m.returnPath(), time.Now().UTC().Format(time.ANSIC))
+	buf.Write(p)
+	if !bytes.HasSuffix(p, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(mb.path), 0o755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	f, err := os.OpenFile(mb.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("buf.WriteTo: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("f.Close: %w", err)
+	}
+	return &Result{MessageID: m.MessageID, Code: 250, Response: "appended to " + mb.path}, nil
+}
+
+// devRender fills in the defaults and renders the message
+// just as it would be sent.
+func devRender(m *Message, from string, opts *dkim.Options) (*Message, []byte, error) {
+	if from == "" {
+		from = DevFrom
+	}
+	m, err := withDefaults(m, from)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := render(m, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, p, nil
+}
+
+// safeName replaces anything that doesn't belong in a file name.
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-', r == '_', r == '@':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,113 @@
+package smtp_test
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestDevSenders(t *testing.T) {
+	t.Run("log", func(t *testing.T) {
+		is := is.New(t)
+
+		var buf bytes.Buffer
+		s := smtp.NewWriter(&buf, &smtp.Config{From: "news@example.com"})
+
+		res, err := s.Send(context.Background(), newTestMessage())
+		is.NoErr(err)                                                              // send email
+		is.True(strings.Contains(buf.String(), "Message-ID: <"+res.MessageID+">")) // rendered message
+		is.True(strings.Contains(buf.String(), "to to@example.com"))               // envelope
+	})
+
+	t.Run("no from", func(t *testing.T) {
+		is := is.New(t)
+
+		// as the worker's mailer has no from of its own
+		var buf bytes.Buffer
+		s := smtp.NewWriter(&buf, parseURL(t, "log://"))
+
+		_, err := s.Send(context.Background(), newTestMessage())
+		is.NoErr(err)                                                    // send email
+		is.True(strings.Contains(buf.String(), "From: <dev@localhost>")) // dev from
+	})
+
+	t.Run("file", func(t *testing.T) {
+		is := is.New(t)
+
+		dir := filepath.Join(t.TempDir(), "out")
+		s, err := smtp.NewSender(parseURL(t, "file://"+dir+"?from=news%40example.com"))
+		is.NoErr(err) // new sender
+
+		for i := 0; i < 2; i++ {
+			_, err = s.Send(context.Background(), newTestMessage())
+			is.NoErr(err) // send email
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+		is.NoErr(err) // list files
+		is.Equal(len(files), 2)
+
+		msg := readMessage(t, files[0])
+		is.Equal(msg.Header.Get("From"), "<news@example.com>")
+	})
+
+	t.Run("maildir", func(t *testing.T) {
+		is := is.New(t)
+
+		dir := t.TempDir()
+		s, err := smtp.NewSender(parseURL(t, "maildir://"+dir+"?from=news%40example.com"))
+		is.NoErr(err) // new sender
+
+		res, err := s.Send(context.Background(), newTestMessage())
+		is.NoErr(err) // send email
+
+		tmp, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+		is.Equal(len(tmp), 0) // moved out of tmp
+
+		msg := readMessage(t, filepath.Join(dir, "new", res.QueueID))
+		is.Equal(msg.Header.Get("Subject"), "Subject")
+	})
+
+	t.Run("mbox", func(t *testing.T) {
+		is := is.New(t)
+
+		path := filepath.Join(t.TempDir(), "dev.mbox")
+		s, err := smtp.NewSender(parseURL(t, "mbox://"+path+"?from=news%40example.com"))
+		is.NoErr(err) // new sender
+
+		m := newTestMessage()
+		m.Text = "From here on\nit is quoted"
+		for i := 0; i < 2; i++ {
+			_, err = s.Send(context.Background(), m)
+			is.NoErr(err) // send email
+		}
+
+		p, err := os.ReadFile(path)
+		is.NoErr(err)                                                       // read mbox
+		is.Equal(strings.Count(string(p), "\nFrom news@example.com ")+1, 2) // two messages
+		is.True(strings.HasPrefix(string(p), "From news@example.com "))
+		is.True(strings.Contains(string(p), "\n>From here on")) // body line quoted
+		is.True(!strings.Contains(string(p), "\r\n"))           // local line endings
+	})
+}
+
+func readMessage(t *testing.T, name string) *mail.Message {
+	t.Helper()
+
+	p, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(p))
+	if err != nil {
+		t.Fatalf("mail.ReadMessage: %v", err)
+	}
+	return msg
+}
@@ -0,0 +1,134 @@
+package dkim_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/adoublef/pinkpink/internal/smtp/dkim"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": edKey} {
+		t.Run(name, func(t *testing.T) {
+			opts := &dkim.Options{Domain: "example.com", Selector: "news", Signer: key}
+
+			record, err := dkim.PublicKeyRecord(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txt := func(name string) ([]string, error) {
+				if name != "news._domainkey.example.com" {
+					t.Fatalf("unexpected lookup of %s", name)
+				}
+				return []string{record}, nil
+			}
+
+			m := &smtp.Message{
+				From:    smtp.Address{Name: "Newsletter", Address: "news@example.com"},
+				To:      []smtp.Address{{Address: "to@example.com"}},
+				Subject: "Grüße from a subject long enough to be folded over more than a single line",
+				Text:    "Hello World\n\n\n",
+				HTML:    "<h1>Hello  World</h1>",
+			}
+			p, err := m.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("verify", func(t *testing.T) {
+				is := is.New(t)
+
+				signed, err := dkim.Sign(p, opts)
+				is.NoErr(err) // sign message
+				is.True(bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; a="+name+"; c=relaxed/relaxed; d=example.com; s=news;")))
+				is.NoErr(dkim.Verify(signed, txt)) // verify signature
+			})
+
+			t.Run("relaxed canonicalization", func(t *testing.T) {
+				is := is.New(t)
+
+				signed, err := dkim.Sign(p, opts)
+				is.NoErr(err) // sign message
+
+				// relays may refold headers, pad whitespace
+				// and add fields of their own
+				relayed := strings.Replace(string(signed), "Subject: ", "Subject:   ", 1)
+				relayed = strings.Replace(relayed, "<h1>Hello  World</h1>", "<h1>Hello \t World</h1>  ", 1)
+				relayed = "Received: from relay.example.net\r\n" + relayed + "\r\n\r\n"
+				is.NoErr(dkim.Verify([]byte(relayed), txt)) // still verifies
+			})
+
+			t.Run("tampered", func(t *testing.T) {
+				is := is.New(t)
+
+				signed, err := dkim.Sign(p, opts)
+				is.NoErr(err) // sign message
+
+				body := strings.Replace(string(signed), "Hello World", "Hello Mallory", 1)
+				is.True(dkim.Verify([]byte(body), txt) != nil) // body changed
+
+				header := strings.Replace(string(signed), "To: <to@example.com>", "To: <mallory@example.com>", 1)
+				is.True(dkim.Verify([]byte(header), txt) != nil) // signed header changed
+			})
+
+			t.Run("signed headers", func(t *testing.T) {
+				is := is.New(t)
+
+				signed, err := dkim.Sign(p, &dkim.Options{Domain: "example.com", Selector: "news", Signer: key, Headers: []string{"Subject"}})
+				is.NoErr(err) // sign message
+				is.True(bytes.Contains(signed, []byte("h=from:subject;"))) // from is always signed
+
+				header := strings.Replace(string(signed), "To: <to@example.com>", "To: <mallory@example.com>", 1)
+				is.NoErr(dkim.Verify([]byte(header), txt)) // unsigned header changed
+			})
+		})
+	}
+}
+
+// TestVerifyRFC8463 checks the verifier against the example in RFC 8463.
+func TestVerifyRFC8463(t *testing.T) {
+	is := is.New(t)
+
+	msg := strings.ReplaceAll(`DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`, "\n", "\r\n")
+
+	txt := func(string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}, nil
+	}
+
+	is.NoErr(dkim.Verify([]byte(msg), txt)) // verify rfc example
+}
@@ -0,0 +1,203 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// LookupTXT returns the TXT records for a name, net.LookupTXT by default.
+type LookupTXT func(name string) ([]string, error)
+
+// bTag matches the value of the b= tag, but not bh=.
+var bTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// Verify checks the first DKIM-Signature on the message, fetching
+// the public key with txt, or from DNS when txt is nil.
+func Verify(msg []byte, txt LookupTXT) error {
+	if txt == nil {
+		txt = net.LookupTXT
+	}
+
+	fields, body, err := split(msg)
+	if err != nil {
+		return err
+	}
+
+	sigs := lookup(fields, "DKIM-Signature")
+	if len(sigs) == 0 {
+		return errors.New("dkim: message is not signed")
+	}
+	sig := sigs[0]
+
+	_, value, _ := strings.Cut(sig, ":")
+	tags, err := parseTags(value)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range []string{"v", "a", "d", "s", "h", "bh", "b"} {
+		if tags[t] == "" {
+			return fmt.Errorf("dkim: signature has no %s= tag", t)
+		}
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	switch bodyCanon {
+	case "":
+		bodyCanon = "simple"
+	case "simple", "relaxed":
+	default:
+		return fmt.Errorf("dkim: unknown body canonicalization %s", bodyCanon)
+	}
+
+	canonBody := simpleBody(body)
+	if bodyCanon == "relaxed" {
+		canonBody = relaxedBody(body)
+	}
+	bh := sha256.Sum256(canonBody)
+	if base64.StdEncoding.EncodeToString(bh[:]) != stripWSP(tags["bh"]) {
+		return errors.New("dkim: body hash does not match")
+	}
+
+	h := sha256.New()
+	used := make(map[string]int)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := lookup(fields, name)
+		n := used[name]
+		used[name]++
+		if n >= len(found) {
+			continue
+		}
+		h.Write([]byte(canonHeader(headerCanon, found[len(found)-1-n]) + "\r\n"))
+	}
+	h.Write([]byte(canonHeader(headerCanon, bTag.ReplaceAllString(sig, "$1$2"))))
+	hash := h.Sum(nil)
+
+	b, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("dkim: base64.DecodeString: %w", err)
+	}
+
+	key, err := publicKey(txt, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("dkim: rsa key used for %s", tags["a"])
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, b); err != nil {
+			return fmt.Errorf("dkim: signature does not match: %w", err)
+		}
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return fmt.Errorf("dkim: ed25519 key used for %s", tags["a"])
+		}
+		if !ed25519.Verify(key, hash, b) {
+			return errors.New("dkim: signature does not match")
+		}
+	}
+	return nil
+}
+
+// publicKey fetches the key record at <selector>._domainkey.<domain>.
+func publicKey(txt LookupTXT, selector, domain string) (crypto.PublicKey, error) {
+	txts, err := txt(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: lookup: %w", err)
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := base64.StdEncoding.DecodeString(stripWSP(tags["p"]))
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("dkim: key record has no valid p= tag")
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(p)
+		if err != nil {
+			if key, err := x509.ParsePKCS1PublicKey(p); err == nil {
+				return key, nil
+			}
+			return nil, fmt.Errorf("dkim: x509.ParsePKIXPublicKey: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("dkim: key record is %T, not rsa", key)
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errors.New("dkim: ed25519 key is the wrong size")
+		}
+		return ed25519.PublicKey(p), nil
+	default:
+		return nil, fmt.Errorf("dkim: unknown key type %s", tags["k"])
+	}
+}
+
+// PublicKeyRecord is the TXT record to publish for a key.
+func PublicKeyRecord(s crypto.Signer) (string, error) {
+	switch key := s.Public().(type) {
+	case *rsa.PublicKey:
+		p, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", fmt.Errorf("dkim: x509.MarshalPKIXPublicKey: %w", err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(p), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	default:
+		return "", fmt.Errorf("dkim: unsupported key type %T", key)
+	}
+}
+
+func canonHeader(canon, f string) string {
+	if canon == "relaxed" {
+		return relaxedHeader(f)
+	}
+	return f
+}
+
+// parseTags parses a tag=value list.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ";") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			return nil, fmt.Errorf("dkim: malformed tag %q", strings.TrimSpace(t))
+		}
+		tags[strings.TrimSpace(k)] = strings.TrimSpace(strings.ReplaceAll(v, "\r\n", ""))
+	}
+	return tags, nil
+}
+
+func stripWSP(s string) string {
+	return string(bytes.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, []byte(s)))
+}
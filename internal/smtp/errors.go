@@ -0,0 +1,168 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// Phase is the step of sending a message that failed.
+type Phase string
+
+const (
+	PhaseDial Phase = "dial"
+	PhaseTLS  Phase = "tls"
+	PhaseAuth Phase = "auth"
+	PhaseMail Phase = "mail"
+	PhaseRcpt Phase = "rcpt"
+	PhaseData Phase = "data"
+)
+
+// Error is a failure reported by the server, or API, that was sent to.
+// Whatever the transport, Code is an SMTP reply code so errors can be
+// handled the same way: 4xx may work if retried, 5xx will not.
+type Error struct {
+	// Transport is where the error came from, such as "smtp" or "sendgrid".
+	Transport string
+	// Phase is the step that failed.
+	Phase Phase
+	// Code is the SMTP reply code, or the closest one to the API's response.
+	// It is 0 when there was no reply, such as when the server could not
+	// be reached.
+	Code int
+	// EnhancedCode is the RFC 3463 status code, such as 5.1.1, when the
+	// server gave one.
+	EnhancedCode string
+	// Message is the server's explanation.
+	Message string
+	// Err is the underlying error, if there is one.
+	Err error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Transport + ": ")
+	if e.Phase != "" {
+		b.WriteString(string(e.Phase) + ": ")
+	}
+	if e.Code != 0 {
+		b.WriteString(fmt.Sprintf("%d ", e.Code))
+	}
+	if e.EnhancedCode != "" {
+		b.WriteString(e.EnhancedCode + " ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Temporary reports whether sending again later may work, which is the
+// case for 4xx replies and for the network failing before there was one.
+func (e *Error) Temporary() bool {
+	if e.Code == 0 {
+		return isNetworkError(e.Err)
+	}
+	return e.Code >= 400 && e.Code < 500
+}
+
+// isNetworkError reports whether err is the connection timing out, being
+// refused or cut off, rather than something that fails the same way every
+// time, such as a certificate that can't be verified.
+func isNetworkError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsTemporary reports whether err is an Error that may go away
+// if the message is sent again later.
+func IsTemporary(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Temporary()
+}
+
+// IsPermanent reports whether err is an Error that will happen again
+// however many times the message is sent, such as an unknown mailbox.
+func IsPermanent(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && !e.Temporary()
+}
+
+// badMailbox are the RFC 3463 codes for a recipient's address that
+// doesn't exist, unlike 5.1.7 and 5.1.8 which are about the sender's.
+var badMailbox = map[string]bool{"5.1.1": true, "5.1.2": true, "5.1.3": true, "5.1.6": true, "5.1.10": true}
+
+// IsBadMailbox reports whether err is the server refusing a recipient
+// as there is no such mailbox, which is the only failure it is worth
+// never sending to the address again for.
+func IsBadMailbox(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Phase == PhaseRcpt && e.Code >= 500 && badMailbox[e.EnhancedCode]
+}
+
+// enhancedCode matches the RFC 3463 code at the start of a reply.
+var enhancedCode = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s+`)
+
+// phaseError wraps an error from the given phase of an SMTP session in
+// an Error. Errors that already are one, and those from the context,
+// are returned as they are.
+func phaseError(phase Phase, err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return &Error{Transport: "smtp", Phase: phase, Message: err.Error(), Err: err}
+	}
+
+	e = &Error{Transport: "smtp", Phase: phase, Code: tpErr.Code, Message: tpErr.Msg, Err: err}
+	if m := enhancedCode.FindStringSubmatch(tpErr.Msg); m != nil {
+		e.EnhancedCode, e.Message = m[1], tpErr.Msg[len(m[0]):]
+	}
+	return e
+}
+
+// httpError maps an API's response status to the nearest SMTP reply code.
+func httpError(transport string, status int, msg string) *Error {
+	code, phase := 554, PhaseData // transaction failed
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		code, phase = 535, PhaseAuth // authentication credentials invalid
+	case status == http.StatusRequestEntityTooLarge:
+		code = 552 // exceeded storage allocation
+	case status == http.StatusTooManyRequests:
+		code = 421 // service not available, try again later
+	case status >= 500:
+		code = 451 // local error in processing
+	}
+
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &Error{Transport: transport, Phase: phase, Code: code, Message: msg}
+}
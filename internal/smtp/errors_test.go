@@ -0,0 +1,112 @@
+package smtp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/adoublef/pinkpink/internal/smtp/smtptest"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestError(t *testing.T) {
+	t.Run("rcpt", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t, func(s *smtptest.Server) { s.Reject = []string{"to@example.com"} })
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), newTestMessage())
+
+		var smtpErr *smtp.Error
+		is.True(errors.As(err, &smtpErr)) // smtp error
+		is.Equal(smtpErr.Phase, smtp.PhaseRcpt)
+		is.Equal(smtpErr.Code, 550)
+		is.Equal(smtpErr.EnhancedCode, "5.1.1")
+		is.Equal(smtpErr.Message, "No such user")
+		is.True(smtp.IsPermanent(err))  // unknown mailbox
+		is.True(!smtp.IsTemporary(err)) // not worth retrying
+		is.True(smtp.IsBadMailbox(err)) // the address is what's wrong
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		cfg := srv.Config()
+		cfg.Password = "wrong"
+		c := smtp.NewClient(cfg)
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), newTestMessage())
+
+		var smtpErr *smtp.Error
+		is.True(errors.As(err, &smtpErr)) // smtp error
+		is.Equal(smtpErr.Phase, smtp.PhaseAuth)
+		is.Equal(smtpErr.Code, 535)
+		is.Equal(smtpErr.EnhancedCode, "5.7.8")
+		is.True(smtp.IsPermanent(err))   // bad credentials
+		is.True(!smtp.IsBadMailbox(err)) // nothing wrong with the recipient
+	})
+
+	t.Run("config", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t, func(s *smtptest.Server) { s.NoStartTLS = true })
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), newTestMessage())
+
+		var smtpErr *smtp.Error
+		is.True(errors.As(err, &smtpErr)) // smtp error
+		is.Equal(smtpErr.Phase, smtp.PhaseTLS)
+		is.True(smtp.IsPermanent(err)) // fails the same way every time
+
+		cfg := srv.Config()
+		cfg.Hostname, cfg.TLS = "relay.example.com", smtp.TLSNone
+		c = smtp.NewClient(cfg)
+		t.Cleanup(func() { c.Close() })
+
+		_, err = c.Send(context.Background(), newTestMessage())
+		is.True(smtp.IsPermanent(err)) // plaintext to a remote host
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		is := is.New(t)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		is.NoErr(err) // listen
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		l.Close()
+
+		c := smtp.NewClient(&smtp.Config{Hostname: "127.0.0.1", Port: port, From: "from@example.com"})
+		t.Cleanup(func() { c.Close() })
+
+		_, err = c.Send(context.Background(), newTestMessage())
+
+		var smtpErr *smtp.Error
+		is.True(errors.As(err, &smtpErr)) // smtp error
+		is.Equal(smtpErr.Phase, smtp.PhaseDial)
+		is.Equal(smtpErr.Code, 0)
+		is.True(smtp.IsTemporary(err)) // server may come back
+	})
+
+	t.Run("context", func(t *testing.T) {
+		is := is.New(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		srv := newTestServer(t)
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(ctx, newTestMessage())
+		is.True(errors.Is(err, context.Canceled)) // context error as is
+		is.True(!smtp.IsTemporary(err) && !smtp.IsPermanent(err))
+	})
+}
@@ -0,0 +1,558 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Mail clients are poor browsers: many drop <style> elements, and
+// HTML-only mail is marked as spam more often. So before a message
+// is sent its CSS is moved into style attributes and, when it has
+// no plain text body, one is made from the HTML.
+
+// withAlternative returns a copy of the message with its CSS inlined
+// and a plain text body, so it goes out as multipart/alternative.
+func (m *Message) withAlternative() (*Message, error) {
+	if m.HTML == "" {
+		return m, nil
+	}
+
+	mm := *m
+	if strings.Contains(strings.ToLower(mm.HTML), "<style") {
+		var err error
+		if mm.HTML, err = InlineCSS(mm.HTML); err != nil {
+			return nil, err
+		}
+	}
+	if mm.Text == "" {
+		mm.Text = HTMLToText(mm.HTML)
+	}
+	return &mm, nil
+}
+
+// dynamic matches the selectors that can't be inlined, as they
+// depend on the reader or aren't elements.
+var dynamic = regexp.MustCompile(`(?i):(hover|active|focus|visited|target)\b|::|:(before|after|first-line|first-letter)\b`)
+
+// InlineCSS moves the rules in the HTML's <style> elements into style
+// attributes, in order of specificity, with those already there
+// winning. Rules that can't be inlined, such as @media queries and
+// :hover, are kept in a <style> element for the clients that use them.
+func InlineCSS(src string) (string, error) {
+	root, full, err := parseHTML(src)
+	if err != nil {
+		return "", err
+	}
+
+	var css strings.Builder
+	var styles []*html.Node
+	walkHTML(root, func(n *html.Node) {
+		if n.DataAtom == atom.Style {
+			styles = append(styles, n)
+			if n.FirstChild != nil {
+				css.WriteString(n.FirstChild.Data + "\n")
+			}
+		}
+	})
+	for _, n := range styles {
+		n.Parent.RemoveChild(n)
+	}
+
+	rules, keep := parseCSS(css.String())
+
+	type match struct {
+		spec  cascadia.Specificity
+		order int
+		decls []cssDecl
+	}
+	matches := make(map[*html.Node][]match)
+	var order []*html.Node
+	for i, r := range rules {
+		for _, el := range cascadia.QueryAll(root, r.sel) {
+			if _, ok := matches[el]; !ok {
+				order = append(order, el)
+			}
+			matches[el] = append(matches[el], match{r.sel.Specificity(), i, r.decls})
+		}
+	}
+
+	for _, el := range order {
+		ms := matches[el]
+		sort.SliceStable(ms, func(i, j int) bool {
+			if ms[i].spec != ms[j].spec {
+				return ms[i].spec.Less(ms[j].spec)
+			}
+			return ms[i].order < ms[j].order
+		})
+
+		var s style
+		for _, m := range ms {
+			s.add(m.decls)
+		}
+		for i, a := range el.Attr {
+			if a.Key == "style" {
+				s.add(parseDecls(a.Val))
+				el.Attr = append(el.Attr[:i], el.Attr[i+1:]...)
+				break
+			}
+		}
+		if len(s.decls) > 0 {
+			el.Attr = append(el.Attr, html.Attribute{Key: "style", Val: s.String()})
+		}
+	}
+
+	if keep != "" {
+		st := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+		st.AppendChild(&html.Node{Type: html.TextNode, Data: keep})
+		if head := findHTML(root, atom.Head); head != nil {
+			head.AppendChild(st)
+		} else {
+			root.InsertBefore(st, root.FirstChild)
+		}
+	}
+
+	var buf bytes.Buffer
+	if !full {
+		// the fragment is rendered without the body it was parsed in
+		for c := root.FirstChild; c != nil; c = c.NextSibling {
+			if err := html.Render(&buf, c); err != nil {
+				return "", fmt.Errorf("html.Render: %w", err)
+			}
+		}
+		return buf.String(), nil
+	}
+	if err := html.Render(&buf, root); err != nil {
+		return "", fmt.Errorf("html.Render: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// parseHTML parses a whole document, or a fragment as though it were
+// in a <body>, returning the document or the body so fragments stay
+// fragments.
+func parseHTML(src string) (root *html.Node, full bool, err error) {
+	lower := strings.ToLower(src)
+	if strings.Contains(lower, "<html") || strings.Contains(lower, "<!doctype") {
+		doc, err := html.Parse(strings.NewReader(src))
+		if err != nil {
+			return nil, false, fmt.Errorf("html.Parse: %w", err)
+		}
+		return doc, true, nil
+	}
+
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(src), body)
+	if err != nil {
+		return nil, false, fmt.Errorf("html.ParseFragment: %w", err)
+	}
+	for _, n := range nodes {
+		body.AppendChild(n)
+	}
+	return body, false, nil
+}
+
+func walkHTML(n *html.Node, f func(n *html.Node)) {
+	f(n)
+	for c := n.FirstChild; c != nil; {
+		// f may remove c
+		next := c.NextSibling
+		walkHTML(c, f)
+		c = next
+	}
+}
+
+func findHTML(root *html.Node, a atom.Atom) *html.Node {
+	var found *html.Node
+	walkHTML(root, func(n *html.Node) {
+		if found == nil && n.DataAtom == a {
+			found = n
+		}
+	})
+	return found
+}
+
+type cssRule struct {
+	sel   cascadia.Sel
+	decls []cssDecl
+}
+
+type cssDecl struct {
+	prop, value string
+	important   bool
+}
+
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// parseCSS returns the rules that can be inlined, a rule per
+// selector, and the CSS that can't be.
+func parseCSS(css string) (rules []cssRule, keep string) {
+	css = cssComment.ReplaceAllString(css, "")
+
+	var kept strings.Builder
+	for css = strings.TrimSpace(css); css != ""; css = strings.TrimSpace(css) {
+		open := strings.IndexByte(css, '{')
+		if css[0] == '@' {
+			// statements such as @import end at a semicolon
+			if semi := strings.IndexByte(css, ';'); semi >= 0 && (open < 0 || semi < open) {
+				kept.WriteString(css[:semi+1] + "\n")
+				css = css[semi+1:]
+				continue
+			}
+		}
+		if open < 0 {
+			break
+		}
+
+		end, closed := closingBrace(css, open)
+		if css[0] == '@' {
+			kept.WriteString(css[:end] + "\n")
+			css = css[end:]
+			continue
+		}
+
+		// a rule that is never closed runs to the end of the css
+		selectors, body := css[:open], css[open+1:end]
+		if closed {
+			body = body[:len(body)-1]
+		}
+		css = css[end:]
+
+		decls := parseDecls(body)
+		for _, s := range splitTop(selectors, ',') {
+			s = strings.TrimSpace(s)
+			sel, err := cascadia.Parse(s)
+			if err != nil || dynamic.MatchString(s) {
+				kept.WriteString(s + " {" + body + "}\n")
+				continue
+			}
+			rules = append(rules, cssRule{sel, decls})
+		}
+	}
+	return rules, kept.String()
+}
+
+// closingBrace is the index after the brace that closes the one at
+// open, or the end of the css when it is never closed.
+func closingBrace(css string, open int) (int, bool) {
+	depth := 0
+	for i := open; i < len(css); i++ {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i + 1, true
+			}
+		}
+	}
+	return len(css), false
+}
+
+// splitTop splits s at sep, except inside quotes or brackets.
+func splitTop(s string, sep byte) []string {
+	var parts []string
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseDecls(s string) []cssDecl {
+	var decls []cssDecl
+	for _, d := range splitTop(s, ';') {
+		prop, value, ok := strings.Cut(d, ":")
+		if !ok {
+			continue
+		}
+		d := cssDecl{prop: strings.ToLower(strings.TrimSpace(prop)), value: strings.TrimSpace(value)}
+		if v := strings.TrimSuffix(d.value, "!important"); v != d.value {
+			d.value, d.important = strings.TrimSpace(v), true
+		}
+		if d.prop != "" && d.value != "" {
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+// style is the declarations an element ends up with,
+// in the order their properties first appeared.
+type style struct {
+	decls []cssDecl
+}
+
+// add sets the declarations, which override those already set
+// unless they were !important and these aren't.
+func (s *style) add(decls []cssDecl) {
+	for _, d := range decls {
+		i := 0
+		for ; i < len(s.decls) && s.decls[i].prop != d.prop; i++ {
+		}
+		switch {
+		case i == len(s.decls):
+			s.decls = append(s.decls, d)
+		case s.decls[i].important && !d.important:
+			// the stylesheet's !important beats inline styles too
+		default:
+			s.decls[i] = d
+		}
+	}
+}
+
+func (s *style) String() string {
+	parts := make([]string, len(s.decls))
+	for i, d := range s.decls {
+		parts[i] = d.prop + ": " + d.value
+		if d.important {
+			parts[i] += " !important"
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// HTMLToText makes a plain text body from the HTML, keeping
+// its headings, lists, quotes and where its links go.
+func HTMLToText(src string) string {
+	root, _, err := parseHTML(src)
+	if err != nil {
+		return ""
+	}
+
+	var w htmlText
+	w.children(root)
+	return strings.TrimSpace(w.String()) + "\n"
+}
+
+// htmlText writes HTML as text, collapsing white space as a browser
+// would. Breaks between blocks are only written once there is more
+// text after them, so there are never more than asked for.
+type htmlText struct {
+	strings.Builder
+	// prefix starts each line, for quotes and list items.
+	prefix string
+	// marker replaces the end of the prefix on the next line.
+	marker string
+	// breaks are the line breaks owed before the next text, and
+	// gap the prefix when they were asked for.
+	breaks int
+	gap    string
+	// space is owed before the next text, unless it starts a line.
+	space     bool
+	lineStart bool
+	pre       bool
+}
+
+// block asks for n line breaks before what comes next.
+func (w *htmlText) block(n int) {
+	if w.Len() > 0 && n > w.breaks {
+		w.breaks, w.gap = n, w.prefix
+	}
+}
+
+func (w *htmlText) text(s string) {
+	if w.pre {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.breaks++
+			}
+			if line != "" {
+				w.flush()
+				w.WriteString(line)
+				w.lineStart = false
+			}
+		}
+		return
+	}
+
+	if s != "" && strings.TrimLeft(s, " \t\r\n") != s {
+		w.space = true
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return
+	}
+
+	w.flush()
+	if w.space && !w.lineStart {
+		w.WriteByte(' ')
+	}
+	w.WriteString(strings.Join(fields, " "))
+	w.lineStart = false
+	w.space = strings.TrimRight(s, " \t\r\n") != s
+}
+
+// flush writes the line breaks owed, and the prefix after them.
+func (w *htmlText) flush() {
+	if w.breaks == 0 && w.Len() > 0 {
+		return
+	}
+	// blank lines only keep the prefix they share, so
+	// a quote doesn't start or end with an empty line
+	gap := w.gap
+	for !strings.HasPrefix(w.prefix, gap) {
+		gap = gap[:len(gap)-1]
+	}
+	for i := 0; i < w.breaks; i++ {
+		if i > 0 {
+			w.WriteString(strings.TrimRight(gap, " "))
+		}
+		w.WriteByte('\n')
+	}
+	w.breaks = 0
+
+	p := w.prefix
+	if w.marker != "" {
+		p, w.marker = p[:len(p)-len(w.marker)]+w.marker, ""
+	}
+	w.WriteString(p)
+	w.space, w.lineStart = false, true
+}
+
+func (w *htmlText) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *htmlText) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Style, atom.Script, atom.Title, atom.Template:
+	case atom.Br:
+		w.breaks++
+	case atom.Hr:
+		w.block(2)
+		w.text("----")
+		w.block(2)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		w.block(2)
+		var h htmlText
+		h.children(n)
+		s := strings.TrimSpace(h.String())
+		w.text(s)
+		switch n.DataAtom {
+		case atom.H1:
+			w.breaks = 1
+			w.text(strings.Repeat("=", len([]rune(s))))
+		case atom.H2:
+			w.breaks = 1
+			w.text(strings.Repeat("-", len([]rune(s))))
+		}
+		w.block(2)
+	case atom.P, atom.Table, atom.Pre:
+		w.block(2)
+		if n.DataAtom == atom.Pre {
+			w.pre = true
+			defer func() { w.pre = false }()
+		}
+		w.children(n)
+		w.block(2)
+	case atom.Div, atom.Tr, atom.Section, atom.Header, atom.Footer, atom.Article, atom.Center:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+	case atom.Td, atom.Th:
+		w.space = true
+		w.children(n)
+		w.space = true
+	case atom.Blockquote:
+		w.block(2)
+		prefix := w.prefix
+		w.prefix += "> "
+		w.children(n)
+		w.prefix = prefix
+		w.block(2)
+	case atom.Ul, atom.Ol:
+		// lists in lists are part of their item
+		gap := 2
+		if w.marker != "" || strings.HasSuffix(w.prefix, "  ") {
+			gap = 1
+		}
+		w.block(gap)
+		w.list(n)
+		w.block(gap)
+	case atom.A:
+		var a htmlText
+		a.children(n)
+		label := strings.TrimSpace(a.String())
+		href := attr(n, "href")
+		w.text(label)
+		if href != label && (strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "http://")) {
+			if label == "" {
+				w.text(href)
+			} else {
+				w.text(" (" + href + ")")
+			}
+		}
+	case atom.Img:
+		w.text(attr(n, "alt"))
+	default:
+		w.children(n)
+	}
+}
+
+func (w *htmlText) list(n *html.Node) {
+	prefix := w.prefix
+	i := 1
+	if s, err := strconv.Atoi(attr(n, "start")); err == nil {
+		i = s
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom != atom.Li {
+			continue
+		}
+		w.block(1)
+		w.marker = "- "
+		if n.DataAtom == atom.Ol {
+			w.marker = strconv.Itoa(i) + ". "
+			i++
+		}
+		w.prefix = prefix + strings.Repeat(" ", len(w.marker))
+		w.children(c)
+		w.prefix = prefix
+	}
+	w.marker = ""
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package smtp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestInlineCSS(t *testing.T) {
+	t.Run("document", func(t *testing.T) {
+		is := is.New(t)
+
+		s, err := smtp.InlineCSS(`<!DOCTYPE html><html><head><style>
+body { margin: 0 }
+td { padding: 2px }
+.cell { padding: 4px }
+a:hover { color: red }
+@media (max-width: 600px) { td { display: block } }
+</style></head><body><table><tr><td class="cell">A</td></tr></table></body></html>`)
+		is.NoErr(err) // inline css
+
+		is.True(strings.Contains(s, `<body style="margin: 0">`))
+		// the class is more specific than the element
+		is.True(strings.Contains(s, `<td class="cell" style="padding: 4px">`))
+		// what can't be inlined is kept in the head
+		is.True(strings.Contains(s, `<head><style>a:hover { color: red }`))
+		is.True(strings.Contains(s, `@media (max-width: 600px)`))
+	})
+
+	t.Run("fragment", func(t *testing.T) {
+		is := is.New(t)
+
+		s, err := smtp.InlineCSS(`<style>p { color: red; font-size: 20px !important } #x { color: blue }</style><p id="x" style="color: purple; font-size: 12px">Hi</p>`)
+		is.NoErr(err) // inline css
+
+		// style attributes win, unless the rule is important
+		is.Equal(s, `<p id="x" style="color: purple; font-size: 20px !important">Hi</p>`)
+	})
+
+	t.Run("unterminated", func(t *testing.T) {
+		is := is.New(t)
+
+		s, err := smtp.InlineCSS(`<style>p {</style><p>x</p>`)
+		is.NoErr(err) // inline css
+		is.Equal(s, `<p>x</p>`)
+
+		s, err = smtp.InlineCSS(`<style>b { font-weight: bold } p { color: red</style><p>x</p>`)
+		is.NoErr(err) // inline css
+		is.Equal(s, `<p style="color: red">x</p>`)
+
+		s, err = smtp.InlineCSS(`<style>@media (max-width: 600px) { p { color: red }</style><p>x</p>`)
+		is.NoErr(err) // inline css
+		is.True(strings.Contains(s, `<p>x</p>`))
+	})
+}
+
+func TestHTMLToText(t *testing.T) {
+	is := is.New(t)
+
+	s := smtp.HTMLToText(`<h1>Title</h1>
+<p>Some <b>bold</b>
+ text with <a href="https://example.com">a link</a>.</p>
+<ul><li>one</li><li>two<ol><li>a</li><li>b</li></ol></li></ul>
+<blockquote><p>quoted</p><p>more</p></blockquote>
+<p>end<br>line</p>`)
+
+	is.Equal(s, `Title
+=====
+
+Some bold text with a link (https://example.com).
+
+- one
+- two
+  1. a
+  2. b
+
+> quoted
+>
+> more
+
+end
+line
+`)
+}
@@ -0,0 +1,24 @@
+package http
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authorize checks the request has the token, either as a bearer token
+// or as the password for basic auth, which a browser can ask for. It
+// responds itself when it doesn't, and nothing is let in without a token.
+func authorize(w http.ResponseWriter, r *http.Request, realm, token string) bool {
+	got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		got = password
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
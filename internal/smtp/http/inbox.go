@@ -0,0 +1,218 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+)
+
+// Inbox shows the mail kept by a smtp.Catcher, to those with the
+// token. It expects to be mounted with its prefix stripped:
+//
+//	mux.Handle("/inbox/", http.StripPrefix("/inbox", smtpHTTP.NewInbox(box, token)))
+//
+// The routes are:
+//
+//	GET    /                    list the messages as a web page
+//	GET    /messages            list the messages
+//	DELETE /messages            delete every message
+//	GET    /messages/{id}       the message's envelope and bodies
+//	DELETE /messages/{id}       delete the message
+//	GET    /messages/{id}/html  the html body
+//	GET    /messages/{id}/text  the plain text body
+//	GET    /messages/{id}/raw   the message as it would have been sent
+type Inbox struct {
+	mux   *http.ServeMux
+	box   smtp.Mailbox
+	token string
+}
+
+func (i *Inbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, "inbox", i.token) {
+		return
+	}
+	i.mux.ServeHTTP(w, r)
+}
+
+// NewInbox returns the Inbox, which turns away anyone
+// without the token, or everyone when it is empty.
+func NewInbox(box smtp.Mailbox, token string) *Inbox {
+	i := &Inbox{
+		mux:   http.NewServeMux(),
+		box:   box,
+		token: token,
+	}
+
+	i.routes()
+
+	return i
+}
+
+func (i *Inbox) routes() {
+	i.mux.HandleFunc("/", i.handleIndex())
+	i.mux.HandleFunc("/messages", i.handleMessages())
+	i.mux.HandleFunc("/messages/", i.handleMessage())
+}
+
+// summary is a message without its body, for listing.
+type summary struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+}
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Inbox</title></head>
+<body>
+<h1>Inbox</h1>
+<table>
+<tr><th>Date</th><th>From</th><th>To</th><th>Subject</th><th></th></tr>
+{{range .}}<tr>
+<td>{{.Date.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.From}}</td>
+<td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+<td><a href="messages/{{.ID}}/html">{{.Subject}}</a></td>
+<td><a href="messages/{{.ID}}/text">text</a> <a href="messages/{{.ID}}/raw">raw</a></td>
+</tr>{{else}}<tr><td colspan="5">No messages</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (i *Inbox) handleIndex() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			i.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		list, err := i.box.List(r.Context())
+		if err != nil {
+			i.error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		indexTmpl.Execute(w, list)
+	}
+}
+
+func (i *Inbox) handleMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := i.box.List(r.Context())
+			if err != nil {
+				i.error(w, r, err, http.StatusInternalServerError)
+				return
+			}
+
+			summaries := make([]summary, len(list))
+			for n, c := range list {
+				summaries[n] = summary{c.ID, c.From, c.To, c.Subject, c.Date}
+			}
+			i.respond(w, r, summaries, http.StatusOK)
+		case http.MethodDelete:
+			if err := i.box.Clear(r.Context()); err != nil {
+				i.error(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			i.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (i *Inbox) handleMessage() http.HandlerFunc {
+	type response struct {
+		summary
+		MessageID string `json:"messageId"`
+		Text      string `json:"text"`
+		HTML      string `json:"html"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, view, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/messages/"), "/")
+
+		if r.Method == http.MethodDelete && view == "" {
+			switch err := i.box.Delete(r.Context(), id); {
+			case errors.Is(err, smtp.ErrNotFound):
+				i.error(w, r, err, http.StatusNotFound)
+			case err != nil:
+				i.error(w, r, err, http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+		if r.Method != http.MethodGet {
+			i.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		c, err := i.box.Get(r.Context(), id)
+		if errors.Is(err, smtp.ErrNotFound) {
+			i.error(w, r, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			i.error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		if view == "raw" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(c.Raw)
+			return
+		}
+
+		text, html, err := c.Body()
+		if err != nil {
+			i.error(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		switch view {
+		case "":
+			i.respond(w, r, &response{summary{c.ID, c.From, c.To, c.Subject, c.Date}, c.MessageID, text, html}, http.StatusOK)
+		case "html":
+			// the html is whatever was sent, so it is kept from running scripts
+			w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src data: https:; style-src 'unsafe-inline'")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(html))
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(text))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func (i *Inbox) respond(w http.ResponseWriter, r *http.Request, v any, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if v != nil {
+		err := json.NewEncoder(w).Encode(v)
+		if err != nil {
+			http.Error(w, "Could not encode in json", status)
+		}
+	}
+}
+
+func (i *Inbox) error(w http.ResponseWriter, r *http.Request, err error, status int) {
+	http.Error(w, err.Error(), status)
+}
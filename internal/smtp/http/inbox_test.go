@@ -0,0 +1,79 @@
+package http_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	smtpHTTP "github.com/adoublef/pinkpink/internal/smtp/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInbox(t *testing.T) {
+	box := smtp.NewMemoryMailbox()
+	c := smtp.NewCatcher(box, &smtp.Config{From: "news@example.com"})
+
+	res, err := c.Send(context.Background(), &smtp.Message{
+		To:      []smtp.Address{{Address: "to@example.com"}},
+		Subject: "Welcome",
+		Text:    "Hello World",
+		HTML:    "<h1>Hello World</h1>",
+	})
+	require.NoError(t, err, "failed to catch message")
+
+	mux := http.NewServeMux()
+	mux.Handle("/inbox/", http.StripPrefix("/inbox", smtpHTTP.NewInbox(box, "secret")))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() { srv.Close() })
+
+	resp, err := srv.Client().Get(srv.URL + "/inbox/")
+	require.NoError(t, err, "failed to make get request")
+	require.Equal(t, 401, resp.StatusCode, "inbox is open without the token")
+
+	get := func(path string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.SetBasicAuth("", "secret")
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err, "failed to make get request")
+		defer resp.Body.Close()
+
+		p, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "failed to read body")
+		return resp, string(p)
+	}
+
+	resp, body := get("/inbox/")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.Contains(t, body, "Welcome", "index does not list the message")
+
+	resp, body = get("/inbox/messages")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+
+	var list []struct{ ID, Subject string }
+	require.NoError(t, json.Unmarshal([]byte(body), &list), "failed to decode list")
+	require.Len(t, list, 1, "list length does not match")
+	require.Equal(t, res.QueueID, list[0].ID, "message id does not match")
+
+	resp, body = get("/inbox/messages/" + res.QueueID + "/html")
+	require.Equal(t, "<h1>Hello World</h1>", body, "html body does not match")
+	require.Contains(t, resp.Header.Get("Content-Security-Policy"), "sandbox", "html is not sandboxed")
+
+	_, body = get("/inbox/messages/" + res.QueueID + "/text")
+	require.Equal(t, "Hello World", body, "text body does not match")
+
+	_, body = get("/inbox/messages/" + res.QueueID + "/raw")
+	require.Contains(t, body, "Subject: Welcome", "raw message does not match")
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/inbox/messages/"+res.QueueID, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = srv.Client().Do(req)
+	require.NoError(t, err, "failed to make delete request")
+	require.Equal(t, 204, resp.StatusCode, "response status code does not match")
+
+	resp, _ = get("/inbox/messages/" + res.QueueID)
+	require.Equal(t, 404, resp.StatusCode, "deleted message still found")
+}
@@ -2,27 +2,40 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
+	"time"
 
 	"github.com/adoublef/pinkpink/internal/openapi"
 	"github.com/adoublef/pinkpink/internal/smtp"
 	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"golang.org/x/text/language"
 )
 
 type Service struct {
-	mux *http.ServeMux
-	p   smtpNATS.Producer
+	mux       *http.ServeMux
+	p         smtpNATS.Producer
+	u         *smtp.Unsubscriber
+	sup       smtp.Suppressions
+	bounceKey string
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
-func New(p smtpNATS.Producer) *Service {
+// New returns the Service. The unsubscribe endpoint is only served
+// when u is not nil, and the bounces one when there is a bounceKey
+// for whatever sends the bounces to authenticate with.
+func New(p smtpNATS.Producer, u *smtp.Unsubscriber, sup smtp.Suppressions, bounceKey string) *Service {
 	s := &Service{
-		mux: http.NewServeMux(),
-		p:   p,
+		mux:       http.NewServeMux(),
+		p:         p,
+		u:         u,
+		sup:       sup,
+		bounceKey: bounceKey,
 	}
 
 	s.routes()
@@ -35,6 +48,12 @@ func (s *Service) routes() {
 
 	s.mux.Handle("/api", openapi.FileServer("/"))
 	s.mux.HandleFunc("/api/subscribe", s.handleSubscribe())
+	if s.bounceKey != "" {
+		s.mux.HandleFunc("/api/bounces", s.handleBounces())
+	}
+	if s.u != nil {
+		s.mux.HandleFunc("/api/unsubscribe", s.handleUnsubscribe())
+	}
 }
 
 func (s *Service) handleSubscribe() http.HandlerFunc {
@@ -42,8 +61,13 @@ func (s *Service) handleSubscribe() http.HandlerFunc {
 		Email     smtp.Address `json:"email"`
 		Subject   string       `json:"subject"`
 		Message   string       `json:"message"`
+		Markdown  string       `json:"markdown"`
 		FirstName string       `json:"firstName"`
 		LastName  string       `json:"lastName"`
+		// Template is the name of a template to send instead of the
+		// subject and message, filled in with Data.
+		Template string         `json:"template"`
+		Data     map[string]any `json:"data"`
 	}
 
 	type response struct {
@@ -51,19 +75,36 @@ func (s *Service) handleSubscribe() http.HandlerFunc {
 	}
 
 	parseEmail := func(w http.ResponseWriter, r *http.Request) (*smtp.Email, error) {
+		// the email is queued much as it is sent, so it has to fit
+		r.Body = http.MaxBytesReader(w, r.Body, smtpNATS.MaxMsgSize/2)
+
 		var req request
 		if err := s.decode(w, r, &req); err != nil {
 			return nil, err
 		}
 
-		// subject must be between 1 to 50 characters
-		if len(req.Subject) < 1 || len(req.Subject) > 50 {
-			return nil, fmt.Errorf("subject must be between 1 to 50 characters")
-		}
+		if req.Template != "" {
+			// template must be at most 100 characters, the template itself gives the subject
+			if len(req.Template) > 100 {
+				return nil, fmt.Errorf("template must be at most 100 characters")
+			}
+		} else {
+			// subject must be between 1 to 50 characters
+			if len(req.Subject) < 1 || len(req.Subject) > 50 {
+				return nil, fmt.Errorf("subject must be between 1 to 50 characters")
+			}
 
-		// message must be between 1 to 255 characters
-		if len(req.Message) < 1 || len(req.Message) > 255 {
-			return nil, fmt.Errorf("message must be between 1 to 255 characters")
+			switch {
+			// markdown is used in place of the message, and may be
+			// longer while still well under smtpNATS.MaxMsgSize
+			case req.Markdown != "":
+				if len(req.Markdown) > 10000 {
+					return nil, fmt.Errorf("markdown must be at most 10000 characters")
+				}
+			// message must be between 1 to 255 characters
+			case len(req.Message) < 1 || len(req.Message) > 255:
+				return nil, fmt.Errorf("message must be between 1 to 255 characters")
+			}
 		}
 
 		// firstname must be between 1 to 50 characters
@@ -79,7 +120,10 @@ func (s *Service) handleSubscribe() http.HandlerFunc {
 		return &smtp.Email{
 			Subject:    req.Subject,
 			Message:    req.Message,
-			Recipients: []smtp.Recipient{{Address: req.Email, FirstName: req.FirstName, LastName: req.LastName}},
+			Markdown:   req.Markdown,
+			Template:   req.Template,
+			Data:       req.Data,
+			Recipients: []smtp.Recipient{{Address: req.Email, FirstName: req.FirstName, LastName: req.LastName, Locale: acceptLocale(r)}},
 		}, nil
 	}
 
@@ -99,6 +143,103 @@ func (s *Service) handleSubscribe() http.HandlerFunc {
 	}
 }
 
+// maxBounceSize is large enough for a bounce with the
+// original message attached.
+const maxBounceSize = 10 << 20
+
+// handleBounces takes a bounce, as piped from the mail server or
+// posted by an inbound webhook with the bounce key, suppressing the
+// recipients that hard bounced and publishing an event for each.
+func (s *Service) handleBounces() http.HandlerFunc {
+	type response struct {
+		Bounces []smtp.Bounce `json:"bounces"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, "bounces", s.bounceKey) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			s.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		bounces, err := smtp.ParseBounce(http.MaxBytesReader(w, r.Body, maxBounceSize))
+		if err != nil {
+			s.error(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		for _, b := range bounces {
+			e := b.Event()
+			if b.Type == smtp.BounceHard {
+				if err := s.sup.Suppress(r.Context(), e); err != nil {
+					s.error(w, r, err, http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := s.p.Publish(smtpNATS.SubjectEvents, e); err != nil {
+				s.error(w, r, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		s.respond(w, r, &response{Bounces: bounces}, http.StatusOK)
+	}
+}
+
+var unsubscribeTmpl = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}<p>{{.Email}} has been unsubscribed.</p>
+{{else}}<form method="post">
+<p>Stop sending mail to {{.Email}}?</p>
+<button name="List-Unsubscribe" value="One-Click">Unsubscribe</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// handleUnsubscribe serves the links made by the Unsubscriber. Mail
+// clients POST to them for RFC 8058 one-click unsubscribing, whereas
+// a GET only asks to confirm, as link scanners follow those. The
+// address is suppressed before the POST is answered.
+func (s *Service) handleUnsubscribe() http.HandlerFunc {
+	type page struct {
+		Email string
+		Done  bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		email, token := r.URL.Query().Get("email"), r.URL.Query().Get("token")
+		if email == "" || !s.u.Verify(email, token) {
+			s.error(w, r, errors.New("invalid unsubscribe link"), http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			e := &smtp.Event{Type: smtp.EventUnsubscribed, Recipient: email, Time: time.Now()}
+			if err := s.sup.Suppress(r.Context(), e); err != nil {
+				s.error(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			if err := s.p.Publish(smtpNATS.SubjectEvents, e); err != nil {
+				s.error(w, r, err, http.StatusInternalServerError)
+				return
+			}
+		default:
+			s.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribeTmpl.Execute(w, &page{Email: email, Done: r.Method == http.MethodPost})
+	}
+}
+
 func (s *Service) decode(w http.ResponseWriter, r *http.Request, v any) error {
 	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
 		return fmt.Errorf("json.NewDecoder: %w", err)
@@ -120,3 +261,19 @@ func (s *Service) respond(w http.ResponseWriter, r *http.Request, v any, status
 func (s *Service) error(w http.ResponseWriter, r *http.Request, err error, status int) {
 	http.Error(w, err.Error(), status)
 }
+
+// acceptLocale is the locale the request's Accept-Language prefers
+// most, or "" when it has none.
+func acceptLocale(r *http.Request) string {
+	tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil {
+		return ""
+	}
+	for _, tag := range tags {
+		// * is any language, which is what having none means anyway
+		if tag != language.Und && tag.String() != "mul" {
+			return tag.String()
+		}
+	}
+	return ""
+}
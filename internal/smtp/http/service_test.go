@@ -4,11 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/adoublef/pinkpink/internal/smtp"
 	smtpHTTP "github.com/adoublef/pinkpink/internal/smtp/http"
 	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
 	containers "github.com/adoublef/pinkpink/pkg/containers/nats"
@@ -84,10 +86,163 @@ func TestService(t *testing.T) {
 	require.Equal(t, 400, resp.StatusCode, "response status code does not match")
 }
 
+func TestSubscribeTemplate(t *testing.T) {
+	p := &fakeProducer{}
+	srv := newTestServer(t, p)
+	t.Cleanup(func() { srv.Close() })
+
+	body := `{"email":"ada@example.com","firstName":"Ada","template":"welcome","data":{"plan":"pro"}}`
+	resp, err := srv.Client().Post(srv.URL+"/api/subscribe", "application/json", strings.NewReader(body))
+	require.NoError(t, err, "failed to make post request")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+
+	require.Len(t, p.published, 1, "email not published")
+	e := p.published[0].(*smtp.Email)
+	require.Equal(t, "welcome", e.Template, "template does not match")
+	require.Equal(t, "pro", e.Data["plan"], "data does not match")
+
+	body = `{"email":"ada@example.com","firstName":"Ada","subject":"News","markdown":"# Hello"}`
+	resp, err = srv.Client().Post(srv.URL+"/api/subscribe", "application/json", strings.NewReader(body))
+	require.NoError(t, err, "failed to make post request")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.Equal(t, "# Hello", p.published[1].(*smtp.Email).Markdown, "markdown does not match")
+
+	// neither a template nor a message
+	body = `{"email":"ada@example.com","firstName":"Ada"}`
+	resp, err = srv.Client().Post(srv.URL+"/api/subscribe", "application/json", strings.NewReader(body))
+	require.NoError(t, err, "failed to make post request")
+	require.Equal(t, 400, resp.StatusCode, "response status code does not match")
+}
+
+func TestSubscribeLocale(t *testing.T) {
+	p := &fakeProducer{}
+	srv := newTestServer(t, p)
+	t.Cleanup(func() { srv.Close() })
+
+	for header, want := range map[string]string{
+		"fr-ca, fr;q=0.9, en;q=0.8": "fr-CA",
+		"*;q=0.5, de;q=0.8":         "de",
+		"":                          "",
+	} {
+		body := `{"email":"ada@example.com","firstName":"Ada","template":"welcome"}`
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/subscribe", strings.NewReader(body))
+		require.NoError(t, err, "failed to create request")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", header)
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err, "failed to make post request")
+		require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+
+		e := p.published[len(p.published)-1].(*smtp.Email)
+		require.Equal(t, want, e.Recipients[0].Locale, "locale does not match")
+	}
+}
+
+func TestBounces(t *testing.T) {
+	p, sup := &fakeProducer{}, smtp.NewMemorySuppressions()
+	srv := httptest.NewServer(smtpHTTP.New(p, testUnsubscriber, sup, "secret"))
+	t.Cleanup(func() { srv.Close() })
+
+	bounce := "From: MAILER-DAEMON@mx.example.org\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"X-Failed-Recipients: gone@example.org\r\n" +
+		"\r\n" +
+		"550 5.1.1 No such user\r\n"
+
+	post := func(body string, key string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/bounces", strings.NewReader(body))
+		req.Header.Set("Content-Type", "message/rfc822")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err, "failed to make post request")
+		return resp
+	}
+
+	// anyone could suppress any address without the key
+	resp := post(bounce, "")
+	require.Equal(t, 401, resp.StatusCode, "response status code does not match")
+	resp = post(bounce, "guess")
+	require.Equal(t, 401, resp.StatusCode, "response status code does not match")
+	require.Len(t, p.published, 0, "forged bounce published")
+
+	resp = post(bounce, "secret")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+
+	require.Len(t, p.published, 1, "one event per bounce")
+	e := p.published[0].(*smtp.Event)
+	require.Equal(t, smtp.EventBounced, e.Type, "event type does not match")
+	require.Equal(t, "gone@example.org", e.Recipient, "recipient does not match")
+	require.Equal(t, smtp.BounceHard, e.Bounce.Type, "bounce type does not match")
+
+	ok, err := sup.Suppressed(context.Background(), "gone@example.org")
+	require.NoError(t, err, "failed to look up address")
+	require.True(t, ok, "hard bounce not suppressed")
+
+	// refused as spam says nothing about the address
+	resp = post(strings.Replace(strings.Replace(bounce, "gone@", "jo@", 1), "5.1.1 No such user", "5.7.1 Rejected as spam", 1), "secret")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	ok, err = sup.Suppressed(context.Background(), "jo@example.org")
+	require.NoError(t, err, "failed to look up address")
+	require.False(t, ok, "policy bounce suppressed")
+
+	// not a bounce
+	resp = post("Subject: Hello\r\n\r\nHi\r\n", "secret")
+	require.Equal(t, 400, resp.StatusCode, "response status code does not match")
+}
+
+func TestUnsubscribe(t *testing.T) {
+	p, sup := &fakeProducer{}, smtp.NewMemorySuppressions()
+	srv := httptest.NewServer(smtpHTTP.New(p, testUnsubscriber, sup, ""))
+	t.Cleanup(func() { srv.Close() })
+
+	link := strings.Replace(testUnsubscriber.Link("jo@example.net"), testUnsubscriber.URL, srv.URL+"/api/unsubscribe", 1)
+
+	// following the link only asks to confirm
+	resp, err := srv.Client().Get(link)
+	require.NoError(t, err, "failed to make get request")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.Len(t, p.published, 0, "unsubscribed without confirming")
+
+	resp, err = srv.Client().Post(link, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	require.NoError(t, err, "failed to make post request")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+
+	require.Len(t, p.published, 1, "one event")
+	e := p.published[0].(*smtp.Event)
+	require.Equal(t, smtp.EventUnsubscribed, e.Type, "event type does not match")
+	require.Equal(t, "jo@example.net", e.Recipient, "recipient does not match")
+
+	ok, err := sup.Suppressed(context.Background(), "jo@example.net")
+	require.NoError(t, err, "failed to look up address")
+	require.True(t, ok, "unsubscribed address not suppressed")
+
+	// someone else's address with jo's token
+	forged := strings.Replace(link, "jo%40example.net", "al%40example.net", 1)
+	resp, err = srv.Client().Post(forged, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	require.NoError(t, err, "failed to make post request")
+	require.Equal(t, 403, resp.StatusCode, "response status code does not match")
+}
+
+// testUnsubscriber signs the test server's unsubscribe links.
+var testUnsubscriber = &smtp.Unsubscriber{URL: "https://example.com/api/unsubscribe", Key: []byte("secret")}
+
+// fakeProducer keeps what is published rather than publishing it.
+type fakeProducer struct {
+	published []any
+}
+
+func (p *fakeProducer) Publish(subject smtpNATS.Subject, data any) error {
+	p.published = append(p.published, data)
+	return nil
+}
+
 func newTestServer(t *testing.T, p smtpNATS.Producer) *httptest.Server {
 	t.Helper()
 
-	return httptest.NewServer(smtpHTTP.New(p))
+	return httptest.NewServer(smtpHTTP.New(p, testUnsubscriber, smtp.NewMemorySuppressions(), ""))
 }
 
 func TestMain(m *testing.M) {
@@ -0,0 +1,444 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"golang.org/x/text/language"
+)
+
+// Templates manages the versions of the templates in a
+// smtp.TemplateStore, for those with the token. It expects
+// to be mounted with its prefix stripped:
+//
+//	mux.Handle("/api/templates/", http.StripPrefix("/api/templates", smtpHTTP.NewTemplates(store, token)))
+//
+// The routes are:
+//
+//	GET  /                        list the templates
+//	GET  /{name}                  the template's versions and which is active
+//	POST /{name}                  save a new version
+//	GET  /{name}/{version}        the version's files
+//	GET  /{name}/diff?from=&to=   the changes between versions, to the active one by default
+//	POST /{name}/publish          make {"version": n} active
+//	POST /{name}/rollback         make the version that was active before active again
+//	POST /{name}/preview          render a version, the latest by default, as it would be sent
+//	POST /{name}/test             send a version to the TestTo addresses
+//
+// A template's locales are templates of their own, named after it and
+// the locale, such as welcome.fr-CA.
+type Templates struct {
+	mux   *http.ServeMux
+	store smtp.TemplateStore
+	token string
+
+	mu     sync.Mutex
+	tested map[string]time.Time
+
+	// Catalog has the shared messages templates are previewed with.
+	Catalog *smtp.Catalog
+	// Producer queues test sends to the TestTo addresses,
+	// through the worker like any other email.
+	Producer smtpNATS.Producer
+	TestTo   []smtp.Address
+	// TestEvery is how often each template can be test sent,
+	// defaults to DefaultTestEvery.
+	TestEvery time.Duration
+}
+
+// DefaultTestEvery keeps a template from being test sent
+// more than once a minute.
+const DefaultTestEvery = time.Minute
+
+func (t *Templates) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, "templates", t.token) {
+		return
+	}
+	t.mux.ServeHTTP(w, r)
+}
+
+// NewTemplates returns the Templates, which turns away anyone
+// without the token, or everyone when it is empty.
+func NewTemplates(store smtp.TemplateStore, token string) *Templates {
+	t := &Templates{
+		mux:    http.NewServeMux(),
+		store:  store,
+		token:  token,
+		tested: make(map[string]time.Time),
+	}
+
+	t.routes()
+
+	return t
+}
+
+func (t *Templates) routes() {
+	t.mux.HandleFunc("/", t.handleTemplates())
+}
+
+// templateFiles is a version of a template's files.
+type templateFiles struct {
+	Version int    `json:"version,omitempty"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html,omitempty"`
+	Markup  string `json:"markup,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+func (t *Templates) handleTemplates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		name = localName(name)
+
+		switch {
+		case name == "" && r.Method == http.MethodGet:
+			t.handleNames(w, r)
+		case name == "":
+			t.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		case action == "" && r.Method == http.MethodGet:
+			t.handleHistory(w, r, name)
+		case action == "" && r.Method == http.MethodPost:
+			t.handlePut(w, r, name)
+		case action == "diff" && r.Method == http.MethodGet:
+			t.handleDiff(w, r, name)
+		case action == "publish" && r.Method == http.MethodPost:
+			t.handlePublish(w, r, name)
+		case action == "rollback" && r.Method == http.MethodPost:
+			t.handleRollback(w, r, name)
+		case action == "preview" && r.Method == http.MethodPost:
+			t.handlePreview(w, r, name)
+		case action == "test" && r.Method == http.MethodPost:
+			t.handleTest(w, r, name)
+		case action == "diff" || action == "publish" || action == "rollback" || action == "preview" || action == "test":
+			t.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		case r.Method == http.MethodGet:
+			t.handleVersion(w, r, name, action)
+		default:
+			t.error(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (t *Templates) handleNames(w http.ResponseWriter, r *http.Request) {
+	names, err := t.store.Names(r.Context())
+	if err != nil {
+		t.error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	t.respond(w, r, names, http.StatusOK)
+}
+
+func (t *Templates) handleHistory(w http.ResponseWriter, r *http.Request, name string) {
+	h, err := t.store.History(r.Context(), name)
+	if err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+	t.respond(w, r, h, http.StatusOK)
+}
+
+// templateName is what a template can be called, which keeps
+// the names usable as paths and keys, with a locale if it has one.
+var templateName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,100}(\.[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*)?$`)
+
+// localName writes the locale in a template's name the way
+// it is looked up, so welcome.fr-ca is welcome.fr-CA.
+func localName(name string) string {
+	base, locale, ok := strings.Cut(name, ".")
+	if !ok {
+		return name
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return name
+	}
+	return smtp.LocalName(base, tag.String())
+}
+
+func (t *Templates) handlePut(w http.ResponseWriter, r *http.Request, name string) {
+	if !templateName.MatchString(name) {
+		t.error(w, r, errors.New("name must be letters, digits, - or _, then a . and a locale if it has one"), http.StatusBadRequest)
+		return
+	}
+
+	var req templateFiles
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		t.error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	v, err := t.store.Put(r.Context(), name, &smtp.TemplateFiles{Subject: req.Subject, HTML: req.HTML, Markup: req.Markup, Text: req.Text})
+	var terr *smtp.TemplateError
+	if errors.As(err, &terr) {
+		t.error(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		t.error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	t.respond(w, r, v, http.StatusCreated)
+}
+
+func (t *Templates) handleVersion(w http.ResponseWriter, r *http.Request, name, version string) {
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	files, err := t.store.Version(r.Context(), name, n)
+	if err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+	t.respond(w, r, &templateFiles{files.Version, files.Subject, files.HTML, files.Markup, files.Text}, http.StatusOK)
+}
+
+func (t *Templates) handleDiff(w http.ResponseWriter, r *http.Request, name string) {
+	h, err := t.store.History(r.Context(), name)
+	if err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+
+	// to defaults to the active version, and from to the one before it
+	to := h.Active
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = strconv.Atoi(s); err != nil {
+			t.error(w, r, errors.New("to must be a version"), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to - 1
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = strconv.Atoi(s); err != nil {
+			t.error(w, r, errors.New("from must be a version"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a, err := t.store.Version(r.Context(), name, from)
+	if err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+	b, err := t.store.Version(r.Context(), name, to)
+	if err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(smtp.DiffTemplates(a, b)))
+}
+
+func (t *Templates) handlePublish(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		t.error(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := t.store.Publish(r.Context(), name, req.Version); err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+	t.handleHistory(w, r, name)
+}
+
+func (t *Templates) handleRollback(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := t.store.Rollback(r.Context(), name); err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+	t.handleHistory(w, r, name)
+}
+
+// previewRequest is who a template is previewed for, a sample
+// recipient or a real subscriber, and the email's data.
+type previewRequest struct {
+	Version   int            `json:"version"`
+	Recipient smtp.Recipient `json:"recipient"`
+	Data      map[string]any `json:"data"`
+}
+
+// preview is a template rendered as it would be sent.
+type preview struct {
+	Version int    `json:"version"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html,omitempty"`
+	Text    string `json:"text"`
+	// MIME is the whole message, as it is written to the server.
+	MIME string `json:"mime"`
+}
+
+func (t *Templates) handlePreview(w http.ResponseWriter, r *http.Request, name string) {
+	tmpl, e, rcpt, ok := t.loadPreview(w, r, name)
+	if !ok {
+		return
+	}
+
+	data := e.TemplateData(rcpt)
+	data.Catalog = t.Catalog
+	m, p, err := tmpl.Preview(smtp.PreviewAddress, data)
+	if err != nil {
+		t.storeError(w, r, err)
+		return
+	}
+	t.respond(w, r, &preview{tmpl.Version, m.Subject, m.HTML, m.Text, string(p)}, http.StatusOK)
+}
+
+func (t *Templates) handleTest(w http.ResponseWriter, r *http.Request, name string) {
+	if t.Producer == nil || len(t.TestTo) == 0 {
+		t.error(w, r, errors.New("there is nowhere to send tests"), http.StatusNotImplemented)
+		return
+	}
+
+	tmpl, e, rcpt, ok := t.loadPreview(w, r, name)
+	if !ok {
+		return
+	}
+
+	// the version is sent whatever the recipient's locale, so
+	// it is the template's own, such as fr for welcome.fr
+	if rcpt.Locale != "" {
+		t.error(w, r, errors.New("test a locale by its template's name, such as "+smtp.LocalName(name, rcpt.Locale)), http.StatusBadRequest)
+		return
+	}
+	_, rcpt.Locale, _ = strings.Cut(name, ".")
+
+	// everyone gets what the recipient would, at their own address,
+	// and it is rendered first so mistakes are found here
+	for _, to := range t.TestTo {
+		rcpt.Address = to
+		data := e.TemplateData(rcpt)
+		data.Catalog = t.Catalog
+		if _, _, err := tmpl.Preview(smtp.PreviewAddress, data); err != nil {
+			t.storeError(w, r, err)
+			return
+		}
+		e.Recipients = append(e.Recipients, rcpt)
+	}
+	e.Test = true
+
+	if wait := t.reserveTest(name); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		t.error(w, r, errors.New("the template was test sent too recently"), http.StatusTooManyRequests)
+		return
+	}
+	if err := t.Producer.Publish(smtpNATS.SubjectSubscribe, e); err != nil {
+		t.releaseTest(name)
+		t.error(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		Version    int            `json:"version"`
+		Recipients []smtp.Address `json:"recipients"`
+	}
+	t.respond(w, r, &response{tmpl.Version, t.TestTo}, http.StatusAccepted)
+}
+
+// reserveTest reports how long until the template can be test sent
+// again, or reserves it for now when it can be.
+func (t *Templates) reserveTest(name string) time.Duration {
+	every := t.TestEvery
+	if every <= 0 {
+		every = DefaultTestEvery
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if wait := t.tested[name].Add(every).Sub(now); wait > 0 {
+		return wait
+	}
+	t.tested[name] = now
+	return 0
+}
+
+// releaseTest lets the template be test sent again, when it wasn't.
+func (t *Templates) releaseTest(name string) {
+	t.mu.Lock()
+	delete(t.tested, name)
+	t.mu.Unlock()
+}
+
+// loadPreview loads the version of the template, the latest by default,
+// and the email it would be sent in, responding itself when it can't.
+func (t *Templates) loadPreview(w http.ResponseWriter, r *http.Request, name string) (*smtp.Template, *smtp.Email, smtp.Recipient, bool) {
+	var req previewRequest
+	// with no body there is nobody in particular
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		t.error(w, r, err, http.StatusBadRequest)
+		return nil, nil, smtp.Recipient{}, false
+	}
+
+	if req.Version == 0 {
+		h, err := t.store.History(r.Context(), name)
+		if err != nil {
+			t.storeError(w, r, err)
+			return nil, nil, smtp.Recipient{}, false
+		}
+		// Latest may be reserved and not saved yet, or never saved
+		if len(h.Versions) == 0 {
+			t.storeError(w, r, &smtp.TemplateError{Name: name, Err: smtp.ErrTemplateNotFound})
+			return nil, nil, smtp.Recipient{}, false
+		}
+		req.Version = h.Versions[len(h.Versions)-1].Version
+	}
+
+	tmpl, err := smtp.LoadTemplateVersion(r.Context(), t.store, name, req.Version)
+	if err != nil {
+		t.storeError(w, r, err)
+		return nil, nil, smtp.Recipient{}, false
+	}
+	return tmpl, &smtp.Email{Template: name, TemplateVersion: tmpl.Version, Data: req.Data}, req.Recipient, true
+}
+
+// storeError responds with the status that fits the store's error.
+func (t *Templates) storeError(w http.ResponseWriter, r *http.Request, err error) {
+	var terr *smtp.TemplateError
+	switch {
+	case errors.Is(err, smtp.ErrTemplateNotFound):
+		t.error(w, r, err, http.StatusNotFound)
+	case errors.Is(err, smtp.ErrNoRollback):
+		t.error(w, r, err, http.StatusConflict)
+	case errors.As(err, &terr):
+		// the template can't be parsed or rendered
+		t.error(w, r, err, http.StatusBadRequest)
+	default:
+		t.error(w, r, err, http.StatusInternalServerError)
+	}
+}
+
+func (t *Templates) respond(w http.ResponseWriter, r *http.Request, v any, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if v != nil {
+		err := json.NewEncoder(w).Encode(v)
+		if err != nil {
+			http.Error(w, "Could not encode in json", status)
+		}
+	}
+}
+
+func (t *Templates) error(w http.ResponseWriter, r *http.Request, err error, status int) {
+	http.Error(w, err.Error(), status)
+}
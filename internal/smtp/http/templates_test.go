@@ -0,0 +1,200 @@
+package http_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	smtpHTTP "github.com/adoublef/pinkpink/internal/smtp/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplates(t *testing.T) {
+	store := smtp.NewMemoryTemplates()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/templates/", http.StripPrefix("/api/templates", smtpHTTP.NewTemplates(store, "secret")))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() { srv.Close() })
+
+	// anyone could change what every subscriber gets
+	resp, err := srv.Client().Post(srv.URL+"/api/templates/welcome", "application/json", strings.NewReader(`{"subject":"Hi","text":"Hi"}`))
+	require.NoError(t, err, "failed to make post request")
+	require.Equal(t, 401, resp.StatusCode, "saved without the token")
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err, "failed to create request")
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err, "failed to make request")
+		defer resp.Body.Close()
+
+		p, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "failed to read body")
+		return resp, string(p)
+	}
+
+	resp, _ = do(http.MethodPost, "/api/templates/welcome", `{"subject":"Hi {{.FirstName}}","text":"Hello\nWorld\n"}`)
+	require.Equal(t, 201, resp.StatusCode, "response status code does not match")
+	resp, _ = do(http.MethodPost, "/api/templates/welcome", `{"subject":"Hi {{.FirstName}}","text":"Hello\nThere\n"}`)
+	require.Equal(t, 201, resp.StatusCode, "response status code does not match")
+
+	resp, body := do(http.MethodPost, "/api/templates/welcome", `{"subject":"Hi {{.FirstName"}`)
+	require.Equal(t, 400, resp.StatusCode, "broken template saved")
+	resp, _ = do(http.MethodPost, "/api/templates/a.b", `{"text":"Hi"}`)
+	require.Equal(t, 400, resp.StatusCode, "bad name saved")
+	resp, body = do(http.MethodPost, "/api/templates/welcome", `{"subject":"Hi","markup":"<email>\n<section><text>Hi</text></section></email>"}`)
+	require.Equal(t, 400, resp.StatusCode, "broken markup saved")
+	require.Contains(t, body, "line 2: <text> can't be in <section>", "markup error does not match")
+
+	resp, body = do(http.MethodGet, "/api/templates/", "")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.JSONEq(t, `["welcome"]`, body, "names do not match")
+
+	// locales are saved the way they are looked up
+	resp, _ = do(http.MethodPost, "/api/templates/welcome.fr-ca", `{"subject":"Salut","text":"Bonjour"}`)
+	require.Equal(t, 201, resp.StatusCode, "response status code does not match")
+	resp, _ = do(http.MethodGet, "/api/templates/welcome.fr-CA", "")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+
+	resp, body = do(http.MethodGet, "/api/templates/welcome/2", "")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.Contains(t, body, "There", "version does not match")
+
+	resp, body = do(http.MethodGet, "/api/templates/welcome/diff?from=1&to=2", "")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.Equal(t, "--- a/body.txt\n+++ b/body.txt\n Hello\n-World\n+There\n", body, "diff does not match")
+
+	var h smtp.TemplateHistory
+	resp, body = do(http.MethodPost, "/api/templates/welcome/publish", `{"version":2}`)
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.NoError(t, json.Unmarshal([]byte(body), &h), "failed to decode history")
+	require.Equal(t, 2, h.Active, "version not published")
+	require.Len(t, h.Versions, 2, "versions length does not match")
+
+	resp, body = do(http.MethodPost, "/api/templates/welcome/rollback", "")
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.NoError(t, json.Unmarshal([]byte(body), &h), "failed to decode history")
+	require.Equal(t, 1, h.Active, "version not rolled back")
+
+	resp, _ = do(http.MethodPost, "/api/templates/welcome/rollback", "")
+	require.Equal(t, 409, resp.StatusCode, "rolled back too far")
+
+	resp, _ = do(http.MethodGet, "/api/templates/missing", "")
+	require.Equal(t, 404, resp.StatusCode, "missing template found")
+	resp, _ = do(http.MethodPost, "/api/templates/welcome/publish", `{"version":9}`)
+	require.Equal(t, 404, resp.StatusCode, "missing version published")
+}
+
+func TestTemplatePreview(t *testing.T) {
+	store := smtp.NewMemoryTemplates()
+	_, err := store.Put(context.Background(), "welcome", &smtp.TemplateFiles{Subject: "Hi {{.FirstName}}", HTML: "<p>You are on {{.Data.plan}}</p>"})
+	require.NoError(t, err, "failed to save template")
+	_, err = store.Put(context.Background(), "welcome", &smtp.TemplateFiles{Subject: "Hi {{.FirstName}}", HTML: "<p>You are on {{.Data.plam}}</p>"})
+	require.NoError(t, err, "failed to save template")
+
+	p := &fakeProducer{}
+	tmpls := smtpHTTP.NewTemplates(store, "secret")
+	tmpls.Producer = p
+	tmpls.TestTo = []smtp.Address{{Address: "qa@example.com"}, {Address: "design@example.com"}}
+	srv := httptest.NewServer(http.StripPrefix("/api/templates", tmpls))
+	t.Cleanup(func() { srv.Close() })
+
+	post := func(path, body string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err, "failed to create request")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err, "failed to make post request")
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "failed to read body")
+		return resp, string(b)
+	}
+
+	var pv struct {
+		Version             int
+		Subject, HTML, Text string
+		MIME                string
+	}
+	resp, body := post("/api/templates/welcome/preview", `{"version":1,"recipient":{"firstName":"Ada"},"data":{"plan":"pro"}}`)
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.NoError(t, json.Unmarshal([]byte(body), &pv), "failed to decode preview")
+	require.Equal(t, "Hi Ada", pv.Subject, "subject does not match")
+	require.Equal(t, "<p>You are on pro</p>", pv.HTML, "html does not match")
+	require.Equal(t, "You are on pro\n", pv.Text, "text does not match")
+	require.Contains(t, pv.MIME, "Content-Type: multipart/alternative", "mime does not match")
+
+	// the latest version has a broken merge field
+	resp, body = post("/api/templates/welcome/preview", `{"recipient":{"firstName":"Ada"},"data":{"plan":"pro"}}`)
+	require.Equal(t, 400, resp.StatusCode, "broken template previewed")
+	require.Contains(t, body, "plam", "error does not match")
+	resp, _ = post("/api/templates/welcome/test", `{"data":{"plan":"pro"}}`)
+	require.Equal(t, 400, resp.StatusCode, "broken template sent")
+	require.Empty(t, p.published, "broken template queued")
+
+	// the version is sent whatever the locale, so it isn't the recipient's
+	resp, body = post("/api/templates/welcome/test", `{"version":1,"recipient":{"firstName":"Ada","locale":"fr"},"data":{"plan":"pro"}}`)
+	require.Equal(t, 400, resp.StatusCode, "tested with the recipient's locale")
+	require.Contains(t, body, "welcome.fr", "error does not match")
+
+	resp, _ = post("/api/templates/welcome/test", `{"version":1,"recipient":{"firstName":"Ada"},"data":{"plan":"pro"}}`)
+	require.Equal(t, 202, resp.StatusCode, "response status code does not match")
+	require.Len(t, p.published, 1, "test not queued")
+	e := p.published[0].(*smtp.Email)
+	require.True(t, e.Test, "not marked as a test")
+	require.Equal(t, 1, e.TemplateVersion, "version does not match")
+	require.Len(t, e.Recipients, 2, "recipients do not match")
+	require.Equal(t, "design@example.com", e.Recipients[1].Address.Address, "recipient does not match")
+	require.Equal(t, "Ada", e.Recipients[1].FirstName, "merge fields do not match")
+
+	resp, _ = post("/api/templates/welcome/test", `{"version":1,"data":{"plan":"pro"}}`)
+	require.Equal(t, 429, resp.StatusCode, "tested again straight away")
+	require.Equal(t, "60", resp.Header.Get("Retry-After"), "retry after does not match")
+	require.Len(t, p.published, 1, "test queued again")
+
+	resp, _ = post("/api/templates/missing/preview", "")
+	require.Equal(t, 404, resp.StatusCode, "missing template previewed")
+}
+
+// reservedTemplates has a version reserved that isn't saved yet.
+type reservedTemplates struct{ smtp.TemplateStore }
+
+func (s reservedTemplates) History(ctx context.Context, name string) (*smtp.TemplateHistory, error) {
+	h, err := s.TemplateStore.History(ctx, name)
+	if err == nil {
+		h.Reserve()
+	}
+	return h, err
+}
+
+func TestTemplatePreviewReserved(t *testing.T) {
+	store := smtp.NewMemoryTemplates()
+	_, err := store.Put(context.Background(), "welcome", &smtp.TemplateFiles{Subject: "Hi", Text: "Hello"})
+	require.NoError(t, err, "failed to save template")
+
+	srv := httptest.NewServer(http.StripPrefix("/api/templates", smtpHTTP.NewTemplates(reservedTemplates{store}, "secret")))
+	t.Cleanup(func() { srv.Close() })
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/templates/welcome/preview", nil)
+	require.NoError(t, err, "failed to create request")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err, "failed to make post request")
+	defer resp.Body.Close()
+
+	// the latest saved version, not the one being saved
+	var pv struct{ Version int }
+	require.Equal(t, 200, resp.StatusCode, "response status code does not match")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&pv), "failed to decode preview")
+	require.Equal(t, 1, pv.Version, "version does not match")
+}
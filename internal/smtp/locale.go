@@ -0,0 +1,205 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// Locales are BCP 47 language tags, such as "fr-CA". Whatever is
+// looked up for a locale falls back to less specific ones, so for
+// fr-CA it is fr-CA, then fr, then the default, which is "".
+
+// Locales returns the locales to look in for the locale, most
+// specific first and ending with the default.
+func Locales(locale string) []string {
+	tag, err := language.Parse(locale)
+	if locale == "" || err != nil {
+		return []string{""}
+	}
+
+	// extensions, such as -u-ca-buddhist, aren't for looking up
+	base, script, region := tag.Raw()
+	tag, _ = language.Compose(base, script, region)
+
+	var locales []string
+	for s := tag.String(); ; s = s[:strings.LastIndex(s, "-")] {
+		locales = append(locales, s)
+		if !strings.Contains(s, "-") {
+			break
+		}
+	}
+	return append(locales, "")
+}
+
+// Catalog has the messages shared between templates, such as the
+// sign-off or the footer, in each locale. The messages are formats
+// for fmt, with the numbers in them formatted for the locale.
+type Catalog struct {
+	messages map[string]map[string]string
+}
+
+// NewCatalog returns a Catalog of the messages for each locale,
+// with the default ones under "".
+func NewCatalog(messages map[string]map[string]string) *Catalog {
+	c := &Catalog{messages: make(map[string]map[string]string, len(messages))}
+	for locale, m := range messages {
+		if tag, err := language.Parse(locale); err == nil && locale != "" {
+			locale = tag.String()
+		}
+		c.messages[locale] = m
+	}
+	return c
+}
+
+// LoadCatalog loads a Catalog from a JSON file of messages for each
+// locale, such as fr-CA.json, with the default ones in default.json.
+func LoadCatalog(fsys fs.FS) (*Catalog, error) {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, fmt.Errorf("fs.Glob: %w", err)
+	}
+
+	messages := make(map[string]map[string]string, len(files))
+	for _, file := range files {
+		locale := strings.TrimSuffix(file, path.Ext(file))
+		if locale == "default" {
+			locale = ""
+		} else if _, err := language.Parse(locale); err != nil {
+			return nil, fmt.Errorf("smtp.LoadCatalog: %s isn't named after a locale", file)
+		}
+
+		p, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("fs.ReadFile: %w", err)
+		}
+		var m map[string]string
+		if err := json.Unmarshal(p, &m); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %s: %w", file, err)
+		}
+		messages[locale] = m
+	}
+	return NewCatalog(messages), nil
+}
+
+// Message formats the message with the key in the locale, or the
+// closest one to it that has the message.
+func (c *Catalog) Message(locale, key string, args ...any) (string, error) {
+	for _, l := range Locales(locale) {
+		if s, ok := c.messages[l][key]; ok {
+			return printer(locale).Sprintf(s, args...), nil
+		}
+	}
+	return "", fmt.Errorf("smtp.Catalog: no message %q", key)
+}
+
+func printer(locale string) *message.Printer {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.Und
+	}
+	return message.NewPrinter(tag)
+}
+
+// dateLayouts are how dates are written in each locale.
+var dateLayouts = map[string]string{
+	"":      "2006-01-02",
+	"da":    "02.01.2006",
+	"de":    "02.01.2006",
+	"en":    "1/2/2006",
+	"en-AU": "02/01/2006",
+	"en-CA": "2006-01-02",
+	"en-GB": "02/01/2006",
+	"en-IE": "02/01/2006",
+	"en-IN": "02/01/2006",
+	"en-NZ": "02/01/2006",
+	"es":    "2/1/2006",
+	"fr":    "02/01/2006",
+	"fr-CA": "2006-01-02",
+	"fr-CH": "02.01.2006",
+	"it":    "2/1/2006",
+	"ja":    "2006/01/02",
+	"ko":    "2006. 1. 2.",
+	"nb":    "02.01.2006",
+	"nl":    "2-1-2006",
+	"pl":    "2.01.2006",
+	"pt":    "02/01/2006",
+	"ru":    "02.01.2006",
+	"sv":    "2006-01-02",
+	"zh":    "2006/1/2",
+}
+
+// formatDate writes the date for the locale. Dates in data from
+// JSON are strings, so RFC 3339 times and plain dates are parsed.
+func formatDate(locale string, v any) (string, error) {
+	var t time.Time
+	switch v := v.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		t = *v
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339, v); err != nil {
+			if t, err = time.Parse("2006-01-02", v); err != nil {
+				return "", fmt.Errorf("smtp.Date: %q isn't a date", v)
+			}
+		}
+	default:
+		return "", fmt.Errorf("smtp.Date: %T isn't a date", v)
+	}
+
+	for _, l := range Locales(locale) {
+		if layout, ok := dateLayouts[l]; ok {
+			return t.Format(layout), nil
+		}
+	}
+	return t.Format(dateLayouts[""]), nil
+}
+
+// formatNumber writes the number for the locale, grouping its
+// digits and with the decimal separator the locale uses.
+func formatNumber(locale string, v any) (string, error) {
+	switch n := v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return "", fmt.Errorf("smtp.Number: %q isn't a number", n)
+		}
+		v = f
+	default:
+		return "", fmt.Errorf("smtp.Number: %T isn't a number", v)
+	}
+	return printer(locale).Sprint(number.Decimal(v)), nil
+}
+
+// Message is the message with the key in the recipient's locale from
+// the Catalog, such as {{.Message "footer"}}, formatted with the args.
+func (d *TemplateData) Message(key string, args ...any) (string, error) {
+	if d.Catalog == nil {
+		return "", errors.New("smtp.Message: there is no catalog")
+	}
+	return d.Catalog.Message(d.Locale, key, args...)
+}
+
+// Date is the date as it is written in the recipient's locale,
+// such as {{.Date .Data.renews}}.
+func (d *TemplateData) Date(v any) (string, error) {
+	return formatDate(d.Locale, v)
+}
+
+// Number is the number as it is written in the recipient's locale,
+// such as {{.Number .Data.total}}.
+func (d *TemplateData) Number(v any) (string, error) {
+	return formatNumber(d.Locale, v)
+}
@@ -0,0 +1,78 @@
+package smtp_test
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestLocales(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(smtp.Locales("fr-ca"), []string{"fr-CA", "fr", ""})
+	is.Equal(smtp.Locales("zh-Hant-TW-u-ca-chinese"), []string{"zh-Hant-TW", "zh-Hant", "zh", ""})
+	is.Equal(smtp.Locales(""), []string{""})
+	is.Equal(smtp.Locales("not a locale"), []string{""})
+}
+
+func TestCatalog(t *testing.T) {
+	is := is.New(t)
+
+	c, err := smtp.LoadCatalog(fstest.MapFS{
+		"default.json": {Data: []byte(`{"thanks":"Thanks","items":"%d items"}`)},
+		"fr.json":      {Data: []byte(`{"thanks":"Merci"}`)},
+		"fr-CA.json":   {Data: []byte(`{"thanks":"Merci bien"}`)},
+	})
+	is.NoErr(err) // load catalog
+
+	for locale, want := range map[string]string{"fr-CA": "Merci bien", "fr-BE": "Merci", "de": "Thanks", "": "Thanks"} {
+		s, err := c.Message(locale, "thanks")
+		is.NoErr(err) // message
+		is.Equal(s, want)
+	}
+
+	// numbers in messages are for the locale too
+	s, err := c.Message("fr", "items", 1234)
+	is.NoErr(err) // message
+	is.Equal(s, "1\u00a0234 items")
+
+	_, err = c.Message("fr", "missing")
+	is.True(err != nil) // no message
+}
+
+func TestTemplateDataLocale(t *testing.T) {
+	is := is.New(t)
+
+	when := time.Date(2023, time.March, 4, 0, 0, 0, 0, time.UTC)
+	for locale, want := range map[string][2]string{
+		"en-US": {"3/4/2023", "1,234.5"},
+		"en-GB": {"04/03/2023", "1,234.5"},
+		"de-DE": {"04.03.2023", "1.234,5"},
+		"fr-CA": {"2023-03-04", "1\u00a0234,5"},
+		"":      {"2023-03-04", "1,234.5"},
+	} {
+		d := &smtp.TemplateData{Recipient: smtp.Recipient{Locale: locale}}
+
+		date, err := d.Date(when)
+		is.NoErr(err) // date
+		is.Equal(date, want[0])
+
+		// json data is strings and float64s
+		date, err = d.Date("2023-03-04")
+		is.NoErr(err) // date from a string
+		is.Equal(date, want[0])
+
+		n, err := d.Number(1234.5)
+		is.NoErr(err) // number
+		is.Equal(n, want[1])
+	}
+
+	d := &smtp.TemplateData{}
+	_, err := d.Date("soon")
+	is.True(err != nil) // not a date
+	_, err = d.Message("thanks")
+	is.True(err != nil) // no catalog
+}
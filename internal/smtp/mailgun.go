@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+)
+
+const (
+	// MailgunEndpoint is the base URL of Mailgun's US API.
+	MailgunEndpoint = "https://api.mailgun.net"
+	// MailgunEUEndpoint is the base URL of Mailgun's EU API.
+	MailgunEUEndpoint = "https://api.eu.mailgun.net"
+)
+
+var _ Sender = (*Mailgun)(nil)
+
+// Mailgun sends through Mailgun's messages API.
+type Mailgun struct {
+	api    *apiClient
+	key    string
+	domain string
+	from   string
+}
+
+// NewMailgun returns a Sender for the Config's APIKey and Domain.
+// A Region of "eu" sends through the EU API.
+func NewMailgun(cfg *Config) *Mailgun {
+	endpoint := MailgunEndpoint
+	if cfg.Region == "eu" {
+		endpoint = MailgunEUEndpoint
+	}
+	return &Mailgun{newAPIClient("mailgun", cfg, endpoint), cfg.APIKey, cfg.Domain, cfg.From}
+}
+
+func (mg *Mailgun) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, err := withDefaults(m, mg.from)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fields := []struct {
+		key    string
+		values []string
+	}{
+		{"from", []string{formatAddress(m.From)}},
+		{"to", addressStrings(apiTo(m))},
+		{"cc", addressStrings(m.Cc)},
+		{"bcc", addressStrings(m.Bcc)},
+		{"subject", []string{m.Subject}},
+		{"text", []string{m.Text}},
+		{"html", []string{m.HTML}},
+	}
+	if len(m.ReplyTo) > 0 {
+		fields = append(fields, struct {
+			key    string
+			values []string
+		}{"h:Reply-To", addressStrings(m.ReplyTo)})
+	}
+
+	header := flattenHeader(m)
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, struct {
+			key    string
+			values []string
+		}{"h:" + k, []string{header[k]}})
+	}
+
+	for _, f := range fields {
+		for _, v := range f.values {
+			if v == "" {
+				continue
+			}
+			if err := mw.WriteField(f.key, v); err != nil {
+				return nil, fmt.Errorf("mw.WriteField: %w", err)
+			}
+		}
+	}
+
+	for _, a := range m.Attachments {
+		// inline files are referenced by their filename, so the
+		// ContentID is used as the name
+		key, filename := "attachment", a.Filename
+		if a.ContentID != "" {
+			key, filename = "inline", a.ContentID
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, key, filename))
+		h.Set("Content-Type", attachmentEntity(a).header.Get("Content-Type"))
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, fmt.Errorf("mw.CreatePart: %w", err)
+		}
+		if _, err := w.Write(a.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("mw.Close: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, mg.api.endpoint+"/v3/"+url.PathEscape(mg.domain)+"/messages", &buf)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Accept", "application/json")
+	r.SetBasicAuth("api", mg.key)
+
+	var res struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	resp, err := mg.api.do(r, &res, mailgunError)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{MessageID: m.MessageID, QueueID: res.ID, Code: 250, Response: resp.Status + " " + res.Message}, nil
+}
+
+func mailgunError(p []byte) string {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(p, &body) != nil {
+		return string(bytes.TrimSpace(p))
+	}
+	return body.Message
+}
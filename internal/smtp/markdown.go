@@ -0,0 +1,218 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strconv"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+var (
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	// sanitiser keeps the html to what Markdown produces, so nothing
+	// written in it can run. Images are still loaded from wherever
+	// their src is, like any other in an email.
+	sanitiser = bluemonday.UGCPolicy()
+)
+
+// RenderMarkdown renders the Markdown to a sanitised HTML body and
+// a plain text one that reads like the Markdown without its markup.
+func RenderMarkdown(src string) (html, plain string, err error) {
+	source := []byte(src)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, source, doc); err != nil {
+		return "", "", fmt.Errorf("goldmark.Render: %w", err)
+	}
+
+	var tw textWriter
+	tw.blocks(doc, source)
+	return sanitiser.Sanitize(buf.String()), tw.String(), nil
+}
+
+// textWriter writes the blocks of a Markdown document as plain text,
+// with a blank line between them.
+type textWriter struct {
+	strings.Builder
+	// prefix starts each line, for quotes and list items.
+	prefix string
+	// marker replaces the end of the prefix on the next
+	// line, for the bullet or number of a list item.
+	marker string
+}
+
+func (w *textWriter) blocks(n ast.Node, source []byte) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if c.PreviousSibling() != nil {
+			w.line("")
+		}
+		w.block(c, source)
+	}
+}
+
+func (w *textWriter) block(n ast.Node, source []byte) {
+	switch n := n.(type) {
+	case *ast.Heading:
+		s := inlineText(n, source)
+		w.line(s)
+		// the top headings are underlined, as is usual in plain text
+		switch n.Level {
+		case 1:
+			w.line(strings.Repeat("=", len([]rune(s))))
+		case 2:
+			w.line(strings.Repeat("-", len([]rune(s))))
+		}
+	case *ast.Paragraph, *ast.TextBlock:
+		for _, l := range strings.Split(inlineText(n, source), "\n") {
+			w.line(l)
+		}
+	case *ast.ThematicBreak:
+		w.line("----")
+	case *ast.CodeBlock, *ast.FencedCodeBlock:
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			seg := lines.At(i)
+			w.line("    " + strings.TrimRight(string(seg.Value(source)), "\n"))
+		}
+	case *ast.Blockquote:
+		prefix := w.prefix
+		w.prefix += "> "
+		w.blocks(n, source)
+		w.prefix = prefix
+	case *ast.List:
+		w.list(n, source)
+	case *extast.Table:
+		for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+			var cells []string
+			for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+				cells = append(cells, inlineText(cell, source))
+			}
+			w.line(strings.Join(cells, " | "))
+		}
+	case *ast.HTMLBlock:
+		// raw html isn't rendered, so it isn't in the text either
+	default:
+		w.blocks(n, source)
+	}
+}
+
+// list writes each item after its bullet or number, with the lines
+// after the first lined up with it.
+func (w *textWriter) list(l *ast.List, source []byte) {
+	prefix := w.prefix
+	i := l.Start
+	for item := l.FirstChild(); item != nil; item = item.NextSibling() {
+		w.marker = "- "
+		if l.IsOrdered() {
+			w.marker = strconv.Itoa(i) + ". "
+			i++
+		}
+		w.prefix = prefix + strings.Repeat(" ", len(w.marker))
+
+		for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+			if c != item.FirstChild() && !l.IsTight {
+				w.line("")
+			}
+			w.block(c, source)
+		}
+		if item.NextSibling() != nil && !l.IsTight {
+			w.line("")
+		}
+	}
+	w.prefix, w.marker = prefix, ""
+}
+
+func (w *textWriter) line(s string) {
+	p := w.prefix
+	if w.marker != "" {
+		p, w.marker = p[:len(p)-len(w.marker)]+w.marker, ""
+	}
+	if s == "" {
+		p = strings.TrimRight(p, " ")
+	}
+	w.WriteString(p + s + "\n")
+}
+
+// inlineText is the text of the inline nodes, with links
+// followed by where they go.
+func inlineText(n ast.Node, source []byte) string {
+	var sb strings.Builder
+	var walk func(n ast.Node)
+	walk = func(n ast.Node) {
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			switch c := c.(type) {
+			case *ast.Text:
+				sb.Write(c.Segment.Value(source))
+				if c.SoftLineBreak() || c.HardLineBreak() {
+					sb.WriteByte('\n')
+				}
+			case *ast.String:
+				sb.Write(c.Value)
+			case *ast.AutoLink:
+				sb.Write(c.URL(source))
+			case *ast.Link:
+				label := inlineText(c, source)
+				sb.WriteString(label)
+				// only where it goes on the web is worth showing
+				if dest := string(c.Destination); dest != label && (strings.HasPrefix(dest, "https://") || strings.HasPrefix(dest, "http://")) {
+					sb.WriteString(" (" + dest + ")")
+				}
+			case *ast.Image:
+				sb.WriteString(inlineText(c, source))
+			case *ast.RawHTML:
+			case *extast.TaskCheckBox:
+				if c.IsChecked {
+					sb.WriteString("[x] ")
+				} else {
+					sb.WriteString("[ ] ")
+				}
+			default:
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// Layout wraps HTML bodies in a page, with a header and a footer.
+type Layout struct {
+	t *htmltemplate.Template
+}
+
+// LayoutData is what a layout is executed with. A layout has
+// to show the Body, as {{.Body}}, which is already escaped.
+type LayoutData struct {
+	Subject string
+	Body    htmltemplate.HTML
+}
+
+// ParseLayout parses the layout, an html/template.
+func ParseLayout(s string) (*Layout, error) {
+	t, err := htmltemplate.New("layout").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("template.Parse: %w", err)
+	}
+	if !strings.Contains(s, ".Body") {
+		return nil, fmt.Errorf("smtp.ParseLayout: layout doesn't show .Body")
+	}
+	return &Layout{t}, nil
+}
+
+// Wrap returns the body inside the layout.
+func (l *Layout) Wrap(subject, body string) (string, error) {
+	var buf bytes.Buffer
+	if err := l.t.Execute(&buf, &LayoutData{subject, htmltemplate.HTML(body)}); err != nil {
+		return "", fmt.Errorf("template.Execute: %w", err)
+	}
+	return buf.String(), nil
+}
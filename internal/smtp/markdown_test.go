@@ -0,0 +1,54 @@
+package smtp_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	t.Run("html", func(t *testing.T) {
+		is := is.New(t)
+
+		html, _, err := smtp.RenderMarkdown("# Hi\n\nRead **this** [here](https://example.com).\n\n<script>alert(1)</script>\n\n[bad](javascript:alert(1)) <img src=x onerror=alert(1)>\n")
+		is.NoErr(err) // render markdown
+		is.True(strings.Contains(html, "<h1>Hi</h1>"))
+		is.True(strings.Contains(html, "<strong>this</strong>"))
+		is.True(strings.Contains(html, `href="https://example.com"`))
+		is.True(!strings.Contains(html, "<script"))     // raw html dropped
+		is.True(!strings.Contains(html, "javascript:")) // unsafe links dropped
+		is.True(!strings.Contains(html, "onerror"))     // handlers dropped
+	})
+
+	t.Run("text", func(t *testing.T) {
+		is := is.New(t)
+
+		src := "# Welcome\n\nRead **this** [here](https://example.com).\n\n- one\n- two\n  - nested\n\n1. first\n2. second\n\n> quoted\n\n```\ncode\n```\n"
+		want := "Welcome\n=======\n\n" +
+			"Read this here (https://example.com).\n\n" +
+			"- one\n- two\n  - nested\n\n" +
+			"1. first\n2. second\n\n" +
+			"> quoted\n\n" +
+			"    code\n"
+
+		_, text, err := smtp.RenderMarkdown(src)
+		is.NoErr(err) // render markdown
+		is.Equal(text, want)
+	})
+}
+
+func TestLayout(t *testing.T) {
+	is := is.New(t)
+
+	l, err := smtp.ParseLayout(`<html><head><title>{{.Subject}}</title></head><body><header>News</header>{{.Body}}<footer>Bye</footer></body></html>`)
+	is.NoErr(err) // parse layout
+
+	html, err := l.Wrap("Hi & bye", "<p>Hello</p>")
+	is.NoErr(err) // wrap body
+	is.Equal(html, `<html><head><title>Hi &amp; bye</title></head><body><header>News</header><p>Hello</p><footer>Bye</footer></body></html>`)
+
+	_, err = smtp.ParseLayout(`<p>no body</p>`)
+	is.True(err != nil) // layout must show the body
+}
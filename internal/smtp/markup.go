@@ -0,0 +1,520 @@
+package smtp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Markup is a small language for responsive email layouts, in the
+// spirit of MJML, that compiles to the nested tables and inline styles
+// mail clients all render alike:
+//
+//	<email background-color="#f4f4f4">
+//	  <section background-color="#ffffff">
+//	    <column width="30%">
+//	      <image src="https://example.com/logo.png" alt="Example" width="120"/>
+//	    </column>
+//	    <column>
+//	      <text font-size="20px">Hi {{.FirstName}}</text>
+//	      <button href="https://example.com/start">Get started</button>
+//	      <divider/>
+//	    </column>
+//	  </section>
+//	</email>
+//
+// Columns without a width share what the others leave, and stack on
+// small screens. What is in a <text> or <button> is HTML, and template
+// actions can go in it, in attribute values, or between elements.
+
+// MarkupError is a mistake in the markup, on the line it was made.
+type MarkupError struct {
+	Line int
+	Msg  string
+}
+
+func (e *MarkupError) Error() string { return "line " + strconv.Itoa(e.Line) + ": " + e.Msg }
+
+// markupValue is what an attribute's value has to look like.
+type markupValue struct {
+	re   *regexp.Regexp
+	want string
+}
+
+var (
+	colorValue   = &markupValue{regexp.MustCompile(`^(#[0-9A-Fa-f]{3}|#[0-9A-Fa-f]{6}|[A-Za-z]+|rgba?\([0-9., %]+\))$`), "a color, like #ff0000"}
+	lengthValue  = &markupValue{regexp.MustCompile(`^\d+(\.\d+)?(px|em|%)?(\s+\d+(\.\d+)?(px|em|%)?){0,3}$`), "a length, like 10px or 10px 25px"}
+	alignValue   = &markupValue{regexp.MustCompile(`^(left|center|right)$`), "left, center or right"}
+	pixelsValue  = &markupValue{regexp.MustCompile(`^\d+(px)?$`), "a width in pixels, like 600"}
+	percentValue = &markupValue{regexp.MustCompile(`^\d+(\.\d+)?%$`), "a width in percent, like 50%"}
+	fontValue    = &markupValue{regexp.MustCompile(`^[\w\s,'"-]+$`), "a list of fonts"}
+)
+
+// markupAttr is an attribute an element can have, with its default.
+type markupAttr struct {
+	def   string
+	value *markupValue
+}
+
+type markupElement struct {
+	attrs    map[string]markupAttr
+	required []string
+	// children are the elements that can be in it, and content is
+	// set for those with HTML in them instead.
+	children []string
+	content  bool
+}
+
+var markupElements = map[string]*markupElement{
+	"email": {
+		attrs: map[string]markupAttr{
+			"width":            {"600", pixelsValue},
+			"background-color": {"", colorValue},
+			"color":            {"#000000", colorValue},
+			"font-family":      {"Helvetica, Arial, sans-serif", fontValue},
+		},
+		children: []string{"section"},
+	},
+	"section": {
+		attrs: map[string]markupAttr{
+			"background-color": {"", colorValue},
+			"padding":          {"20px 0", lengthValue},
+		},
+		children: []string{"column"},
+	},
+	"column": {
+		attrs: map[string]markupAttr{
+			"width":            {"", percentValue},
+			"background-color": {"", colorValue},
+			"padding":          {"0", lengthValue},
+		},
+		children: []string{"text", "button", "image", "divider"},
+	},
+	"text": {
+		attrs: map[string]markupAttr{
+			"align":       {"left", alignValue},
+			"color":       {"", colorValue},
+			"font-family": {"", fontValue},
+			"font-size":   {"14px", lengthValue},
+			"line-height": {"1.5", lengthValue},
+			"padding":     {"10px 25px", lengthValue},
+		},
+		content: true,
+	},
+	"button": {
+		attrs: map[string]markupAttr{
+			"href":             {"", nil},
+			"align":            {"center", alignValue},
+			"background-color": {"#414141", colorValue},
+			"color":            {"#ffffff", colorValue},
+			"font-family":      {"", fontValue},
+			"font-size":        {"14px", lengthValue},
+			"border-radius":    {"3px", lengthValue},
+			"inner-padding":    {"10px 25px", lengthValue},
+			"padding":          {"10px 25px", lengthValue},
+		},
+		required: []string{"href"},
+		content:  true,
+	},
+	"image": {
+		attrs: map[string]markupAttr{
+			"src":     {"", nil},
+			"alt":     {"", nil},
+			"href":    {"", nil},
+			"width":   {"", pixelsValue},
+			"align":   {"center", alignValue},
+			"padding": {"10px 25px", lengthValue},
+		},
+		required: []string{"src"},
+	},
+	"divider": {
+		attrs: map[string]markupAttr{
+			"border-color": {"#cccccc", colorValue},
+			"border-width": {"1px", lengthValue},
+			"padding":      {"10px 25px", lengthValue},
+		},
+	},
+}
+
+// markupNode is an element, or the template actions between elements
+// when it has no name.
+type markupNode struct {
+	name     string
+	line     int
+	attrs    map[string]string
+	children []*markupNode
+	html     string
+}
+
+// CompileMarkup compiles the markup to an HTML document, leaving the
+// template actions in it as they are. Every mistake found is returned,
+// as MarkupErrors joined together.
+func CompileMarkup(src string) (string, error) {
+	root, err := parseMarkup(src)
+	if err != nil {
+		return "", err
+	}
+
+	var w markupWriter
+	w.email(root)
+	return w.String(), nil
+}
+
+var (
+	// actions are the template actions, which can be anywhere.
+	actions = regexp.MustCompile(`(?s){{.*?}}`)
+	// contentTag is the start of an element with HTML in it, or a
+	// comment or CDATA section, which the decoder skips over too.
+	contentTag = regexp.MustCompile(`(?s:<!--.*?-->|<!\[CDATA\[.*?\]\]>)|<(text|button)(\s[^>]*|/)?>`)
+	charRef    = regexp.MustCompile(`^&([A-Za-z][A-Za-z0-9]*|#[0-9]+|#x[0-9A-Fa-f]+);`)
+)
+
+// markupContents takes the HTML out of the <text> and <button> elements,
+// which needn't be XML, leaving the lines it was on so the lines of the
+// rest are the same. A lone & is escaped, as it would be in HTML.
+func markupContents(src string) (string, []string) {
+	var sb strings.Builder
+	var contents []string
+	last := 0
+	for _, m := range contentTag.FindAllStringSubmatchIndex(src, -1) {
+		if m[0] < last || m[2] < 0 {
+			continue
+		}
+		if strings.HasSuffix(src[m[0]:m[1]], "/>") {
+			contents = append(contents, "")
+			continue
+		}
+		end := strings.Index(src[m[1]:], "</"+src[m[2]:m[3]]+">")
+		if end < 0 {
+			// the decoder says where it isn't closed
+			break
+		}
+		content := src[m[1] : m[1]+end]
+		contents = append(contents, strings.TrimSpace(content))
+		sb.WriteString(src[last:m[1]])
+		sb.WriteString(strings.Repeat("\n", strings.Count(content, "\n")))
+		last = m[1] + end
+	}
+	sb.WriteString(src[last:])
+
+	s := sb.String()
+	sb.Reset()
+	for i := 0; i < len(s); i++ {
+		if s[i] == '&' && !charRef.MatchString(s[i:]) {
+			sb.WriteString("&amp;")
+			continue
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String(), contents
+}
+
+func parseMarkup(src string) (*markupNode, error) {
+	src, contents := markupContents(src)
+
+	d := xml.NewDecoder(strings.NewReader(src))
+	d.Entity = xml.HTMLEntity
+
+	var errs []error
+	fail := func(line int, format string, a ...any) {
+		errs = append(errs, &MarkupError{line, fmt.Sprintf(format, a...)})
+	}
+
+	var root *markupNode
+	var stack []*markupNode
+	for {
+		// before the token is read, this is where it starts
+		line, _ := d.InputPos()
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var serr *xml.SyntaxError
+		if errors.As(err, &serr) {
+			fail(serr.Line, "%s", serr.Msg)
+			return nil, errors.Join(errs...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xml.Token: %w", err)
+		}
+
+		var parent *markupNode
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			n := &markupNode{name: tok.Name.Local, line: line, attrs: make(map[string]string)}
+			el, ok := markupElements[n.name]
+			switch {
+			case !ok:
+				fail(line, "there is no <%s>", n.name)
+			case parent == nil && n.name != "email":
+				fail(line, "<email> has to be around everything, not <%s>", n.name)
+			case parent != nil && !canContain(parent.name, n.name):
+				fail(line, "<%s> can't be in <%s>", n.name, parent.name)
+			}
+			if ok {
+				markupAttrs(el, n, tok.Attr, fail)
+				if el.content && len(contents) > 0 {
+					n.html, contents = contents[0], contents[1:]
+				}
+			}
+
+			switch {
+			case parent != nil:
+				parent.children = append(parent.children, n)
+			case root == nil:
+				root = n
+			default:
+				fail(line, "there can only be one <email>")
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			if parent.name == "section" {
+				sectionWidths(parent, fail)
+			}
+		case xml.CharData:
+			s := strings.TrimSpace(string(tok))
+			if s == "" {
+				continue
+			}
+			// the text starts after the white space before it
+			line += strings.Count(string(tok)[:strings.Index(string(tok), s)], "\n")
+			if parent == nil || strings.TrimSpace(actions.ReplaceAllString(s, "")) != "" {
+				fail(line, "text has to be in a <text> or <button>")
+				continue
+			}
+			parent.children = append(parent.children, &markupNode{line: line, html: s})
+		}
+	}
+
+	if root == nil && len(errs) == 0 {
+		fail(1, "there is no <email>")
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return root, nil
+}
+
+func canContain(parent, child string) bool {
+	el, ok := markupElements[parent]
+	if !ok {
+		// its own mistake is enough
+		return true
+	}
+	for _, c := range el.children {
+		if c == child {
+			return true
+		}
+	}
+	return false
+}
+
+// markupAttrs checks the element's attributes, filling in the defaults.
+func markupAttrs(el *markupElement, n *markupNode, attrs []xml.Attr, fail func(int, string, ...any)) {
+	for name, a := range el.attrs {
+		n.attrs[name] = a.def
+	}
+	for _, a := range attrs {
+		name := a.Name.Local
+		spec, ok := el.attrs[name]
+		if !ok || a.Name.Space != "" {
+			fail(n.line, "<%s> has no %s attribute", n.name, name)
+			continue
+		}
+		// widths are worked out with, so can't come from the data
+		templated := strings.Contains(a.Value, "{{") && spec.value != pixelsValue && spec.value != percentValue
+		if spec.value != nil && !templated && !spec.value.re.MatchString(a.Value) {
+			fail(n.line, "%s of <%s> is %q, not %s", name, n.name, a.Value, spec.value.want)
+			continue
+		}
+		n.attrs[name] = a.Value
+	}
+	for _, name := range el.required {
+		if n.attrs[name] == "" {
+			fail(n.line, "<%s> needs a %s", n.name, name)
+		}
+	}
+}
+
+// sectionWidths shares what the columns with a width leave between
+// those without one.
+func sectionWidths(section *markupNode, fail func(int, string, ...any)) {
+	var columns []*markupNode
+	total := 0.0
+	for _, c := range section.children {
+		if c.name != "column" {
+			continue
+		}
+		columns = append(columns, c)
+		if w := c.attrs["width"]; w != "" {
+			f, _ := strconv.ParseFloat(strings.TrimSuffix(w, "%"), 64)
+			total += f
+		}
+	}
+
+	var rest []*markupNode
+	for _, c := range columns {
+		if c.attrs["width"] == "" {
+			rest = append(rest, c)
+		}
+	}
+	if total > 100 || (total >= 100 && len(rest) > 0) {
+		fail(section.line, "the widths of the columns add up to more than 100%%")
+		return
+	}
+	for _, c := range rest {
+		share := math.Floor((100-total)/float64(len(rest))*100) / 100
+		c.attrs["width"] = strconv.FormatFloat(share, 'f', -1, 64) + "%"
+	}
+}
+
+// markupWriter writes the compiled markup. Tables are used for
+// layout, as that is what mail clients render alike.
+type markupWriter struct {
+	strings.Builder
+	// font and color are the email's, for the elements with text
+	font, color string
+}
+
+const presentation = `role="presentation" cellpadding="0" cellspacing="0" border="0"`
+
+func (w *markupWriter) email(n *markupNode) {
+	w.font, w.color = n.attrs["font-family"], n.attrs["color"]
+	width := strings.TrimSuffix(n.attrs["width"], "px")
+	bg := n.attrs["background-color"]
+
+	w.WriteString(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style>
+@media only screen and (max-width: 480px) { .column { display: block !important; width: 100% !important; } }
+</style>
+</head>
+`)
+	w.WriteString(`<body style="` + styles("margin", "0", "padding", "0", "background-color", bg) + `">` + "\n")
+	w.WriteString(`<table ` + presentation + ` width="100%" style="` + styles("background-color", bg) + `"><tr><td align="center">` + "\n")
+	w.WriteString(`<table ` + presentation + ` width="` + width + `" style="` + styles("width", width+"px", "max-width", "100%", "font-family", w.font, "color", w.color) + `">` + "\n")
+	for _, c := range n.children {
+		w.section(c)
+	}
+	w.WriteString("</table>\n</td></tr></table>\n</body>\n</html>\n")
+}
+
+func (w *markupWriter) section(n *markupNode) {
+	if n.name == "" {
+		w.WriteString(n.html + "\n")
+		return
+	}
+	w.WriteString(`<tr><td style="` + styles("background-color", n.attrs["background-color"], "padding", n.attrs["padding"]) + `">` + "\n")
+	w.WriteString(`<table ` + presentation + ` width="100%"><tr>` + "\n")
+	for _, c := range n.children {
+		w.column(c)
+	}
+	w.WriteString("</tr></table>\n</td></tr>\n")
+}
+
+func (w *markupWriter) column(n *markupNode) {
+	if n.name == "" {
+		w.WriteString(n.html + "\n")
+		return
+	}
+	width := n.attrs["width"]
+	w.WriteString(`<td class="column" width="` + width + `" valign="top" style="` + styles("width", width, "background-color", n.attrs["background-color"], "padding", n.attrs["padding"]) + `">` + "\n")
+	for _, c := range n.children {
+		w.block(c)
+	}
+	w.WriteString("</td>\n")
+}
+
+func (w *markupWriter) block(n *markupNode) {
+	if n.name == "" {
+		w.WriteString(n.html + "\n")
+		return
+	}
+
+	a := n.attrs
+	font := or(a["font-family"], w.font)
+	w.WriteString(`<table ` + presentation + ` width="100%"><tr>`)
+	switch n.name {
+	case "text":
+		w.WriteString(`<td align="` + attrValue(a["align"]) + `" style="` + styles("padding", a["padding"], "font-family", font, "font-size", a["font-size"], "line-height", a["line-height"], "color", or(a["color"], w.color)) + `">`)
+		w.WriteString(n.html)
+		w.WriteString(`</td>`)
+	case "button":
+		bg := a["background-color"]
+		w.WriteString(`<td align="` + attrValue(a["align"]) + `" style="` + styles("padding", a["padding"]) + `">`)
+		w.WriteString(`<table ` + presentation + `><tr><td align="center" bgcolor="` + attrValue(bg) + `" style="` + styles("border-radius", a["border-radius"], "background-color", bg) + `">`)
+		w.WriteString(`<a href="` + attrValue(a["href"]) + `" target="_blank" style="` + styles("display", "inline-block", "padding", a["inner-padding"], "font-family", font, "font-size", a["font-size"], "color", a["color"], "text-decoration", "none", "border-radius", a["border-radius"]) + `">`)
+		w.WriteString(n.html)
+		w.WriteString(`</a></td></tr></table></td>`)
+	case "image":
+		w.WriteString(`<td align="` + attrValue(a["align"]) + `" style="` + styles("padding", a["padding"]) + `">`)
+		if a["href"] != "" {
+			w.WriteString(`<a href="` + attrValue(a["href"]) + `" target="_blank">`)
+		}
+		w.WriteString(`<img src="` + attrValue(a["src"]) + `" alt="` + attrValue(a["alt"]) + `"`)
+		margin := ""
+		if a["align"] == "center" {
+			margin = "0 auto"
+		}
+		if width := strings.TrimSuffix(a["width"], "px"); width != "" {
+			w.WriteString(` width="` + width + `" style="` + styles("display", "block", "border", "0", "margin", margin, "width", width+"px", "max-width", "100%", "height", "auto") + `">`)
+		} else {
+			w.WriteString(` style="` + styles("display", "block", "border", "0", "margin", margin, "max-width", "100%", "height", "auto") + `">`)
+		}
+		if a["href"] != "" {
+			w.WriteString(`</a>`)
+		}
+		w.WriteString(`</td>`)
+	case "divider":
+		w.WriteString(`<td style="` + styles("padding", a["padding"]) + `">`)
+		w.WriteString(`<p style="` + styles("border-top", a["border-width"]+" solid "+a["border-color"], "font-size", "1px", "line-height", "1px", "margin", "0", "width", "100%") + `">&nbsp;</p></td>`)
+	}
+	w.WriteString("</tr></table>\n")
+}
+
+// styles is the declarations for a style attribute, from pairs of
+// properties and values, leaving out those without a value.
+func styles(pairs ...string) string {
+	var decls []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			decls = append(decls, pairs[i]+": "+attrValue(pairs[i+1]))
+		}
+	}
+	return strings.Join(decls, "; ")
+}
+
+// attrValue escapes the value for an attribute, leaving its
+// template actions for html/template to escape.
+func attrValue(s string) string {
+	var sb strings.Builder
+	last := 0
+	for _, m := range actions.FindAllStringIndex(s, -1) {
+		sb.WriteString(html.EscapeString(s[last:m[0]]))
+		sb.WriteString(s[m[0]:m[1]])
+		last = m[1]
+	}
+	sb.WriteString(html.EscapeString(s[last:]))
+	return sb.String()
+}
+
+func or(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
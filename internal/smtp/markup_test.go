@@ -0,0 +1,98 @@
+package smtp_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestCompileMarkup(t *testing.T) {
+	t.Run("compile", func(t *testing.T) {
+		is := is.New(t)
+
+		s, err := smtp.CompileMarkup(`<email width="500" background-color="#f4f4f4">
+  <section>
+    <column width="40%">
+      <image src="https://example.com/logo.png?a=1&b=2" alt="Logo" width="120"/>
+    </column>
+    <column>
+      <text color="#333">Hi {{.FirstName}},<br> &nbsp;<b>welcome</b></text>
+      {{if .Data.cta}}<button href="{{.Data.cta}}">Start</button>{{end}}
+      <divider/>
+    </column>
+  </section>
+</email>`)
+		is.NoErr(err) // compile markup
+
+		for _, want := range []string{
+			`<table role="presentation" cellpadding="0" cellspacing="0" border="0" width="500" style="width: 500px;`,
+			`<td class="column" width="40%" valign="top" style="width: 40%; padding: 0">`,
+			// the column without a width has what is left
+			`<td class="column" width="60%"`,
+			`<img src="https://example.com/logo.png?a=1&amp;b=2" alt="Logo" width="120"`,
+			`color: #333">Hi {{.FirstName}},<br> &nbsp;<b>welcome</b></td>`,
+			`{{if .Data.cta}}`,
+			`<a href="{{.Data.cta}}" target="_blank"`,
+			`border-top: 1px solid #cccccc`,
+			`@media only screen and (max-width: 480px)`,
+		} {
+			is.True(strings.Contains(s, want)) // compiled html
+		}
+	})
+
+	t.Run("comments", func(t *testing.T) {
+		is := is.New(t)
+
+		// the decoder skips comments, so what is in them isn't content
+		s, err := smtp.CompileMarkup(`<email><section><column>
+      <!-- <text>OLD</text> -->
+      <text>NEW</text>
+      <button href="https://example.com">Go</button>
+    </column></section></email>`)
+		is.NoErr(err) // compile markup
+		is.True(!strings.Contains(s, "OLD"))
+		is.True(strings.Contains(s, ">NEW</td>"))
+		is.True(strings.Contains(s, ">Go</a>"))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		is := is.New(t)
+
+		_, err := smtp.CompileMarkup(`<email>
+  <section>
+    <colum></colum>
+    <column width="80%">
+      <text font-size="big" colour="red">Hi</text>
+      <button>Go</button>
+    </column>
+    <column width="30%"></column>
+  </section>
+
+  Hello
+</email>`)
+
+		var merr *smtp.MarkupError
+		is.True(errors.As(err, &merr))
+		is.Equal(merr.Line, 3)
+		is.Equal(err.Error(), strings.Join([]string{
+			`line 3: there is no <colum>`,
+			`line 5: font-size of <text> is "big", not a length, like 10px or 10px 25px`,
+			`line 5: <text> has no colour attribute`,
+			`line 6: <button> needs a href`,
+			`line 2: the widths of the columns add up to more than 100%`,
+			`line 11: text has to be in a <text> or <button>`,
+		}, "\n"))
+	})
+
+	t.Run("syntax", func(t *testing.T) {
+		is := is.New(t)
+
+		_, err := smtp.CompileMarkup("<email>\n  <section>\n</email>")
+		var merr *smtp.MarkupError
+		is.True(errors.As(err, &merr))
+		is.Equal(merr.Line, 3)
+	})
+}
@@ -0,0 +1,473 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLineLength is where header lines are folded, as recommended by RFC 5322.
+const maxLineLength = 78
+
+// Message is a single email, rendered to RFC 5322 with WriteTo.
+//
+// When both Text and HTML are set they are sent as multipart/alternative.
+// Attachments with a ContentID are inline and sent as multipart/related
+// alongside the HTML, the rest are sent as multipart/mixed.
+type Message struct {
+	From    Address
+	ReplyTo []Address
+	To      []Address
+	Cc      []Address
+	// Bcc recipients are only given to the server, never written
+	// to the headers.
+	Bcc []Address
+	// Undisclosed writes To as undisclosed-recipients when there
+	// is nobody in it, for a message only sent Bcc.
+	Undisclosed bool
+	Subject     string
+	// Text is the plain text body.
+	Text string
+	// HTML is the html body.
+	HTML        string
+	Attachments []Attachment
+	// Header holds any extra fields, such as List-Unsubscribe.
+	// The fields written from the rest of the message, such as To,
+	// can't be set here.
+	Header textproto.MIMEHeader
+	// Date defaults to when the message is written.
+	Date time.Time
+	// MessageID defaults to a random id at the From address' domain.
+	// It should not include the angle brackets.
+	MessageID string
+	// ReturnPath is the envelope sender, where bounces go, and
+	// defaults to From. The API transports ignore it as they
+	// handle bounces themselves.
+	ReturnPath string
+}
+
+// Attachment is a file sent along with the message.
+type Attachment struct {
+	Filename string
+	// ContentType defaults to a guess from the Filename's extension.
+	ContentType string
+	Data        []byte
+	// ContentID makes the attachment inline, so it can be referenced
+	// from the HTML as `cid:<ContentID>`.
+	ContentID string
+}
+
+// Attach adds a file to the message.
+func (m *Message) Attach(filename string, data []byte) *Message {
+	m.Attachments = append(m.Attachments, Attachment{Filename: filename, Data: data})
+	return m
+}
+
+// Embed adds an inline file, such as an image, which the HTML
+// references as `cid:<cid>`.
+func (m *Message) Embed(cid, filename string, data []byte) *Message {
+	m.Attachments = append(m.Attachments, Attachment{Filename: filename, Data: data, ContentID: cid})
+	return m
+}
+
+// SetHeader sets an extra header field, replacing any existing values.
+// A field written from the rest of the message is rejected on WriteTo.
+func (m *Message) SetHeader(key, value string) *Message {
+	if m.Header == nil {
+		m.Header = make(textproto.MIMEHeader)
+	}
+	m.Header.Set(key, value)
+	return m
+}
+
+// Recipients are the envelope recipients, including Bcc.
+func (m *Message) Recipients() []Address {
+	rcpt := make([]Address, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	rcpt = append(rcpt, m.To...)
+	rcpt = append(rcpt, m.Cc...)
+	return append(rcpt, m.Bcc...)
+}
+
+// returnPath is the envelope sender.
+func (m *Message) returnPath() string {
+	if m.ReturnPath != "" {
+		return m.ReturnPath
+	}
+	return m.From.Address
+}
+
+// Bytes renders the message.
+func (m *Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo renders the message to w. Header values containing line
+// breaks are rejected rather than written.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if err := m.validate(); err != nil {
+		return 0, err
+	}
+
+	body, err := m.body()
+	if err != nil {
+		return 0, err
+	}
+
+	hw := &headerWriter{}
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	hw.write("Date", date.Format(time.RFC1123Z))
+
+	id := m.MessageID
+	if id == "" {
+		id = newMessageID(m.From)
+	}
+	hw.write("Message-ID", "<"+id+">")
+
+	hw.write("From", formatAddress(m.From))
+	hw.addressList("Reply-To", m.ReplyTo)
+	hw.addressList("To", m.To)
+	if len(m.To) == 0 && m.Undisclosed {
+		hw.write("To", "undisclosed-recipients:;")
+	}
+	hw.addressList("Cc", m.Cc)
+	hw.write("Subject", encodeWords(m.Subject))
+	hw.write("MIME-Version", "1.0")
+
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			hw.write(k, encodeWords(v))
+		}
+	}
+
+	for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if v := body.header.Get(k); v != "" {
+			hw.write(k, v)
+		}
+	}
+
+	hw.buf.WriteString("\r\n")
+	hw.buf.Write(body.data)
+
+	return hw.buf.WriteTo(w)
+}
+
+// validate guards against header injection, as well as a message
+// with nowhere to go.
+func (m *Message) validate() error {
+	if m.From.Address == "" {
+		return errors.New("message has no From address")
+	}
+
+	if len(m.Recipients()) == 0 {
+		return errors.New("message has no recipients")
+	}
+
+	addrs := append(m.Recipients(), m.From)
+	addrs = append(addrs, m.ReplyTo...)
+	for _, a := range addrs {
+		if hasLineBreak(a.Name) || hasLineBreak(a.Address) {
+			return fmt.Errorf("address %q contains a line break", a.Address)
+		}
+	}
+
+	if hasLineBreak(m.Subject) {
+		return errors.New("subject contains a line break")
+	}
+
+	if hasLineBreak(m.MessageID) {
+		return errors.New("message id contains a line break")
+	}
+
+	if hasLineBreak(m.ReturnPath) {
+		return errors.New("return path contains a line break")
+	}
+
+	for k, vs := range m.Header {
+		if !isToken(k) {
+			return fmt.Errorf("invalid header field name %q", k)
+		}
+		if reserved[textproto.CanonicalMIMEHeaderKey(k)] {
+			return fmt.Errorf("header %s is written from the message", k)
+		}
+		for _, v := range vs {
+			if hasLineBreak(v) {
+				return fmt.Errorf("header %s contains a line break", k)
+			}
+		}
+	}
+
+	for _, a := range m.Attachments {
+		if hasLineBreak(a.Filename) || hasLineBreak(a.ContentType) || hasLineBreak(a.ContentID) {
+			return fmt.Errorf("attachment %q contains a line break", a.Filename)
+		}
+	}
+
+	return nil
+}
+
+// reserved are the header fields WriteTo writes itself, so they
+// would be written twice if set in the Header too. Bcc is never
+// written at all.
+var reserved = map[string]bool{
+	"Date": true, "Message-Id": true, "From": true, "Reply-To": true,
+	"To": true, "Cc": true, "Bcc": true, "Subject": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// entity is a MIME header and the body that goes with it.
+type entity struct {
+	header textproto.MIMEHeader
+	data   []byte
+}
+
+// body nests the parts of the message as needed:
+//
+//	multipart/mixed
+//	├── multipart/related
+//	│   ├── multipart/alternative
+//	│   │   ├── text/plain
+//	│   │   └── text/html
+//	│   └── inline attachments
+//	└── attachments
+func (m *Message) body() (*entity, error) {
+	var parts []*entity
+	if m.Text != "" || m.HTML == "" {
+		parts = append(parts, textEntity("text/plain", m.Text))
+	}
+	if m.HTML != "" {
+		parts = append(parts, textEntity("text/html", m.HTML))
+	}
+
+	e := parts[0]
+	if len(parts) > 1 {
+		var err error
+		if e, err = multipartEntity("alternative", parts...); err != nil {
+			return nil, err
+		}
+	}
+
+	var inline, attached []*entity
+	for _, a := range m.Attachments {
+		if a.ContentID != "" {
+			inline = append(inline, attachmentEntity(a))
+		} else {
+			attached = append(attached, attachmentEntity(a))
+		}
+	}
+
+	if len(inline) > 0 {
+		var err error
+		if e, err = multipartEntity("related", append([]*entity{e}, inline...)...); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(attached) > 0 {
+		var err error
+		if e, err = multipartEntity("mixed", append([]*entity{e}, attached...)...); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func textEntity(contentType, s string) *entity {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(s))
+	qp.Close()
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &entity{h, buf.Bytes()}
+}
+
+func attachmentEntity(a Attachment) *entity {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+
+	disposition := "attachment"
+	if a.ContentID != "" {
+		disposition = "inline"
+		h.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	if a.Filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	} else {
+		h.Set("Content-Disposition", disposition)
+	}
+
+	// base64 split into lines of 76 characters
+	enc := base64.StdEncoding.EncodeToString(a.Data)
+	var buf bytes.Buffer
+	for len(enc) > 76 {
+		buf.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	buf.WriteString(enc)
+	return &entity{h, buf.Bytes()}
+}
+
+func multipartEntity(subtype string, parts ...*entity) (*entity, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			return nil, fmt.Errorf("mw.CreatePart: %w", err)
+		}
+		if _, err := w.Write(p.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("mw.Close: %w", err)
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()}))
+	return &entity{h, buf.Bytes()}, nil
+}
+
+// headerWriter writes header fields, folding lines that are too long.
+type headerWriter struct {
+	buf bytes.Buffer
+}
+
+func (hw *headerWriter) addressList(key string, addrs []Address) {
+	if len(addrs) == 0 {
+		return
+	}
+
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = formatAddress(a)
+	}
+	hw.write(key, strings.Join(list, ", "))
+}
+
+// write folds the field at the last space that keeps the
+// line within maxLineLength. Words that are too long to fold
+// are left as they are.
+func (hw *headerWriter) write(key, value string) {
+	line := key + ": " + value
+	for len(line) > maxLineLength {
+		i := strings.LastIndexByte(line[:maxLineLength], ' ')
+		if i <= len(key)+1 {
+			// no space to fold at, so look further along the line
+			if i = strings.IndexByte(line[maxLineLength:], ' '); i < 0 {
+				break
+			}
+			i += maxLineLength
+		}
+		hw.buf.WriteString(line[:i] + "\r\n")
+		line = line[i:]
+	}
+	hw.buf.WriteString(line + "\r\n")
+}
+
+// encodeWords encodes text that isn't plain ASCII as RFC 2047 encoded-words.
+// The words are kept short so the header can be folded between them.
+func encodeWords(s string) string {
+	if mime.QEncoding.Encode("utf-8", s) == s {
+		return s
+	}
+
+	// each word is kept to 60 characters, 12 of which
+	// are taken by =?utf-8?q? and ?=
+	const payload = 48
+
+	var words []string
+	var word strings.Builder
+	for _, r := range s {
+		var enc string
+		switch {
+		case r == ' ':
+			enc = "_"
+		case r > ' ' && r < utf8.RuneSelf && r != '=' && r != '?' && r != '_':
+			enc = string(r)
+		default:
+			for _, b := range []byte(string(r)) {
+				enc += fmt.Sprintf("=%02X", b)
+			}
+		}
+		if word.Len()+len(enc) > payload {
+			words = append(words, "=?utf-8?q?"+word.String()+"?=")
+			word.Reset()
+		}
+		word.WriteString(enc)
+	}
+	words = append(words, "=?utf-8?q?"+word.String()+"?=")
+	return strings.Join(words, " ")
+}
+
+// formatAddress writes the address with its display name, which
+// is encoded when it isn't plain ASCII.
+func formatAddress(a Address) string {
+	return (*mail.Address)(&a).String()
+}
+
+// newMessageID returns a random id at the domain of the address.
+func newMessageID(from Address) string {
+	p := make([]byte, 16)
+	rand.Read(p)
+
+	domain := "localhost"
+	if i := strings.LastIndexByte(from.Address, '@'); i >= 0 {
+		domain = from.Address[i+1:]
+	}
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(p), domain)
+}
+
+func hasLineBreak(s string) bool { return strings.ContainsAny(s, "\r\n") }
+
+// isToken reports whether s is a valid header field name.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r > '~' || r == ':' {
+			return false
+		}
+	}
+	return true
+}
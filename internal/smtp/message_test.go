@@ -0,0 +1,178 @@
+package smtp_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestMessage(t *testing.T) {
+	t.Run("headers", func(t *testing.T) {
+		is := is.New(t)
+
+		m := &smtp.Message{
+			From:      smtp.Address{Name: "Zoë Newsletter", Address: "news@example.com"},
+			To:        []smtp.Address{{Name: "Kristopher", Address: "kristopher@example.com"}},
+			Bcc:       []smtp.Address{{Address: "hidden@example.com"}},
+			Subject:   "Grüße aus Köln — a subject that goes on and on and on well past the line limit",
+			Text:      "Hello World",
+			Date:      time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC),
+			MessageID: "1@example.com",
+		}
+
+		p, err := m.Bytes()
+		is.NoErr(err) // render message
+
+		for _, line := range strings.Split(string(p), "\r\n") {
+			is.True(len(line) <= 78) // lines are folded
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(p))
+		is.NoErr(err) // parse message
+
+		var dec mime.WordDecoder
+		subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+		is.NoErr(err) // decode subject
+		is.Equal(subject, m.Subject)
+
+		from, err := mail.ParseAddress(msg.Header.Get("From"))
+		is.NoErr(err) // parse from
+		is.Equal(from.Name, "Zoë Newsletter")
+
+		is.Equal(msg.Header.Get("Date"), "Sat, 01 Apr 2023 12:00:00 +0000")
+		is.Equal(msg.Header.Get("Message-ID"), "<1@example.com>")
+		is.Equal(msg.Header.Get("MIME-Version"), "1.0")
+		is.Equal(msg.Header.Get("Bcc"), "") // bcc is not written
+		is.Equal(len(m.Recipients()), 2)    // bcc is still a recipient
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		is.NoErr(err) // parse content type
+		is.Equal(mediaType, "text/plain")
+		is.Equal(params["charset"], "utf-8")
+	})
+
+	t.Run("header injection", func(t *testing.T) {
+		is := is.New(t)
+
+		from := smtp.Address{Address: "news@example.com"}
+		to := []smtp.Address{{Address: "to@example.com"}}
+
+		_, err := (&smtp.Message{From: from, To: to, Subject: "Hi\r\nBcc: everyone@example.com"}).Bytes()
+		is.True(err != nil) // subject with line break
+
+		_, err = (&smtp.Message{From: from, To: []smtp.Address{{Name: "Eve\r\nBcc: x", Address: "eve@example.com"}}}).Bytes()
+		is.True(err != nil) // name with line break
+
+		_, err = (&smtp.Message{From: from, To: to}).SetHeader("X-Campaign", "1\nBcc: x").Bytes()
+		is.True(err != nil) // header with line break
+
+		_, err = (&smtp.Message{From: from, To: to}).SetHeader("X Campaign", "1").Bytes()
+		is.True(err != nil) // invalid field name
+
+		for _, k := range []string{"To", "content-type", "MIME-Version", "Bcc", "From"} {
+			_, err = (&smtp.Message{From: from, To: to}).SetHeader(k, "x@example.com").Bytes()
+			is.True(err != nil) // reserved field name
+		}
+
+		_, err = (&smtp.Message{From: from}).Bytes()
+		is.True(err != nil) // no recipients
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		is := is.New(t)
+
+		m := &smtp.Message{
+			From:    smtp.Address{Address: "news@example.com"},
+			To:      []smtp.Address{{Address: "to@example.com"}},
+			Subject: "Hello",
+			Text:    "Hello World",
+			HTML:    `<h1>Hello World</h1><img src="cid:logo">`,
+		}
+		m.Embed("logo", "logo.png", []byte("\x89PNG"))
+		m.Attach("résumé.pdf", bytes.Repeat([]byte("%PDF"), 100))
+
+		p, err := m.Bytes()
+		is.NoErr(err) // render message
+
+		msg, err := mail.ReadMessage(bytes.NewReader(p))
+		is.NoErr(err) // parse message
+
+		// mixed: related, attachment
+		mixed := readParts(t, msg.Header.Get("Content-Type"), msg.Body)
+		is.Equal(len(mixed), 2)
+		is.Equal(mixed[0].mediaType, "multipart/related")
+		is.Equal(mixed[1].mediaType, "application/pdf")
+
+		_, params, err := mime.ParseMediaType(mixed[1].header.Get("Content-Disposition"))
+		is.NoErr(err) // parse disposition
+		is.Equal(params["filename"], "résumé.pdf")
+		is.Equal(string(mixed[1].body), strings.Repeat("%PDF", 100))
+
+		// related: alternative, inline image
+		related := readParts(t, mixed[0].header.Get("Content-Type"), bytes.NewReader(mixed[0].body))
+		is.Equal(len(related), 2)
+		is.Equal(related[0].mediaType, "multipart/alternative")
+		is.Equal(related[1].mediaType, "image/png")
+		is.Equal(related[1].header.Get("Content-Id"), "<logo>")
+
+		// alternative: text, html
+		alt := readParts(t, related[0].header.Get("Content-Type"), bytes.NewReader(related[0].body))
+		is.Equal(len(alt), 2)
+		is.Equal(alt[0].mediaType, "text/plain")
+		is.Equal(string(alt[0].body), m.Text)
+		is.Equal(alt[1].mediaType, "text/html")
+		is.Equal(string(alt[1].body), m.HTML)
+	})
+}
+
+type part struct {
+	mediaType string
+	header    textproto.MIMEHeader
+	body      []byte
+}
+
+// readParts reads each part of a multipart body, decoding
+// its transfer encoding.
+func readParts(t *testing.T, contentType string, r io.Reader) []part {
+	t.Helper()
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("mime.ParseMediaType: %v", err)
+	}
+
+	var parts []part
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("mr.NextPart: %v", err)
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+
+		var body io.Reader = p
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			body = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("io.ReadAll: %v", err)
+		}
+
+		parts = append(parts, part{mediaType, p.Header, data})
+	}
+}
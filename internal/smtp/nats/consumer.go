@@ -3,7 +3,9 @@ package nats
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/adoublef/pinkpink/internal/smtp"
 	"github.com/nats-io/nats.go"
@@ -11,14 +13,58 @@ import (
 
 type Consumer interface {
 	NextMsg(ctx context.Context) (*smtp.Email, error)
-	Listen(ctx context.Context) error
+	Listen(ctx context.Context, h Handler) error
 	Close() error
 }
 
+// Handler does something with an email taken off the stream.
+// The message is redelivered if it returns an error, after a
+// delay that grows each time, unless the error is ErrTerm.
+type Handler func(ctx context.Context, e *smtp.Email) error
+
+// EventHandler does something with an event taken off the stream,
+// it is redelivered in the same way as for a Handler.
+type EventHandler func(ctx context.Context, e *smtp.Event) error
+
+// ErrTerm is returned, or wrapped, by a Handler for messages
+// that should never be redelivered.
+var ErrTerm = errors.New("message terminated")
+
+// RetryAfter is returned, or wrapped, by a Handler for a message to
+// be redelivered once the time has passed, in place of the backoff.
+type RetryAfter time.Duration
+
+func (d RetryAfter) Error() string { return "retry after " + time.Duration(d).String() }
+
+const (
+	// RetryDelay is how long a message is left before it is first
+	// redelivered, which doubles each time up to MaxRetryDelay.
+	RetryDelay    = 30 * time.Second
+	MaxRetryDelay = 30 * time.Minute
+	// MaxDeliver is how many times a message is delivered
+	// before it is given up on.
+	MaxDeliver = 8
+)
+
+// Backoff is how long to wait before the nth retry.
+func Backoff(n int) time.Duration {
+	d := RetryDelay
+	for i := 1; i < n && d < MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > MaxRetryDelay {
+		return MaxRetryDelay
+	}
+	return d
+}
+
 var _ Consumer = (*Worker)(nil)
 
 type Worker struct {
 	sub *nats.Subscription
+	// ackWait is how long the consumer waits for a message to be
+	// acked before redelivering it.
+	ackWait time.Duration
 }
 
 func NewWorker(nc *nats.Conn, ack nats.AckPolicy, maxPending int, consumer string, subj Subject) (*Worker, error) {
@@ -27,12 +73,17 @@ func NewWorker(nc *nats.Conn, ack nats.AckPolicy, maxPending int, consumer strin
 		return nil, fmt.Errorf("nc.JetStream: %w", err)
 	}
 
-	sub, err := newWorker(js, ack, maxPending, consumer, subj.String())
+	sub, err := newWorker(js, ack, maxPending, consumer, subj.stream(), subj.String())
 	if err != nil {
 		return nil, fmt.Errorf("newConsumer: %w", err)
 	}
 
-	return &Worker{sub}, nil
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, fmt.Errorf("sub.ConsumerInfo: %w", err)
+	}
+
+	return &Worker{sub, info.Config.AckWait}, nil
 }
 
 // I don't really need to know this info I don't think
@@ -58,19 +109,43 @@ func (w *Worker) NextMsg(ctx context.Context) (*smtp.Email, error) {
 }
 
 // Actual handler I care for
-func (w *Worker) Listen(ctx context.Context) error {
+func (w *Worker) Listen(ctx context.Context, h Handler) error {
+	return listen[smtp.Email](ctx, w.sub, w.ackWait, h)
+}
+
+// ListenEvents is Listen for a Worker on SubjectEvents.
+func (w *Worker) ListenEvents(ctx context.Context, h EventHandler) error {
+	return listen[smtp.Event](ctx, w.sub, w.ackWait, h)
+}
+
+func listen[T any](ctx context.Context, sub *nats.Subscription, ackWait time.Duration, h func(ctx context.Context, v *T) error) error {
 	for {
-		msg, err := w.sub.NextMsgWithContext(ctx)
+		msg, err := sub.NextMsgWithContext(ctx)
 		if err != nil {
 			return fmt.Errorf("sub.NextMsgWithContext: %w", err)
 		}
 
-		var email smtp.Email
-		if err := unmarshal(msg, &email); err != nil {
-			return fmt.Errorf("email.UnmarshalJSON: %w", err)
+		var v T
+		if err := unmarshal(msg, &v); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
 		}
 
-		// do something with the email
+		done := make(chan struct{})
+		go inProgress(msg, ackWait, done)
+		err = h(ctx, &v)
+		close(done)
+
+		if errors.Is(err, ErrTerm) {
+			if err := msg.Term(); err != nil {
+				return fmt.Errorf("msg.Term: %w", err)
+			}
+			continue
+		} else if err != nil {
+			if err := msg.NakWithDelay(retryDelay(msg, err)); err != nil {
+				return fmt.Errorf("msg.NakWithDelay: %w", err)
+			}
+			continue
+		}
 
 		// ack the message
 		if err := msg.Ack(); err != nil {
@@ -79,6 +154,25 @@ func (w *Worker) Listen(ctx context.Context) error {
 	}
 }
 
+// inProgress tells the server the message is still being handled
+// until done, as sending to each recipient in turn can take longer
+// than the ackWait, and it would be redelivered while being sent.
+func inProgress(msg *nats.Msg, ackWait time.Duration, done <-chan struct{}) {
+	if ackWait <= 0 {
+		ackWait = 30 * time.Second
+	}
+	t := time.NewTicker(ackWait / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			msg.InProgress()
+		}
+	}
+}
+
 func (w *Worker) Close() error {
 	if err := w.sub.Unsubscribe(); err != nil {
 		return fmt.Errorf("sub.Unsubscribe: %w", err)
@@ -86,13 +180,35 @@ func (w *Worker) Close() error {
 	return nil
 }
 
-func newWorker(js nats.JetStreamContext, ack nats.AckPolicy, pending int, consumer, subject string) (*nats.Subscription, error) {
-	// if consumer already exists return it
-	if _, err := js.ConsumerInfo(streamName, consumer); err == nil {
-		return js.QueueSubscribeSync(subject, consumer, nats.Bind(streamName, consumer))
+// retryDelay is how long to wait before the message the
+// Handler failed with err is redelivered.
+func retryDelay(msg *nats.Msg, err error) time.Duration {
+	var d RetryAfter
+	if errors.As(err, &d) {
+		return time.Duration(d)
+	}
+
+	n := 1
+	if meta, err := msg.Metadata(); err == nil {
+		n = int(meta.NumDelivered)
+	}
+	return Backoff(n)
+}
+
+func newWorker(js nats.JetStreamContext, ack nats.AckPolicy, pending int, consumer, stream, subject string) (*nats.Subscription, error) {
+	// if consumer already exists return it, once it gives up in the end
+	if info, err := js.ConsumerInfo(stream, consumer); err == nil {
+		if info.Config.MaxDeliver != MaxDeliver {
+			cfg := info.Config
+			cfg.MaxDeliver = MaxDeliver
+			if _, err := js.UpdateConsumer(stream, &cfg); err != nil {
+				return nil, fmt.Errorf("js.UpdateConsumer: %w", err)
+			}
+		}
+		return js.QueueSubscribeSync(subject, consumer, nats.Bind(stream, consumer))
 	}
 
-	_, err := js.AddConsumer(streamName, &nats.ConsumerConfig{
+	_, err := js.AddConsumer(stream, &nats.ConsumerConfig{
 		Durable: consumer,
 		// convention is to use the same name as the durable
 		DeliverGroup: consumer,
@@ -101,12 +217,13 @@ func newWorker(js nats.JetStreamContext, ack nats.AckPolicy, pending int, consum
 		FilterSubject:  subject,
 		AckPolicy:      ack,
 		MaxAckPending:  pending,
+		MaxDeliver:     MaxDeliver,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("js.AddConsumer: %w", err)
 	}
 
-	return js.QueueSubscribeSync(subject, consumer, nats.Bind(streamName, consumer))
+	return js.QueueSubscribeSync(subject, consumer, nats.Bind(stream, consumer))
 }
 
 // unmarshal is a helper function to unmarshal the data
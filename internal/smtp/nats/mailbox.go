@@ -0,0 +1,125 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultBucket is where caught mail is kept when no bucket is named.
+const DefaultBucket = "mail"
+
+var _ smtp.Mailbox = (*Mailbox)(nil)
+
+// Mailbox keeps caught mail in a KV bucket, so the worker that
+// catches it and the web server that shows it can be apart.
+type Mailbox struct {
+	kv nats.KeyValue
+}
+
+// NewMailbox returns a Mailbox for the bucket, creating it if need be.
+func NewMailbox(nc *nats.Conn, bucket string) (*Mailbox, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("nc.JetStream: %w", err)
+	}
+
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, Description: "caught mail"})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("js.KeyValue: %w", err)
+	}
+
+	return &Mailbox{kv}, nil
+}
+
+func (b *Mailbox) Put(ctx context.Context, c *smtp.Caught) error {
+	p, err := marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.kv.Put(c.ID, p); err != nil {
+		return fmt.Errorf("kv.Put: %w", err)
+	}
+	return nil
+}
+
+func (b *Mailbox) Get(ctx context.Context, id string) (*smtp.Caught, error) {
+	entry, err := b.kv.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return nil, smtp.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kv.Get: %w", err)
+	}
+
+	var c smtp.Caught
+	if err := json.Unmarshal(entry.Value(), &c); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &c, nil
+}
+
+func (b *Mailbox) List(ctx context.Context) ([]*smtp.Caught, error) {
+	keys, err := b.kv.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kv.Keys: %w", err)
+	}
+
+	list := make([]*smtp.Caught, 0, len(keys))
+	for _, k := range keys {
+		c, err := b.Get(ctx, k)
+		if errors.Is(err, smtp.ErrNotFound) {
+			// deleted since the keys were listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	smtp.SortCaught(list)
+	return list, nil
+}
+
+func (b *Mailbox) Delete(ctx context.Context, id string) error {
+	if _, err := b.Get(ctx, id); err != nil {
+		return err
+	}
+
+	if err := b.kv.Purge(id); err != nil {
+		return fmt.Errorf("kv.Purge: %w", err)
+	}
+	return nil
+}
+
+func (b *Mailbox) Clear(ctx context.Context) error {
+	keys, err := b.kv.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("kv.Keys: %w", err)
+	}
+
+	for _, k := range keys {
+		if err := b.kv.Purge(k); err != nil {
+			return fmt.Errorf("kv.Purge: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package nats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailbox(t *testing.T) {
+	ctx := context.Background()
+
+	box, err := smtpNATS.NewMailbox(natsConn, "test_mail")
+	require.NoError(t, err, "failed to create mailbox")
+
+	older := &smtp.Caught{ID: "a", Subject: "Older", Date: time.Now().Add(-time.Minute), Raw: []byte("Subject: Older\r\n\r\n")}
+	newer := &smtp.Caught{ID: "b", Subject: "Newer", Date: time.Now(), Raw: []byte("Subject: Newer\r\n\r\n")}
+	require.NoError(t, box.Put(ctx, older), "failed to put message")
+	require.NoError(t, box.Put(ctx, newer), "failed to put message")
+
+	c, err := box.Get(ctx, "a")
+	require.NoError(t, err, "failed to get message")
+	require.Equal(t, "Older", c.Subject, "subject does not match")
+
+	list, err := box.List(ctx)
+	require.NoError(t, err, "failed to list messages")
+	require.Len(t, list, 2, "list length does not match")
+	require.Equal(t, "b", list[0].ID, "newest message is not first")
+
+	require.NoError(t, box.Delete(ctx, "a"), "failed to delete message")
+	_, err = box.Get(ctx, "a")
+	require.True(t, errors.Is(err, smtp.ErrNotFound), "deleted message still found")
+
+	require.NoError(t, box.Clear(ctx), "failed to clear mailbox")
+	list, err = box.List(ctx)
+	require.NoError(t, err, "failed to list messages")
+	require.Len(t, list, 0, "mailbox is not empty")
+}
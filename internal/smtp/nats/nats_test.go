@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/adoublef/pinkpink/internal/smtp"
 	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
@@ -25,7 +27,7 @@ func TestConsumer(t *testing.T) {
 	t.Setenv("DEBUG", "t")
 
 	// setup nats p
-	p, err := smtpNATS.NewProducer(natsConn, nats.WorkQueuePolicy, 1024)
+	p, err := smtpNATS.NewProducer(natsConn, nats.WorkQueuePolicy, smtpNATS.DefaultMaxBytes)
 	require.NoError(t, err, "failed to create nats producer")
 
 	// setup nats c
@@ -43,6 +45,87 @@ func TestConsumer(t *testing.T) {
 	require.NoError(t, err, "failed to get next message")
 }
 
+func TestProducerEvents(t *testing.T) {
+	_, err := smtpNATS.NewProducer(natsConn, nats.WorkQueuePolicy, smtpNATS.DefaultMaxBytes)
+	require.NoError(t, err, "failed to create nats producer")
+
+	js, err := natsConn.JetStream()
+	require.NoError(t, err, "failed to get jetstream")
+
+	jobs, err := js.StreamNameBySubject(smtpNATS.SubjectSubscribe.String())
+	require.NoError(t, err, "no stream for emails")
+	events, err := js.StreamNameBySubject(smtpNATS.SubjectEvents.String())
+	require.NoError(t, err, "no stream for events")
+	require.NotEqual(t, jobs, events, "events share the work queue")
+
+	info, err := js.StreamInfo(events)
+	require.NoError(t, err, "failed to get stream info")
+	require.Equal(t, nats.LimitsPolicy, info.Config.Retention, "events aren't kept")
+}
+
+func TestProducerLimits(t *testing.T) {
+	p, err := smtpNATS.NewProducer(natsConn, nats.WorkQueuePolicy, smtpNATS.DefaultMaxBytes)
+	require.NoError(t, err, "failed to create nats producer")
+
+	js, err := natsConn.JetStream()
+	require.NoError(t, err, "failed to get jetstream")
+	name, err := js.StreamNameBySubject(smtpNATS.SubjectSubscribe.String())
+	require.NoError(t, err, "no stream for emails")
+	info, err := js.StreamInfo(name)
+	require.NoError(t, err, "failed to get stream info")
+	require.Equal(t, nats.DiscardNew, info.Config.Discard, "queued emails can be dropped")
+
+	// too big to queue is an error, not dropped
+	email := smtp.Email{Markdown: strings.Repeat("a", smtpNATS.MaxMsgSize)}
+	err = p.Publish(smtpNATS.SubjectSubscribe, &email)
+	require.Error(t, err, "oversized email queued")
+}
+
+func TestWorkerInProgress(t *testing.T) {
+	p, err := smtpNATS.NewProducer(natsConn, nats.WorkQueuePolicy, smtpNATS.DefaultMaxBytes)
+	require.NoError(t, err, "failed to create nats producer")
+
+	// a consumer that redelivers after a second, unless told it is in progress
+	js, err := natsConn.JetStream()
+	require.NoError(t, err, "failed to get jetstream")
+	stream, err := js.StreamNameBySubject(smtpNATS.SubjectEvents.String())
+	require.NoError(t, err, "no stream for events")
+	_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:        "slow",
+		DeliverGroup:   "slow",
+		DeliverSubject: nats.NewInbox(),
+		DeliverPolicy:  nats.DeliverNewPolicy,
+		FilterSubject:  smtpNATS.SubjectEvents.String(),
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        time.Second,
+		MaxDeliver:     smtpNATS.MaxDeliver,
+	})
+	require.NoError(t, err, "failed to add consumer")
+
+	w, err := smtpNATS.NewWorker(natsConn, nats.AckExplicitPolicy, 1, "slow", smtpNATS.SubjectEvents)
+	require.NoError(t, err, "failed to create nats consumer")
+	t.Cleanup(func() { w.Close() })
+
+	err = p.Publish(smtpNATS.SubjectEvents, &smtp.Event{Type: smtp.EventDelivered, Recipient: "jo@example.com"})
+	require.NoError(t, err, "failed to publish event")
+
+	var calls int
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+	defer cancel()
+	w.ListenEvents(ctx, func(ctx context.Context, e *smtp.Event) error {
+		calls++
+		time.Sleep(2500 * time.Millisecond)
+		return nil
+	})
+	require.Equal(t, 1, calls, "redelivered while being handled")
+}
+
+func TestBackoff(t *testing.T) {
+	require.Equal(t, smtpNATS.RetryDelay, smtpNATS.Backoff(1))
+	require.Equal(t, 2*smtpNATS.RetryDelay, smtpNATS.Backoff(2))
+	require.Equal(t, smtpNATS.MaxRetryDelay, smtpNATS.Backoff(smtpNATS.MaxDeliver), "capped")
+}
+
 func TestMain(m *testing.M) {
 	ctx := context.Background()
 
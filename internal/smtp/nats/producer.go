@@ -3,6 +3,7 @@ package nats
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
@@ -23,10 +24,24 @@ func init() {
 
 const (
 	streamName = "SMTP"
+	// eventsStreamName keeps events apart from the work queue, for
+	// as long as they are of use rather than until they are handled
+	eventsStreamName = "SMTP_EVENTS"
+	eventsMaxAge     = 30 * 24 * time.Hour
+	eventsMaxBytes   = 1 << 30
+)
+
+const (
+	// DefaultMaxBytes is how much the work queue holds. When it is
+	// full new emails are turned away, rather than queued ones lost.
+	DefaultMaxBytes = 64 << 20
+	// MaxMsgSize is the most an email in the work queue can be.
+	MaxMsgSize = 256 << 10
 )
 
 var (
 	streamSubjects = []string{"*.smtp.subscribe"}
+	eventsSubjects = []string{"*.smtp.events"}
 )
 
 type Subject string
@@ -39,10 +54,20 @@ func (s Subject) String() string {
 	return "internal.smtp." + string(s)
 }
 
+// stream is the name of the stream the subject is kept in.
+func (s Subject) stream() string {
+	if s == SubjectEvents {
+		return eventsStreamName
+	}
+	return streamName
+}
+
 // subjects
 const (
 	SubjectAll       Subject = ">"
 	SubjectSubscribe Subject = "subscribe"
+	// SubjectEvents carries smtp.Events, such as bounces.
+	SubjectEvents Subject = "events"
 )
 
 type Producer interface {
@@ -77,21 +102,66 @@ func NewProducer(nc *nats.Conn, retention nats.RetentionPolicy, maxBytes int64)
 		return nil, fmt.Errorf("nc.JetStream: %w", err)
 	}
 
-	// TODO: update stream with new subjects if they change
-
-	// check if stream already exists
-	if _, err = js.StreamInfo(streamName); err == nil {
-		return &Stream{js}, nil
-	}
-
-	if _, err = js.AddStream(&nats.StreamConfig{
+	if err := addStream(js, &nats.StreamConfig{
 		Name:      streamName,
 		Subjects:  streamSubjects, // wildcard
-		Retention: retention,
-		MaxBytes:  maxBytes, // 1kb
+		Retention:  retention,
+		MaxBytes:   maxBytes,
+		MaxMsgSize: MaxMsgSize,
+		Discard:    nats.DiscardNew,
+	}); err != nil {
+		return nil, err
+	}
+
+	// events are kept whether or not anyone has read them, so
+	// they can't push emails waiting to be sent out
+	if err := addStream(js, &nats.StreamConfig{
+		Name:      eventsStreamName,
+		Subjects:  eventsSubjects,
+		Retention: nats.LimitsPolicy,
+		MaxAge:    eventsMaxAge,
+		MaxBytes:  eventsMaxBytes,
+		Discard:   nats.DiscardOld,
 	}); err != nil {
-		return nil, fmt.Errorf("addStream: %w", err)
+		return nil, err
 	}
 
 	return &Stream{js}, nil
 }
+
+// addStream adds the stream, or if it already exists makes its
+// subjects and limits the same, as they have changed since.
+func addStream(js nats.JetStreamContext, cfg *nats.StreamConfig) error {
+	if info, err := js.StreamInfo(cfg.Name); err == nil {
+		c := info.Config
+		if !sameSubjects(c.Subjects, cfg.Subjects) || c.MaxBytes != cfg.MaxBytes || c.MaxMsgSize != cfg.MaxMsgSize || c.MaxAge != cfg.MaxAge || c.Discard != cfg.Discard {
+			c.Subjects, c.MaxBytes, c.MaxMsgSize, c.MaxAge, c.Discard = cfg.Subjects, cfg.MaxBytes, cfg.MaxMsgSize, cfg.MaxAge, cfg.Discard
+			if _, err := js.UpdateStream(&c); err != nil {
+				return fmt.Errorf("js.UpdateStream: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if _, err := js.AddStream(cfg); err != nil {
+		return fmt.Errorf("addStream: %w", err)
+	}
+	return nil
+}
+
+// sameSubjects reports whether have and want are the same subjects.
+func sameSubjects(have, want []string) bool {
+	if len(have) != len(want) {
+		return false
+	}
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			found = found || h == w
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
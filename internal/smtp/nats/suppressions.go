@@ -0,0 +1,73 @@
+package nats
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultSuppressions is where suppressed addresses are kept
+// when no bucket is named.
+const DefaultSuppressions = "suppressions"
+
+var _ smtp.Suppressions = (*Suppressions)(nil)
+
+// Suppressions keeps the event each address was suppressed for in a
+// KV bucket, keyed by the address, so every worker sees them.
+type Suppressions struct {
+	kv nats.KeyValue
+}
+
+// NewSuppressions returns Suppressions for the bucket, creating it if need be.
+func NewSuppressions(nc *nats.Conn, bucket string) (*Suppressions, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("nc.JetStream: %w", err)
+	}
+
+	if bucket == "" {
+		bucket = DefaultSuppressions
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, Description: "suppressed addresses"})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("js.KeyValue: %w", err)
+	}
+
+	return &Suppressions{kv}, nil
+}
+
+func (s *Suppressions) Suppress(ctx context.Context, e *smtp.Event) error {
+	p, err := marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.kv.Put(suppressionKey(e.Recipient), p); err != nil {
+		return fmt.Errorf("kv.Put: %w", err)
+	}
+	return nil
+}
+
+func (s *Suppressions) Suppressed(ctx context.Context, address string) (bool, error) {
+	_, err := s.kv.Get(suppressionKey(address))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("kv.Get: %w", err)
+	}
+	return true, nil
+}
+
+// suppressionKey encodes the address, as keys can't have an @ in them.
+func suppressionKey(address string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(smtp.SuppressionKey(address)))
+}
@@ -0,0 +1,36 @@
+package nats_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuppressions(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := smtpNATS.NewSuppressions(natsConn, "test_suppressions")
+	require.NoError(t, err, "failed to create suppressions")
+
+	ok, err := s.Suppressed(ctx, "jo+news@example.net")
+	require.NoError(t, err, "failed to look up address")
+	require.False(t, ok, "suppressed before anything happened")
+
+	e := &smtp.Event{Type: smtp.EventUnsubscribed, Recipient: "Jo+News@Example.net", Time: time.Now()}
+	require.NoError(t, s.Suppress(ctx, e), "failed to suppress address")
+
+	ok, err = s.Suppressed(ctx, "jo+news@example.net")
+	require.NoError(t, err, "failed to look up address")
+	require.True(t, ok, "address isn't suppressed, whatever its case")
+
+	// a second connection, as another worker would have
+	other, err := smtpNATS.NewSuppressions(natsConn, "test_suppressions")
+	require.NoError(t, err, "failed to open suppressions")
+	ok, err = other.Suppressed(ctx, "jo+news@example.net")
+	require.NoError(t, err, "failed to look up address")
+	require.True(t, ok, "suppression isn't shared")
+}
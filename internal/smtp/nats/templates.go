@@ -0,0 +1,290 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultTemplates is where templates are kept when no bucket is named.
+const DefaultTemplates = "templates"
+
+var _ smtp.TemplateStore = (*Templates)(nil)
+
+// Templates keeps every version of a template in an object store
+// bucket, with an object per file, such as "welcome/3/body.html",
+// and each template's history, with its active version, in a KV
+// bucket of the same name.
+type Templates struct {
+	obs nats.ObjectStore
+	kv  nats.KeyValue
+}
+
+// NewTemplates returns Templates for the bucket, creating it if need be.
+func NewTemplates(nc *nats.Conn, bucket string) (*Templates, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("nc.JetStream: %w", err)
+	}
+
+	if bucket == "" {
+		bucket = DefaultTemplates
+	}
+
+	obs, err := js.ObjectStore(bucket)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		obs, err = js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: bucket, Description: "email templates"})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("js.ObjectStore: %w", err)
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, Description: "email template versions"})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("js.KeyValue: %w", err)
+	}
+
+	t := &Templates{obs, kv}
+	if err := t.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Templates) Files(ctx context.Context, name string) (*smtp.TemplateFiles, error) {
+	h, _, err := t.history(name)
+	if err != nil {
+		return nil, err
+	}
+	if h.Active == 0 {
+		return nil, smtp.ErrTemplateNotFound
+	}
+	return t.files(ctx, name, h.Active)
+}
+
+func (t *Templates) Put(ctx context.Context, name string, files *smtp.TemplateFiles) (*smtp.TemplateVersion, error) {
+	if _, err := smtp.ParseTemplate(name, files); err != nil {
+		return nil, err
+	}
+
+	// the number is taken first, so nobody else saves over the files
+	var version int
+	if err := t.update(name, true, func(h *smtp.TemplateHistory) error {
+		version = h.Reserve()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for file, s := range map[string]string{smtp.TemplateSubject: files.Subject, smtp.TemplateHTML: files.HTML, smtp.TemplateMarkup: files.Markup, smtp.TemplateText: files.Text} {
+		if s == "" {
+			continue
+		}
+		if _, err := t.obs.PutBytes(key(name, version, file), []byte(s), nats.Context(ctx)); err != nil {
+			return nil, fmt.Errorf("obs.PutBytes: %w", err)
+		}
+	}
+
+	v := smtp.TemplateVersion{Name: name, Version: version, Created: time.Now()}
+	if err := t.update(name, false, func(h *smtp.TemplateHistory) error {
+		h.Add(v)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (t *Templates) Version(ctx context.Context, name string, version int) (*smtp.TemplateFiles, error) {
+	h, _, err := t.history(name)
+	if err != nil {
+		return nil, err
+	}
+	if !h.Has(version) {
+		return nil, smtp.ErrTemplateNotFound
+	}
+	return t.files(ctx, name, version)
+}
+
+func (t *Templates) History(ctx context.Context, name string) (*smtp.TemplateHistory, error) {
+	h, _, err := t.history(name)
+	return h, err
+}
+
+func (t *Templates) Publish(ctx context.Context, name string, version int) error {
+	return t.update(name, false, func(h *smtp.TemplateHistory) error {
+		return h.Publish(version)
+	})
+}
+
+func (t *Templates) Rollback(ctx context.Context, name string) (int, error) {
+	var version int
+	err := t.update(name, false, func(h *smtp.TemplateHistory) (err error) {
+		version, err = h.Rollback()
+		return err
+	})
+	return version, err
+}
+
+func (t *Templates) Names(ctx context.Context) ([]string, error) {
+	names, err := t.kv.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kv.Keys: %w", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// files reads the version's files, which are left out when empty.
+func (t *Templates) files(ctx context.Context, name string, version int) (*smtp.TemplateFiles, error) {
+	files := smtp.TemplateFiles{Version: version}
+	for file, p := range map[string]*string{smtp.TemplateSubject: &files.Subject, smtp.TemplateHTML: &files.HTML, smtp.TemplateMarkup: &files.Markup, smtp.TemplateText: &files.Text} {
+		b, err := t.obs.GetBytes(key(name, version, file), nats.Context(ctx))
+		if errors.Is(err, nats.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("obs.GetBytes: %w", err)
+		}
+		*p = string(b)
+	}
+	return &files, nil
+}
+
+// history returns the template's history and its revision.
+func (t *Templates) history(name string) (*smtp.TemplateHistory, uint64, error) {
+	entry, err := t.kv.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return nil, 0, smtp.ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("kv.Get: %w", err)
+	}
+
+	var h smtp.TemplateHistory
+	if err := json.Unmarshal(entry.Value(), &h); err != nil {
+		return nil, 0, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &h, entry.Revision(), nil
+}
+
+// update changes the template's history, trying again when someone
+// else changed it first. A template without a history only gets one
+// when create is set.
+func (t *Templates) update(name string, create bool, f func(h *smtp.TemplateHistory) error) error {
+	for {
+		h, rev, err := t.history(name)
+		if errors.Is(err, smtp.ErrTemplateNotFound) && create {
+			h = &smtp.TemplateHistory{}
+		} else if err != nil {
+			return err
+		}
+
+		if err := f(h); err != nil {
+			return err
+		}
+
+		p, err := json.Marshal(h)
+		if err != nil {
+			return fmt.Errorf("json.Marshal: %w", err)
+		}
+
+		if rev == 0 {
+			_, err = t.kv.Create(name, p)
+		} else {
+			_, err = t.kv.Update(name, p, rev)
+		}
+		// the revision is checked for updates too, failing the same way
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("kv.Update: %w", err)
+		}
+		return nil
+	}
+}
+
+// migrate gives the templates saved before there were versions, as
+// "welcome/body.html", a first version that is active so they are
+// still sent. Processes starting together can each migrate them, as
+// only one can create the history and they write the same files.
+func (t *Templates) migrate(ctx context.Context) error {
+	objs, err := t.obs.List(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoObjectsFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("obs.List: %w", err)
+	}
+
+	old := make(map[string][]string)
+	for _, o := range objs {
+		if name, file, ok := strings.Cut(o.Name, "/"); ok && !strings.Contains(file, "/") {
+			old[name] = append(old[name], o.Name)
+		}
+	}
+
+	for name, keys := range old {
+		_, _, err := t.history(name)
+		if errors.Is(err, smtp.ErrTemplateNotFound) {
+			err = t.migrateTemplate(ctx, name)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := t.obs.Delete(k); err != nil && !errors.Is(err, nats.ErrObjectNotFound) {
+				return fmt.Errorf("obs.Delete: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateTemplate saves the template's old files as its first version.
+func (t *Templates) migrateTemplate(ctx context.Context, name string) error {
+	for _, file := range []string{smtp.TemplateSubject, smtp.TemplateHTML, smtp.TemplateText} {
+		b, err := t.obs.GetBytes(path.Join(name, file), nats.Context(ctx))
+		if errors.Is(err, nats.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("obs.GetBytes: %w", err)
+		}
+		if _, err := t.obs.PutBytes(key(name, 1, file), b, nats.Context(ctx)); err != nil {
+			return fmt.Errorf("obs.PutBytes: %w", err)
+		}
+	}
+
+	var h smtp.TemplateHistory
+	h.Add(smtp.TemplateVersion{Name: name, Version: h.Reserve(), Created: time.Now()})
+	p, err := json.Marshal(&h)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if _, err := t.kv.Create(name, p); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+		return fmt.Errorf("kv.Create: %w", err)
+	}
+	return nil
+}
+
+func key(name string, version int, file string) string {
+	return path.Join(name, strconv.Itoa(version), file)
+}
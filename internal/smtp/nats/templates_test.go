@@ -0,0 +1,104 @@
+package nats_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	smtpNATS "github.com/adoublef/pinkpink/internal/smtp/nats"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplates(t *testing.T) {
+	ctx := context.Background()
+
+	tmpls, err := smtpNATS.NewTemplates(natsConn, "test_templates")
+	require.NoError(t, err, "failed to create templates")
+
+	_, err = tmpls.Files(ctx, "welcome")
+	require.True(t, errors.Is(err, smtp.ErrTemplateNotFound), "missing template found")
+
+	v1, err := tmpls.Put(ctx, "welcome", &smtp.TemplateFiles{Subject: "Hi {{.FirstName}}", HTML: "<p>Hi {{.FirstName}}</p>"})
+	require.NoError(t, err, "failed to put template")
+	require.Equal(t, 1, v1.Version, "version does not match")
+
+	tmpl, err := smtp.LoadTemplate(ctx, tmpls, "welcome")
+	require.NoError(t, err, "failed to load template")
+	require.Equal(t, 1, tmpl.Version, "new template is not active")
+
+	msg, err := tmpl.Render(&smtp.TemplateData{Recipient: smtp.Recipient{FirstName: "Jane"}})
+	require.NoError(t, err, "failed to render template")
+	require.Equal(t, "<p>Hi Jane</p>", msg.HTML, "html does not match")
+
+	// a new version isn't sent until it is published
+	v2, err := tmpls.Put(ctx, "welcome", &smtp.TemplateFiles{Subject: "Hello {{.FirstName}}", Text: "Hello"})
+	require.NoError(t, err, "failed to put template")
+	require.Equal(t, 2, v2.Version, "version does not match")
+
+	files, err := tmpls.Files(ctx, "welcome")
+	require.NoError(t, err, "failed to get files")
+	require.Equal(t, 1, files.Version, "unpublished version is active")
+
+	require.NoError(t, tmpls.Publish(ctx, "welcome", 2), "failed to publish")
+	files, err = tmpls.Files(ctx, "welcome")
+	require.NoError(t, err, "failed to get files")
+	require.Equal(t, 2, files.Version, "published version is not active")
+	require.Empty(t, files.HTML, "files of another version kept")
+
+	h, err := tmpls.History(ctx, "welcome")
+	require.NoError(t, err, "failed to get history")
+	require.Len(t, h.Versions, 2, "versions length does not match")
+
+	v, err := tmpls.Rollback(ctx, "welcome")
+	require.NoError(t, err, "failed to roll back")
+	require.Equal(t, 1, v, "rolled back to the wrong version")
+
+	_, err = tmpls.Rollback(ctx, "welcome")
+	require.True(t, errors.Is(err, smtp.ErrNoRollback), "rolled back too far")
+
+	require.True(t, errors.Is(tmpls.Publish(ctx, "welcome", 9), smtp.ErrTemplateNotFound), "published a missing version")
+	require.True(t, errors.Is(tmpls.Publish(ctx, "missing", 1), smtp.ErrTemplateNotFound), "published a missing template")
+
+	names, err := tmpls.Names(ctx)
+	require.NoError(t, err, "failed to list names")
+	require.Equal(t, []string{"welcome"}, names, "names do not match")
+
+	_, err = tmpls.Put(ctx, "broken", &smtp.TemplateFiles{HTML: "{{.FirstName"})
+	var terr *smtp.TemplateError
+	require.True(t, errors.As(err, &terr), "broken template stored")
+}
+
+func TestTemplatesMigrate(t *testing.T) {
+	ctx := context.Background()
+
+	// saved as they were before there were versions
+	js, err := natsConn.JetStream()
+	require.NoError(t, err, "failed to get jetstream")
+	obs, err := js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: "test_old_templates"})
+	require.NoError(t, err, "failed to create object store")
+	_, err = obs.PutString("welcome/"+smtp.TemplateSubject, "Hi {{.FirstName}}")
+	require.NoError(t, err, "failed to put subject")
+	_, err = obs.PutString("welcome/"+smtp.TemplateText, "Hello {{.FirstName}}")
+	require.NoError(t, err, "failed to put text")
+
+	tmpls, err := smtpNATS.NewTemplates(natsConn, "test_old_templates")
+	require.NoError(t, err, "failed to create templates")
+
+	files, err := tmpls.Files(ctx, "welcome")
+	require.NoError(t, err, "old template not found")
+	require.Equal(t, 1, files.Version, "old template is not the first version")
+	require.Equal(t, "Hi {{.FirstName}}", files.Subject, "subject does not match")
+	require.Equal(t, "Hello {{.FirstName}}", files.Text, "text does not match")
+
+	_, err = obs.GetInfo("welcome/" + smtp.TemplateSubject)
+	require.True(t, errors.Is(err, nats.ErrObjectNotFound), "old files left behind")
+
+	// again, as the next process to start would
+	tmpls, err = smtpNATS.NewTemplates(natsConn, "test_old_templates")
+	require.NoError(t, err, "failed to open templates")
+	h, err := tmpls.History(ctx, "welcome")
+	require.NoError(t, err, "failed to get history")
+	require.Len(t, h.Versions, 1, "migrated twice")
+}
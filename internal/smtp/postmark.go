@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PostmarkEndpoint is the base URL of the Postmark API.
+const PostmarkEndpoint = "https://api.postmarkapp.com"
+
+var _ Sender = (*Postmark)(nil)
+
+// Postmark sends through Postmark's email API.
+type Postmark struct {
+	api   *apiClient
+	token string
+	from  string
+}
+
+// NewPostmark returns a Sender for the Config's APIKey,
+// which is the server token.
+func NewPostmark(cfg *Config) *Postmark {
+	return &Postmark{newAPIClient("postmark", cfg, PostmarkEndpoint), cfg.APIKey, cfg.From}
+}
+
+type postmarkEmail struct {
+	From        string               `json:"From"`
+	To          string               `json:"To"`
+	Cc          string               `json:"Cc,omitempty"`
+	Bcc         string               `json:"Bcc,omitempty"`
+	ReplyTo     string               `json:"ReplyTo,omitempty"`
+	Subject     string               `json:"Subject"`
+	TextBody    string               `json:"TextBody,omitempty"`
+	HtmlBody    string               `json:"HtmlBody,omitempty"`
+	Headers     []postmarkHeader     `json:"Headers,omitempty"`
+	Attachments []postmarkAttachment `json:"Attachments,omitempty"`
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     string `json:"Content"`
+	ContentType string `json:"ContentType"`
+	ContentID   string `json:"ContentID,omitempty"`
+}
+
+type postmarkResponse struct {
+	MessageID string `json:"MessageID"`
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+}
+
+func (p *Postmark) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, err := withDefaults(m, p.from)
+	if err != nil {
+		return nil, err
+	}
+
+	body := postmarkEmail{
+		From:     formatAddress(m.From),
+		To:       strings.Join(addressStrings(apiTo(m)), ", "),
+		Cc:       strings.Join(addressStrings(m.Cc), ", "),
+		Bcc:      strings.Join(addressStrings(m.Bcc), ", "),
+		ReplyTo:  strings.Join(addressStrings(m.ReplyTo), ", "),
+		Subject:  m.Subject,
+		TextBody: m.Text,
+		HtmlBody: m.HTML,
+	}
+	for k, v := range flattenHeader(m) {
+		body.Headers = append(body.Headers, postmarkHeader{k, v})
+	}
+	for _, a := range m.Attachments {
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = attachmentEntity(a).header.Get("Content-Type")
+		}
+		cid := ""
+		if a.ContentID != "" {
+			cid = "cid:" + a.ContentID
+		}
+		body.Attachments = append(body.Attachments, postmarkAttachment{
+			Name:        a.Filename,
+			Content:     base64.StdEncoding.EncodeToString(a.Data),
+			ContentType: contentType,
+			ContentID:   cid,
+		})
+	}
+
+	r, err := p.api.newJSONRequest(ctx, "/email", body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("X-Postmark-Server-Token", p.token)
+
+	var res postmarkResponse
+	resp, err := p.api.do(r, &res, postmarkError)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ErrorCode != 0 {
+		return nil, &Error{Transport: "postmark", Phase: PhaseData, Code: 554, Message: fmt.Sprintf("%d %s", res.ErrorCode, res.Message)}
+	}
+
+	return &Result{MessageID: m.MessageID, QueueID: res.MessageID, Code: 250, Response: resp.Status + " " + res.Message}, nil
+}
+
+func postmarkError(p []byte) string {
+	var body postmarkResponse
+	json.Unmarshal(p, &body)
+	return fmt.Sprintf("%d %s", body.ErrorCode, body.Message)
+}
@@ -0,0 +1,154 @@
+package smtp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestRouter(t *testing.T) {
+	// heavy enough that the first route is always tried first
+	const heavy = 1 << 30
+
+	t.Run("failover", func(t *testing.T) {
+		is := is.New(t)
+
+		primary := &fakeSender{err: &smtp.Error{Transport: "smtp", Code: 421, Message: "try later"}}
+		backup := &fakeSender{}
+
+		r := smtp.NewRouter(smtp.Route{Sender: primary, Weight: heavy}, smtp.Route{Sender: backup})
+
+		res, err := r.Send(context.Background(), newTestMessage())
+		is.NoErr(err) // send email
+		is.Equal(res.QueueID, "fake")
+		is.Equal(primary.calls, 1)
+		is.Equal(backup.calls, 1)
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		is := is.New(t)
+
+		primary := &fakeSender{err: &smtp.Error{Transport: "smtp", Code: 550, Message: "no such user"}}
+		backup := &fakeSender{}
+
+		r := smtp.NewRouter(smtp.Route{Sender: primary, Weight: heavy}, smtp.Route{Sender: backup})
+
+		_, err := r.Send(context.Background(), newTestMessage())
+		is.True(err != nil) // permanent error
+		is.Equal(backup.calls, 0)
+	})
+
+	t.Run("cooldown", func(t *testing.T) {
+		is := is.New(t)
+
+		primary := &fakeSender{err: &smtp.Error{Transport: "smtp", Code: 451, Message: "local error"}}
+		backup := &fakeSender{}
+
+		r := smtp.NewRouter(smtp.Route{Sender: primary, Weight: heavy}, smtp.Route{Sender: backup})
+		r.MaxFailures, r.Cooldown = 2, 50*time.Millisecond
+
+		for i := 0; i < 5; i++ {
+			_, err := r.Send(context.Background(), newTestMessage())
+			is.NoErr(err) // send email
+		}
+		is.Equal(primary.calls, 2) // unhealthy after two failures
+		is.Equal(backup.calls, 5)
+
+		time.Sleep(60 * time.Millisecond)
+		primary.err = nil
+
+		_, err := r.Send(context.Background(), newTestMessage())
+		is.NoErr(err)              // send email
+		is.Equal(primary.calls, 3) // healthy again after the cooldown
+	})
+
+	t.Run("all failing", func(t *testing.T) {
+		is := is.New(t)
+
+		tempErr := &smtp.Error{Transport: "smtp", Code: 421, Message: "try later"}
+		r := smtp.NewRouter(smtp.Route{Sender: &fakeSender{err: tempErr}}, smtp.Route{Sender: &fakeSender{err: tempErr}})
+
+		_, err := r.Send(context.Background(), newTestMessage())
+		var smtpErr *smtp.Error
+		is.True(errors.As(err, &smtpErr)) // smtp error
+		is.True(smtpErr.Temporary())      // still temporary
+	})
+
+	t.Run("weight", func(t *testing.T) {
+		is := is.New(t)
+
+		nine, one := &fakeSender{}, &fakeSender{}
+		r := smtp.NewRouter(smtp.Route{Sender: nine, Weight: 9}, smtp.Route{Sender: one, Weight: 1})
+
+		for i := 0; i < 1000; i++ {
+			_, err := r.Send(context.Background(), newTestMessage())
+			is.NoErr(err) // send email
+		}
+		is.True(nine.calls > 800 && one.calls > 50) // roughly 9 to 1
+	})
+}
+
+func TestRouterVerify(t *testing.T) {
+	t.Run("one route up", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		bad := srv.Config()
+		bad.Password = "wrong"
+
+		down, up := smtp.NewClient(bad), smtp.NewClient(srv.Config())
+		t.Cleanup(func() { down.Close(); up.Close() })
+
+		r := smtp.NewRouter(smtp.Route{Sender: down}, smtp.Route{Sender: up}, smtp.Route{Sender: &fakeSender{}})
+
+		caps, err := r.Verify(context.Background())
+		is.NoErr(err) // verify
+		is.True(caps.TLS)
+	})
+
+	t.Run("all routes down", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := newTestServer(t)
+		bad := srv.Config()
+		bad.Password = "wrong"
+
+		down := smtp.NewClient(bad)
+		t.Cleanup(func() { down.Close() })
+
+		r := smtp.NewRouter(smtp.Route{Sender: down})
+
+		_, err := r.Verify(context.Background())
+		is.True(smtp.IsPermanent(err)) // bad credentials
+	})
+}
+
+func TestParseRouter(t *testing.T) {
+	is := is.New(t)
+
+	_, err := smtp.ParseRouter("smtp://relay.example.com?weight=3 sendgrid://:key@")
+	is.NoErr(err) // parse router
+
+	_, err = smtp.ParseRouter("smtp://relay.example.com?weight=heavy")
+	is.True(err != nil) // invalid weight
+
+	_, err = smtp.ParseRouter(" ")
+	is.True(err != nil) // no urls
+}
+
+type fakeSender struct {
+	err   error
+	calls int
+}
+
+func (s *fakeSender) Send(ctx context.Context, m *smtp.Message) (*smtp.Result, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &smtp.Result{QueueID: "fake", Code: 250}, nil
+}
@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/textproto"
+	"strings"
+)
+
+// SendGridEndpoint is the base URL of the SendGrid v3 API.
+const SendGridEndpoint = "https://api.sendgrid.com"
+
+var _ Sender = (*SendGrid)(nil)
+
+// SendGrid sends through SendGrid's v3 mail send API.
+type SendGrid struct {
+	api  *apiClient
+	key  string
+	from string
+}
+
+// NewSendGrid returns a Sender for the Config's APIKey.
+func NewSendGrid(cfg *Config) *SendGrid {
+	return &SendGrid{newAPIClient("sendgrid", cfg, SendGridEndpoint), cfg.APIKey, cfg.From}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridMail struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+func (s *SendGrid) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, err := withDefaults(m, s.from)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := func(as []Address) []sendGridAddress {
+		var sg []sendGridAddress
+		for _, a := range as {
+			sg = append(sg, sendGridAddress{a.Address, a.Name})
+		}
+		return sg
+	}
+
+	// every personalization needs someone in To, so without one
+	// the first Cc recipient takes its place, who is seen anyway
+	p := sendGridPersonalization{To: addrs(apiTo(m)), Cc: addrs(m.Cc), Bcc: addrs(m.Bcc)}
+	if len(p.To) == 0 {
+		p.To, p.Cc = p.Cc[:1], p.Cc[1:]
+	}
+
+	body := sendGridMail{
+		Personalizations: []sendGridPersonalization{p},
+		From:             sendGridAddress{m.From.Address, m.From.Name},
+		ReplyToList:      addrs(m.ReplyTo),
+		Subject:          m.Subject,
+		Headers:          flattenHeader(m),
+	}
+	if m.Text != "" {
+		body.Content = append(body.Content, sendGridContent{"text/plain", m.Text})
+	}
+	if m.HTML != "" {
+		body.Content = append(body.Content, sendGridContent{"text/html", m.HTML})
+	}
+	for _, a := range m.Attachments {
+		disposition := "attachment"
+		if a.ContentID != "" {
+			disposition = "inline"
+		}
+		body.Attachments = append(body.Attachments, sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(a.Data),
+			Filename:    a.Filename,
+			Type:        a.ContentType,
+			Disposition: disposition,
+			ContentID:   a.ContentID,
+		})
+	}
+
+	r, err := s.api.newJSONRequest(ctx, "/v3/mail/send", body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+s.key)
+
+	resp, err := s.api.do(r, nil, sendGridError)
+	if err != nil {
+		return nil, err
+	}
+
+	id := resp.Header.Get("X-Message-Id")
+	return &Result{MessageID: m.MessageID, QueueID: id, Code: 250, Response: resp.Status}, nil
+}
+
+// sendGridError joins the messages in an error response.
+func sendGridError(p []byte) string {
+	var body struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(p, &body)
+
+	var msgs []string
+	for _, e := range body.Errors {
+		msgs = append(msgs, e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// apiReserved are the header fields the APIs set themselves, from
+// the rest of the message, and refuse to be given.
+var apiReserved = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true,
+	"Subject": true, "Date": true, "Message-Id": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true,
+	"Received": true, "Dkim-Signature": true,
+}
+
+// flattenHeader takes the first value of each extra header field the
+// APIs can be given, with the Message-ID when one was set.
+func flattenHeader(m *Message) map[string]string {
+	h := make(map[string]string)
+	for k, vs := range m.Header {
+		if len(vs) > 0 && !apiReserved[textproto.CanonicalMIMEHeaderKey(k)] {
+			h[k] = vs[0]
+		}
+	}
+	if m.MessageID != "" {
+		h["Message-ID"] = "<" + m.MessageID + ">"
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
@@ -0,0 +1,21 @@
+package smtp_test
+
+import (
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp/smtptest"
+)
+
+// newTestServer starts a fake smtp server, once opts have been
+// applied to it, that is closed when the test ends.
+func newTestServer(t *testing.T, opts ...func(*smtptest.Server)) *smtptest.Server {
+	t.Helper()
+
+	s := smtptest.NewUnstartedServer()
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
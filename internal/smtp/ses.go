@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp/dkim"
+)
+
+var _ Sender = (*SES)(nil)
+
+// SES sends through the Amazon SES v2 API. Messages are rendered
+// and sent raw, so attachments and DKIM work as they do over SMTP.
+type SES struct {
+	api    *apiClient
+	region string
+	key    string
+	secret string
+	from   string
+	dkim   *dkim.Options
+}
+
+// NewSES returns a Sender for the Config's Region, using the
+// Username and Password as the access key id and secret.
+func NewSES(cfg *Config) *SES {
+	endpoint := "https://email." + cfg.Region + ".amazonaws.com"
+	return &SES{newAPIClient("ses", cfg, endpoint), cfg.Region, cfg.Username, cfg.Password, cfg.From, cfg.DKIM}
+}
+
+func (s *SES) Send(ctx context.Context, m *Message) (*Result, error) {
+	m, err := withDefaults(m, s.from)
+	if err != nil {
+		return nil, err
+	}
+	p, err := render(m, s.dkim)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		FromEmailAddress string
+		Destination      struct {
+			ToAddresses  []string `json:",omitempty"`
+			CcAddresses  []string `json:",omitempty"`
+			BccAddresses []string `json:",omitempty"`
+		}
+		Content struct {
+			Raw struct{ Data []byte }
+		}
+	}
+	body.FromEmailAddress = m.From.Address
+	body.Destination.ToAddresses = addressStrings(m.To)
+	body.Destination.CcAddresses = addressStrings(m.Cc)
+	body.Destination.BccAddresses = addressStrings(m.Bcc)
+	body.Content.Raw.Data = p
+
+	r, err := s.api.newJSONRequest(ctx, "/v2/email/outbound-emails", body)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, _ := json.Marshal(body)
+	s.sign(r, payload, time.Now())
+
+	var res struct {
+		MessageId string
+	}
+	resp, err := s.api.do(r, &res, sesError)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{MessageID: m.MessageID, QueueID: res.MessageId, Code: 250, Response: resp.Status}, nil
+}
+
+func sesError(p []byte) string {
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(p, &body)
+	return body.Message
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (s *SES) sign(r *http.Request, payload []byte, now time.Time) {
+	signV4(r, payload, now, s.region, "ses", s.key, s.secret)
+}
+
+// signV4 signs the request as described in
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func signV4(r *http.Request, payload []byte, now time.Time, region, service, key, secret string) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	r.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if r.Header.Get("Host") == "" {
+		r.Header.Set("Host", r.URL.Host)
+	}
+
+	// the headers that are signed, by lowercase name
+	headers := make(map[string]string)
+	for k, vs := range r.Header {
+		headers[strings.ToLower(k)] = strings.Join(vs, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonRequest := strings.Join([]string{
+		r.Method,
+		path,
+		canonicalQuery(r),
+		canonHeaders.String(),
+		signed,
+		hexHash(payload),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", now.Format("20060102T150405Z"), scope, hexHash([]byte(canonRequest))}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	r.Header.Del("Host")
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+key+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+// canonicalQuery sorts the query by key, then value.
+func canonicalQuery(r *http.Request) string {
+	q := r.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
+
+func hexHash(p []byte) string {
+	h := sha256.Sum256(p)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -2,7 +2,10 @@ package smtp
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/mail"
+	"strings"
+	"time"
 )
 
 type Recipient struct {
@@ -12,18 +15,43 @@ type Recipient struct {
 	FirstName string `json:"firstName"`
 	// LastName is optional, must be between 1 to 50 characters if provided
 	LastName string `json:"lastName"`
+	// Data is the recipient's own template data, which
+	// takes precedence over the Email's
+	Data map[string]any `json:"data,omitempty"`
+	// Locale is the language tag templates are chosen and
+	// formatted for, such as "fr-CA"
+	Locale string `json:"locale,omitempty"`
 }
 
 type Email struct {
 	// Subject must be between 1 to 50 characters
 	Subject string `json:"subject"`
 	// Message must be between 1 to 255 characters
-	Message    string      `json:"message"`
+	Message string `json:"message"`
+	// Markdown is used in place of the Message when set, and is
+	// sent as both HTML and plain text
+	Markdown   string      `json:"markdown,omitempty"`
 	Recipients []Recipient `json:"recipient"`
+	// Template is the name of the template rendered for each
+	// recipient in place of the Subject and Message, when set
+	Template string `json:"template,omitempty"`
+	// TemplateVersion is sent in place of the template's active
+	// version when set, such as for a test before it is published
+	TemplateVersion int `json:"templateVersion,omitempty"`
+	// Data is the template's custom data
+	Data map[string]any `json:"data,omitempty"`
+	// Attempt is how many times the email was sent before, when it
+	// is sent again to those it failed for, which isn't before RetryAt
+	Attempt int        `json:"attempt,omitempty"`
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+	// Test is set for a template's test sends, which go to our
+	// own addresses so aren't suppressed or counted as sent
+	Test bool `json:"test,omitempty"`
 }
 
 // Address wraps the mail.Address and adds custom encoding/decoding
-// This ignores the Name field
+// to and from a single string, such as `"Jane Doe" <jane@example.com>`.
+// Names and addresses may be non-ASCII, as RFC 6532 allows.
 type Address mail.Address
 
 func (a *Address) UnmarshalJSON(b []byte) error {
@@ -42,8 +70,24 @@ func (a *Address) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalJSON writes the name as it is, rather than
+// encoding it as mail.Address does for headers.
 func (a Address) MarshalJSON() ([]byte, error) {
-	return json.Marshal(a.String())
+	if a.Name == "" {
+		return json.Marshal(a.Address)
+	}
+
+	name := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.Name)
+	return json.Marshal(`"` + name + `" <` + a.Address + `>`)
 }
 
 func (a Address) String() string { return a.Address }
+
+// parseAddress parses a single RFC 5322 address.
+func parseAddress(s string) (Address, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return Address{}, fmt.Errorf("mail.ParseAddress: %w", err)
+	}
+	return Address(*addr), nil
+}
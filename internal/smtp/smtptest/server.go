@@ -0,0 +1,531 @@
+// Package smtptest provides an in-process SMTP server for testing
+// the smtp package, and anything built on it, without a network.
+package smtptest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+)
+
+// The credentials the server accepts by default.
+const (
+	Username = "from@example.com"
+	Password = "password"
+	// Token is the XOAUTH2 access token.
+	Token = "token"
+)
+
+// Server is an SMTP server listening on a loopback address, recording
+// the messages it receives. It supports EHLO, STARTTLS, AUTH PLAIN,
+// LOGIN, CRAM-MD5 and XOAUTH2, PIPELINING and optionally SMTPUTF8.
+//
+// The exported fields are read when a session starts, so should be
+// set before the first connection is made.
+type Server struct {
+	// Listener is where connections are accepted from.
+	Listener net.Listener
+	// TLS is used for STARTTLS, or from the start when the server
+	// was started with StartTLS. It has a self-signed certificate for
+	// 127.0.0.1 and localhost.
+	TLS *tls.Config
+	// NoStartTLS stops STARTTLS being offered.
+	NoStartTLS bool
+	// Auth are the mechanisms offered, defaults to PLAIN and LOGIN.
+	Auth []string
+	// Username, Password and Token are the credentials accepted.
+	Username, Password, Token string
+	// Delay holds up each reply.
+	Delay time.Duration
+	// Reject are recipients refused with a 550.
+	Reject []string
+	// DataReply is the text of the reply to DATA,
+	// defaults to "2.0.0 Ok: queued as <n>".
+	DataReply string
+	// DropAfterData closes the connection after each message.
+	DropAfterData bool
+	// SMTPUTF8 offers the extension, without which
+	// non-ASCII addresses are refused.
+	SMTPUTF8 bool
+
+	implicit bool
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns int
+	msgs  []Message
+	mechs []string
+	fails map[string]*failure
+	open  map[net.Conn]bool
+}
+
+// Message is a mail transaction the server accepted.
+type Message struct {
+	// From is the envelope sender.
+	From string
+	// SMTPUTF8 is whether the message was sent with SMTPUTF8.
+	SMTPUTF8 bool
+	// To are the envelope recipients that were accepted.
+	To []string
+	// Data is the message as sent, with CRLF line endings.
+	Data []byte
+	// Header and Body are the parsed message.
+	Header mail.Header
+	Body   []byte
+}
+
+// failure is a reply given in place of the usual one.
+type failure struct {
+	n     int
+	reply string
+}
+
+// NewServer starts and returns a new Server.
+// The caller should call Close when finished.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts and returns a new Server using implicit TLS.
+// The caller should call Close when finished.
+func NewTLSServer() *Server {
+	s := NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a new Server that is not yet serving,
+// so its fields can be changed before calling Start or StartTLS.
+func NewUnstartedServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen on a port: %v", err))
+	}
+
+	return &Server{
+		Listener: l,
+		TLS:      &tls.Config{Certificates: []tls.Certificate{newCert()}},
+		Auth:     []string{"PLAIN", "LOGIN"},
+		Username: Username,
+		Password: Password,
+		Token:    Token,
+		fails:    make(map[string]*failure),
+		open:     make(map[net.Conn]bool),
+	}
+}
+
+// Start starts the server.
+func (s *Server) Start() {
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// StartTLS starts the server with TLS from the start of each
+// connection, as SMTPS does.
+func (s *Server) StartTLS() {
+	s.implicit = true
+	s.Listener = tls.NewListener(s.Listener, s.TLS)
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close stops the server, closing any open connections and waiting
+// for their sessions to end.
+func (s *Server) Close() {
+	s.Listener.Close()
+
+	s.mu.Lock()
+	for c := range s.open {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Port is the port the server is listening on.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return port
+}
+
+// Certificate is the server's certificate.
+func (s *Server) Certificate() *x509.Certificate {
+	leaf, _ := x509.ParseCertificate(s.TLS.Certificates[0].Certificate[0])
+	return leaf
+}
+
+// Config returns a Config for sending to the server, with the
+// credentials it accepts and its certificate trusted.
+func (s *Server) Config() *smtp.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	cfg := &smtp.Config{
+		Username: s.Username,
+		Password: s.Password,
+		Hostname: "127.0.0.1",
+		Port:     s.Port(),
+		RootCAs:  pool,
+	}
+	if s.implicit {
+		cfg.TLS = smtp.TLSImplicit
+	}
+	return cfg
+}
+
+// Fail replies to the next n uses of the command, such as "RCPT", with
+// the reply given instead of the usual one. An empty reply closes the
+// connection. When n is negative every use of the command fails.
+//
+//	s.Fail("MAIL", 1, "451 4.3.0 Try again later")
+func (s *Server) Fail(cmd string, n int, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fails[strings.ToUpper(cmd)] = &failure{n, reply}
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.msgs...)
+}
+
+// Conns returns the number of connections accepted so far.
+func (s *Server) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Mechanisms returns the auth mechanisms used to log in successfully.
+func (s *Server) Mechanisms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.mechs...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns++
+		s.open[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+
+			s.mu.Lock()
+			delete(s.open, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// fail returns the reply to give in place of the usual one, if any.
+func (s *Server) fail(cmd string) (reply string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.fails[cmd]
+	if f == nil || f.n == 0 {
+		return "", false
+	}
+	if f.n > 0 {
+		f.n--
+	}
+	return f.reply, true
+}
+
+func (s *Server) rejects(arg string) bool {
+	for _, r := range s.Reject {
+		if strings.Contains(arg, "<"+r+">") {
+			return true
+		}
+	}
+	return false
+}
+
+// session is the state of a single connection.
+type session struct {
+	c      net.Conn
+	tp     *textproto.Conn
+	secure bool
+	msg    *Message
+}
+
+func (s *Server) handle(c net.Conn) {
+	ss := &session{c: c, tp: textproto.NewConn(c), secure: s.implicit}
+	defer func() { ss.c.Close() }()
+
+	ss.tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		time.Sleep(s.Delay)
+
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		if reply, ok := s.fail(verb); ok {
+			if reply == "" {
+				return
+			}
+			ss.tp.PrintfLine("%s", reply)
+			continue
+		}
+
+		if !s.command(ss, verb, arg) {
+			return
+		}
+	}
+}
+
+// command replies to a single command, reporting whether
+// the session should carry on.
+func (s *Server) command(ss *session, verb, arg string) bool {
+	tp := ss.tp
+	switch verb {
+	case "EHLO", "HELO":
+		ss.msg = nil
+		tp.PrintfLine("250-localhost")
+		tp.PrintfLine("250-PIPELINING")
+		tp.PrintfLine("250-8BITMIME")
+		if s.SMTPUTF8 {
+			tp.PrintfLine("250-SMTPUTF8")
+		}
+		if !ss.secure && !s.NoStartTLS {
+			tp.PrintfLine("250-STARTTLS")
+		}
+		tp.PrintfLine("250 AUTH %s", strings.Join(s.Auth, " "))
+	case "STARTTLS":
+		if ss.secure || s.NoStartTLS {
+			tp.PrintfLine("502 5.5.1 STARTTLS not available")
+			return true
+		}
+		tp.PrintfLine("220 Ready to start TLS")
+		tc := tls.Server(ss.c, s.TLS)
+		if err := tc.Handshake(); err != nil {
+			return false
+		}
+		// anything pipelined before the handshake is thrown away
+		ss.c, ss.tp, ss.secure = tc, textproto.NewConn(tc), true
+	case "AUTH":
+		mech, ir, _ := strings.Cut(arg, " ")
+		mech = strings.ToUpper(mech)
+		if !s.authenticate(tp, mech, ir) {
+			tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+			return true
+		}
+		s.mu.Lock()
+		s.mechs = append(s.mechs, mech)
+		s.mu.Unlock()
+		tp.PrintfLine("235 2.7.0 Authentication successful")
+	case "MAIL":
+		from, ok := path(arg, "FROM:")
+		if !ok {
+			tp.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+			return true
+		}
+		utf8 := s.SMTPUTF8 && strings.Contains(strings.ToUpper(arg), " SMTPUTF8")
+		if !utf8 && !isASCII(from) {
+			tp.PrintfLine("553 5.6.7 Non-ASCII addresses not permitted")
+			return true
+		}
+		ss.msg = &Message{From: from, SMTPUTF8: utf8}
+		tp.PrintfLine("250 2.1.0 Ok")
+	case "RCPT":
+		to, ok := path(arg, "TO:")
+		switch {
+		case ss.msg == nil:
+			tp.PrintfLine("503 5.5.1 Error: need MAIL command")
+		case !ok:
+			tp.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+		case !ss.msg.SMTPUTF8 && !isASCII(to):
+			tp.PrintfLine("553 5.6.7 Non-ASCII addresses not permitted")
+		case s.rejects(arg):
+			tp.PrintfLine("550 5.1.1 No such user")
+		default:
+			ss.msg.To = append(ss.msg.To, to)
+			tp.PrintfLine("250 2.1.5 Ok")
+		}
+	case "DATA":
+		if ss.msg == nil || len(ss.msg.To) == 0 {
+			tp.PrintfLine("554 5.5.1 Error: no valid recipients")
+			return true
+		}
+		tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+		data, err := tp.ReadDotBytes()
+		if err != nil {
+			return false
+		}
+		n := s.receive(ss.msg, data)
+		ss.msg = nil
+
+		reply := s.DataReply
+		if reply == "" {
+			reply = fmt.Sprintf("2.0.0 Ok: queued as %d", n)
+		}
+		tp.PrintfLine("250 %s", reply)
+		return !s.DropAfterData
+	case "RSET":
+		ss.msg = nil
+		tp.PrintfLine("250 2.0.0 Ok")
+	case "NOOP":
+		tp.PrintfLine("250 2.0.0 Ok")
+	case "QUIT":
+		tp.PrintfLine("221 2.0.0 Bye")
+		return false
+	default:
+		tp.PrintfLine("502 5.5.2 Error: command not recognized")
+	}
+	return true
+}
+
+// receive records the message, returning how many there now are.
+func (s *Server) receive(m *Message, data []byte) int {
+	// the dot reader turns CRLF into LF
+	m.Data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	if msg, err := mail.ReadMessage(bytes.NewReader(m.Data)); err == nil {
+		m.Header = msg.Header
+		m.Body, _ = io.ReadAll(msg.Body)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, *m)
+	return len(s.msgs)
+}
+
+// path reads the address from the argument to MAIL or RCPT,
+// ignoring any parameters after it.
+func path(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticate checks the credentials for the mechanism.
+func (s *Server) authenticate(tp *textproto.Conn, mech, ir string) bool {
+	offered := false
+	for _, m := range s.Auth {
+		offered = offered || strings.EqualFold(m, mech)
+	}
+	if !offered {
+		return false
+	}
+
+	// challenge sends a 334 and decodes the reply
+	challenge := func(c string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(c)))
+		line, _ := tp.ReadLine()
+		p, _ := base64.StdEncoding.DecodeString(line)
+		return string(p)
+	}
+
+	switch mech {
+	case "PLAIN":
+		if ir == "" {
+			tp.PrintfLine("334 ")
+			ir, _ = tp.ReadLine()
+		}
+		p, _ := base64.StdEncoding.DecodeString(ir)
+		return string(p) == "\x00"+s.Username+"\x00"+s.Password
+	case "LOGIN":
+		return challenge("Username:") == s.Username && challenge("Password:") == s.Password
+	case "CRAM-MD5":
+		c := "<1896.697170952@localhost>"
+		h := hmac.New(md5.New, []byte(s.Password))
+		h.Write([]byte(c))
+		return challenge(c) == s.Username+" "+hex.EncodeToString(h.Sum(nil))
+	case "XOAUTH2":
+		p, _ := base64.StdEncoding.DecodeString(ir)
+		if string(p) == "user="+s.Username+"\x01auth=Bearer "+s.Token+"\x01\x01" {
+			return true
+		}
+		challenge(`{"status":"401","schemes":"bearer"}`)
+		return false
+	default:
+		return false
+	}
+}
+
+// newCert makes a self-signed certificate for the loopback address.
+func newCert() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: ecdsa.GenerateKey: %v", err))
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: x509.CreateCertificate: %v", err))
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
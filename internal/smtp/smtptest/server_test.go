@@ -0,0 +1,133 @@
+package smtptest_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/adoublef/pinkpink/internal/smtp/smtptest"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestServer(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := smtptest.NewServer()
+		t.Cleanup(srv.Close)
+
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), &smtp.Message{
+			To:      []smtp.Address{{Address: "to@example.com"}},
+			Subject: "Hello",
+			Text:    "Hello World",
+		})
+		is.NoErr(err) // send email
+
+		msgs := srv.Messages()
+		is.Equal(len(msgs), 1)
+		is.Equal(msgs[0].From, smtptest.Username)
+		is.Equal(msgs[0].To, []string{"to@example.com"})
+		is.Equal(msgs[0].Header.Get("Subject"), "Hello")
+		is.Equal(string(msgs[0].Body), "Hello World\r\n")
+		is.Equal(srv.Mechanisms(), []string{"PLAIN"})
+	})
+
+	t.Run("implicit tls", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := smtptest.NewTLSServer()
+		t.Cleanup(srv.Close)
+
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), &smtp.Message{To: []smtp.Address{{Address: "to@example.com"}}})
+		is.NoErr(err) // send email over smtps
+	})
+
+	t.Run("pipelining", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := smtptest.NewUnstartedServer()
+		srv.NoStartTLS, srv.Auth = true, nil
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		nc, err := net.Dial("tcp", "127.0.0.1:"+srv.Port())
+		is.NoErr(err) // dial
+		t.Cleanup(func() { nc.Close() })
+
+		tp := textproto.NewConn(nc)
+		_, _, err = tp.ReadResponse(220)
+		is.NoErr(err) // greeting
+
+		_, err = nc.Write([]byte("EHLO localhost\r\n"))
+		is.NoErr(err) // ehlo
+		_, text, err := tp.ReadResponse(250)
+		is.NoErr(err) // ehlo reply
+		is.True(strings.Contains(text, "PIPELINING"))
+
+		// the whole transaction in a single write
+		w := bufio.NewWriter(nc)
+		w.WriteString("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<c@example.com>\r\nDATA\r\n")
+		is.NoErr(w.Flush()) // pipeline
+		for _, code := range []int{250, 250, 250, 354} {
+			_, _, err := tp.ReadResponse(code)
+			is.NoErr(err) // pipelined reply
+		}
+
+		is.NoErr(tp.PrintfLine("Subject: Hi\r\n\r\nHello\r\n.")) // data
+		_, _, err = tp.ReadResponse(250)
+		is.NoErr(err) // queued
+
+		msgs := srv.Messages()
+		is.Equal(len(msgs), 1)
+		is.Equal(msgs[0].To, []string{"b@example.com", "c@example.com"})
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := smtptest.NewServer()
+		t.Cleanup(srv.Close)
+		srv.Fail("MAIL", 1, "451 4.3.0 Try again later")
+
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		m := &smtp.Message{To: []smtp.Address{{Address: "to@example.com"}}}
+
+		_, err := c.Send(context.Background(), m)
+		is.True(smtp.IsTemporary(err)) // injected failure
+
+		_, err = c.Send(context.Background(), m)
+		is.NoErr(err) // fails only once
+	})
+
+	t.Run("fail closes connection", func(t *testing.T) {
+		is := is.New(t)
+
+		srv := smtptest.NewServer()
+		t.Cleanup(srv.Close)
+		srv.Fail("DATA", -1, "")
+
+		c := smtp.NewClient(srv.Config())
+		t.Cleanup(func() { c.Close() })
+
+		_, err := c.Send(context.Background(), &smtp.Message{To: []smtp.Address{{Address: "to@example.com"}}})
+
+		var smtpErr *smtp.Error
+		is.True(errors.As(err, &smtpErr)) // smtp error
+		is.Equal(smtpErr.Phase, smtp.PhaseData)
+		is.Equal(smtpErr.Code, 0) // connection closed without a reply
+		is.Equal(len(srv.Messages()), 0)
+	})
+}
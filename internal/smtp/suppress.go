@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Suppressions are the addresses mail isn't sent to any more, as they
+// have no mailbox, hard bounced or unsubscribed. They are kept apart
+// from any one process, so every worker sees them and they outlast it.
+type Suppressions interface {
+	// Suppress stops mail to the event's recipient, for the event.
+	Suppress(ctx context.Context, e *Event) error
+	// Suppressed reports whether mail to the address is stopped.
+	Suppressed(ctx context.Context, address string) (bool, error)
+}
+
+// SuppressionKey is how an address is looked up, which ignores case
+// as so many mail servers do.
+func SuppressionKey(address string) string { return strings.ToLower(address) }
+
+var _ Suppressions = (*MemorySuppressions)(nil)
+
+// MemorySuppressions keeps suppressions in memory, for tests.
+type MemorySuppressions struct {
+	mu     sync.Mutex
+	events map[string]*Event
+}
+
+func NewMemorySuppressions() *MemorySuppressions {
+	return &MemorySuppressions{events: make(map[string]*Event)}
+}
+
+func (s *MemorySuppressions) Suppress(ctx context.Context, e *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[SuppressionKey(e.Recipient)] = e
+	return nil
+}
+
+func (s *MemorySuppressions) Suppressed(ctx context.Context, address string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.events[SuppressionKey(address)]
+	return ok, nil
+}
@@ -0,0 +1,258 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrTemplateNotFound is returned by a TemplateSource
+// for a template it doesn't have.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// The files a template is made of, in a directory named after it.
+// Either body may be left out, but not both. The HTML body can be
+// written as markup instead, which is compiled to HTML.
+const (
+	TemplateSubject = "subject.txt"
+	TemplateHTML    = "body.html"
+	TemplateMarkup  = "body.xml"
+	TemplateText    = "body.txt"
+)
+
+// TemplateFiles are the sources of a template's parts.
+type TemplateFiles struct {
+	Subject string
+	HTML    string
+	Markup  string
+	Text    string
+	// Version is which version of the template the files are,
+	// or 0 for sources that don't keep versions.
+	Version int
+}
+
+// TemplateSource is where templates are loaded from.
+type TemplateSource interface {
+	// Files returns ErrTemplateNotFound if there is no template with the name.
+	Files(ctx context.Context, name string) (*TemplateFiles, error)
+}
+
+// TemplateError is a template that couldn't be loaded, parsed or
+// rendered. Sending again won't help until the template is fixed.
+type TemplateError struct {
+	Name string
+	Err  error
+}
+
+func (e *TemplateError) Error() string { return "template " + e.Name + ": " + e.Err.Error() }
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// Template is a parsed email template, with html/template for the
+// HTML body and text/template for the subject and plain text body.
+type Template struct {
+	Name    string
+	Version int
+	// Locale is which of the template's locales it is, or "" for
+	// the default.
+	Locale  string
+	subject *texttemplate.Template
+	html    *htmltemplate.Template
+	text    *texttemplate.Template
+}
+
+// TemplateData is what a template is rendered with. The recipient's
+// fields are merge fields, such as {{.FirstName}} or {{.Name}}, and
+// the custom data is under .Data, such as {{.Data.plan}}. Its methods
+// are for the recipient's locale, and need $ in place of the dot
+// inside a range or with.
+type TemplateData struct {
+	Recipient
+	Data map[string]any
+	// Catalog has the shared messages, for {{.Message "key"}}.
+	Catalog *Catalog
+}
+
+// ParseTemplate parses the template's files.
+func ParseTemplate(name string, files *TemplateFiles) (*Template, error) {
+	if files.HTML == "" && files.Markup == "" && files.Text == "" {
+		return nil, &TemplateError{name, errors.New("has no body")}
+	}
+	if files.HTML != "" && files.Markup != "" {
+		return nil, &TemplateError{name, errors.New("has both an HTML body and markup")}
+	}
+
+	html, htmlName := files.HTML, TemplateHTML
+	if files.Markup != "" {
+		// the actions are parsed first, so their mistakes are
+		// on the lines of the markup rather than what it compiles to
+		if _, err := texttemplate.New(TemplateMarkup).Parse(files.Markup); err != nil {
+			return nil, &TemplateError{name, err}
+		}
+		var err error
+		if html, err = CompileMarkup(files.Markup); err != nil {
+			return nil, &TemplateError{name, fmt.Errorf("%s: %w", TemplateMarkup, err)}
+		}
+		htmlName = TemplateMarkup
+	}
+
+	t := &Template{Name: name, Version: files.Version}
+
+	var err error
+	if t.subject, err = texttemplate.New(TemplateSubject).Option("missingkey=error").Parse(files.Subject); err != nil {
+		return nil, &TemplateError{name, err}
+	}
+	if html != "" {
+		if t.html, err = htmltemplate.New(htmlName).Option("missingkey=error").Parse(html); err != nil {
+			return nil, &TemplateError{name, err}
+		}
+	}
+	if files.Text != "" {
+		if t.text, err = texttemplate.New(TemplateText).Option("missingkey=error").Parse(files.Text); err != nil {
+			return nil, &TemplateError{name, err}
+		}
+	}
+	return t, nil
+}
+
+// LoadTemplate loads the named template from the source and parses it.
+func LoadTemplate(ctx context.Context, src TemplateSource, name string) (*Template, error) {
+	return LoadLocalTemplate(ctx, src, name, "")
+}
+
+// LoadLocalTemplate loads the named template for the locale. A template's
+// locales are kept as templates of their own, named after it and the
+// locale, such as "welcome.fr-CA", and the first of "welcome.fr-CA",
+// "welcome.fr" and "welcome" the source has is loaded.
+func LoadLocalTemplate(ctx context.Context, src TemplateSource, name, locale string) (*Template, error) {
+	for _, l := range Locales(locale) {
+		files, err := src.Files(ctx, LocalName(name, l))
+		if errors.Is(err, ErrTemplateNotFound) {
+			continue
+		}
+		if err != nil {
+			// the source may be back later
+			return nil, fmt.Errorf("smtp.LoadTemplate: %w", err)
+		}
+
+		t, err := ParseTemplate(LocalName(name, l), files)
+		if err != nil {
+			return nil, err
+		}
+		t.Name, t.Locale = name, l
+		return t, nil
+	}
+	return nil, &TemplateError{name, ErrTemplateNotFound}
+}
+
+// LocalName is the name of the template's locale.
+func LocalName(name, locale string) string {
+	if locale == "" {
+		return name
+	}
+	return name + "." + locale
+}
+
+// Render fills in the template, returning a message with its Subject,
+// HTML and Text set. Missing data is an error rather than left blank.
+func (t *Template) Render(data *TemplateData) (*Message, error) {
+	m := &Message{}
+
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return nil, &TemplateError{t.Name, err}
+	}
+	// a subject can't span lines, so they are joined
+	m.Subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	if t.html != nil {
+		buf.Reset()
+		if err := t.html.Execute(&buf, data); err != nil {
+			return nil, &TemplateError{t.Name, err}
+		}
+		m.HTML = buf.String()
+	}
+
+	if t.text != nil {
+		buf.Reset()
+		if err := t.text.Execute(&buf, data); err != nil {
+			return nil, &TemplateError{t.Name, err}
+		}
+		m.Text = buf.String()
+	}
+	return m, nil
+}
+
+// PreviewAddress stands in for the addresses a preview doesn't have.
+var PreviewAddress = Address{Name: "Preview", Address: "preview@example.invalid"}
+
+// Preview renders the template for the recipient the way it would be
+// sent, with its CSS inlined and a plain text body made from the HTML
+// if it has none, and the message from the address as it is written.
+func (t *Template) Preview(from Address, data *TemplateData) (*Message, []byte, error) {
+	m, err := t.Render(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	to := data.Address
+	if to.Address == "" {
+		to = PreviewAddress
+	}
+	if name := data.Name(); name != "" {
+		to.Name = name
+	}
+	m.From, m.To = from, []Address{to}
+
+	if m, err = m.withAlternative(); err != nil {
+		return nil, nil, err
+	}
+	p, err := m.Bytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, p, nil
+}
+
+var _ TemplateSource = (*FSTemplates)(nil)
+
+// FSTemplates loads templates from a directory per template in a
+// file system, such as an embed.FS.
+type FSTemplates struct {
+	fsys fs.FS
+}
+
+// NewFSTemplates returns a TemplateSource for the file system.
+func NewFSTemplates(fsys fs.FS) *FSTemplates {
+	return &FSTemplates{fsys: fsys}
+}
+
+func (t *FSTemplates) Files(ctx context.Context, name string) (*TemplateFiles, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, ErrTemplateNotFound
+	}
+
+	var files TemplateFiles
+	found := false
+	for file, p := range map[string]*string{TemplateSubject: &files.Subject, TemplateHTML: &files.HTML, TemplateMarkup: &files.Markup, TemplateText: &files.Text} {
+		b, err := fs.ReadFile(t.fsys, path.Join(name, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fs.ReadFile: %w", err)
+		}
+		*p, found = string(b), true
+	}
+
+	if !found {
+		return nil, ErrTemplateNotFound
+	}
+	return &files, nil
+}
@@ -0,0 +1,124 @@
+package smtp_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestTemplate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"welcome/subject.txt":    {Data: []byte("Welcome,\n{{.FirstName}}")},
+		"welcome/body.html":      {Data: []byte("<p>Hi {{.Name}}, {{.Data.note}}</p>")},
+		"welcome/body.txt":       {Data: []byte("Hi {{.Name}}, {{.Data.note}}")},
+		"empty/subject.txt":      {Data: []byte("No body")},
+		"broken/body.html":       {Data: []byte("{{.Name")},
+		"markup/subject.txt":     {Data: []byte("Hi")},
+		"markup/body.xml":        {Data: []byte(`<email><section><column><text>Hi {{.Data.note}}</text></column></section></email>`)},
+		"welcome.fr/subject.txt": {Data: []byte("Bienvenue {{.FirstName}}")},
+		"welcome.fr/body.txt":    {Data: []byte(`{{.Message "thanks"}}, {{.Date .Data.renews}}, {{.Number .Data.total}}`)},
+		"bad/subject.txt":        {Data: []byte("Hi")},
+		"bad/body.xml":           {Data: []byte("<email>\n<section><text>Hi</text></section></email>")},
+	}
+	src := smtp.NewFSTemplates(fsys)
+
+	t.Run("render", func(t *testing.T) {
+		is := is.New(t)
+
+		tmpl, err := smtp.LoadTemplate(context.Background(), src, "welcome")
+		is.NoErr(err) // load template
+
+		data := &smtp.TemplateData{
+			Recipient: smtp.Recipient{FirstName: "Ada", LastName: "Lovelace"},
+			Data:      map[string]any{"note": "<b>&</b>"},
+		}
+		msg, err := tmpl.Render(data)
+		is.NoErr(err)                                                          // render template
+		is.Equal(msg.Subject, "Welcome, Ada")                                  // subject on one line
+		is.Equal(msg.HTML, "<p>Hi Ada Lovelace, &lt;b&gt;&amp;&lt;/b&gt;</p>") // html escaped
+		is.Equal(msg.Text, "Hi Ada Lovelace, <b>&</b>")                        // text left alone
+	})
+
+	t.Run("markup", func(t *testing.T) {
+		is := is.New(t)
+
+		tmpl, err := smtp.LoadTemplate(context.Background(), src, "markup")
+		is.NoErr(err) // load template
+
+		msg, err := tmpl.Render(&smtp.TemplateData{Data: map[string]any{"note": "<b>&</b>"}})
+		is.NoErr(err)                                                        // render template
+		is.True(strings.HasPrefix(msg.HTML, "<!DOCTYPE html>"))              // compiled to html
+		is.True(strings.Contains(msg.HTML, ">Hi &lt;b&gt;&amp;&lt;/b&gt;<")) // html escaped
+	})
+
+	t.Run("locale", func(t *testing.T) {
+		is := is.New(t)
+
+		tmpl, err := smtp.LoadLocalTemplate(context.Background(), src, "welcome", "fr-CA")
+		is.NoErr(err) // load template
+		is.Equal(tmpl.Name, "welcome")
+		is.Equal(tmpl.Locale, "fr") // falls back to fr
+
+		msg, err := tmpl.Render(&smtp.TemplateData{
+			Recipient: smtp.Recipient{FirstName: "Ada", Locale: "fr-CA"},
+			Data:      map[string]any{"renews": "2023-03-04", "total": 1234.5},
+			Catalog:   smtp.NewCatalog(map[string]map[string]string{"": {"thanks": "Thanks"}, "fr": {"thanks": "Merci"}}),
+		})
+		is.NoErr(err) // render template
+		is.Equal(msg.Subject, "Bienvenue Ada")
+		is.Equal(msg.Text, "Merci, 2023-03-04, 1\u00a0234,5")
+
+		tmpl, err = smtp.LoadLocalTemplate(context.Background(), src, "welcome", "de")
+		is.NoErr(err)             // load template
+		is.Equal(tmpl.Locale, "") // falls back to the default
+	})
+
+	t.Run("preview", func(t *testing.T) {
+		is := is.New(t)
+
+		tmpl, err := smtp.ParseTemplate("news", &smtp.TemplateFiles{
+			Subject: "Hi {{.FirstName}}",
+			HTML:    `<style>p { color: red }</style><p>Hi {{.FirstName}}</p>`,
+		})
+		is.NoErr(err) // parse template
+
+		m, p, err := tmpl.Preview(smtp.PreviewAddress, &smtp.TemplateData{Recipient: smtp.Recipient{FirstName: "Ada"}})
+		is.NoErr(err)                                           // preview template
+		is.Equal(m.HTML, `<p style="color: red">Hi Ada</p>`)    // as it would be sent
+		is.Equal(m.Text, "Hi Ada\n")                            // with a text body
+		is.True(strings.Contains(string(p), "Subject: Hi Ada")) // and the whole message
+		is.True(strings.Contains(string(p), `To: "Ada" <preview@example.invalid>`))
+	})
+
+	t.Run("missing data", func(t *testing.T) {
+		is := is.New(t)
+
+		tmpl, err := smtp.LoadTemplate(context.Background(), src, "welcome")
+		is.NoErr(err) // load template
+
+		_, err = tmpl.Render(&smtp.TemplateData{Recipient: smtp.Recipient{FirstName: "Ada"}})
+		var terr *smtp.TemplateError
+		is.True(errors.As(err, &terr))
+		is.Equal(terr.Name, "welcome")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		is := is.New(t)
+
+		for name, want := range map[string]error{"missing": smtp.ErrTemplateNotFound, "../welcome": smtp.ErrTemplateNotFound} {
+			_, err := smtp.LoadTemplate(context.Background(), src, name)
+			is.True(errors.Is(err, want)) // not found
+		}
+
+		for _, name := range []string{"empty", "broken", "bad"} {
+			_, err := smtp.LoadTemplate(context.Background(), src, name)
+			var terr *smtp.TemplateError
+			is.True(errors.As(err, &terr)) // not parsed
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strings"
+)
+
+// Unsubscriber signs the one-click unsubscribe links that go in each
+// message, so whoever has the link can unsubscribe without logging in
+// but nobody can unsubscribe anyone else.
+type Unsubscriber struct {
+	// URL is the unsubscribe endpoint, such as
+	// "https://example.com/api/unsubscribe".
+	URL string
+	// Key signs the links and must be kept secret.
+	Key []byte
+	// Mailto is an address that is also listed, for mail
+	// clients that don't support one-click, when set.
+	Mailto string
+}
+
+// Link is the recipient's signed unsubscribe link.
+func (u *Unsubscriber) Link(rcpt string) string {
+	q := url.Values{"email": {rcpt}, "token": {u.token(rcpt)}}
+
+	sep := "?"
+	if strings.Contains(u.URL, "?") {
+		sep = "&"
+	}
+	return u.URL + sep + q.Encode()
+}
+
+// Verify reports whether the token was signed for the recipient.
+func (u *Unsubscriber) Verify(rcpt, token string) bool {
+	return hmac.Equal([]byte(u.token(rcpt)), []byte(token))
+}
+
+// SetHeaders adds the recipient's List-Unsubscribe headers to the message.
+func (u *Unsubscriber) SetHeaders(m *Message, rcpt string) *Message {
+	urls := []string{u.Link(rcpt)}
+	if u.Mailto != "" {
+		urls = append(urls, "mailto:"+u.Mailto+"?subject=unsubscribe")
+	}
+	return m.ListUnsubscribe(urls...)
+}
+
+// token is the signature of the address, which is
+// case insensitive as mail servers treat it that way.
+func (u *Unsubscriber) token(rcpt string) string {
+	h := hmac.New(sha256.New, u.Key)
+	h.Write([]byte(strings.ToLower(rcpt)))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ListUnsubscribe sets the List-Unsubscribe header to the urls, which
+// may be https: or mailto:, and asks for RFC 8058 one-click
+// unsubscribing when there is an https: url to POST to.
+func (m *Message) ListUnsubscribe(urls ...string) *Message {
+	var b strings.Builder
+	oneClick := false
+	for i, u := range urls {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("<" + u + ">")
+		oneClick = oneClick || strings.HasPrefix(u, "https:")
+	}
+
+	m.SetHeader("List-Unsubscribe", b.String())
+	if oneClick {
+		m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	return m
+}
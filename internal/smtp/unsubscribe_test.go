@@ -0,0 +1,48 @@
+package smtp_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestUnsubscriber(t *testing.T) {
+	u := &smtp.Unsubscriber{URL: "https://example.com/api/unsubscribe", Key: []byte("secret"), Mailto: "unsubscribe@example.com"}
+
+	t.Run("link", func(t *testing.T) {
+		is := is.New(t)
+
+		link, err := url.Parse(u.Link("jo@example.net"))
+		is.NoErr(err) // parse link
+		is.Equal(link.Query().Get("email"), "jo@example.net")
+
+		token := link.Query().Get("token")
+		is.True(u.Verify("jo@example.net", token))  // signed for jo
+		is.True(u.Verify("Jo@Example.net", token))  // whatever the case
+		is.True(!u.Verify("al@example.net", token)) // not for anyone else
+
+		other := &smtp.Unsubscriber{URL: u.URL, Key: []byte("other")}
+		is.True(!other.Verify("jo@example.net", token)) // not with another key
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		is := is.New(t)
+
+		m := u.SetHeaders(newTestMessage(), "jo@example.net")
+		h := m.Header.Get("List-Unsubscribe")
+		is.True(strings.HasPrefix(h, "<"+u.Link("jo@example.net")+">")) // one-click link first
+		is.True(strings.HasSuffix(h, ", <mailto:unsubscribe@example.com?subject=unsubscribe>"))
+		is.Equal(m.Header.Get("List-Unsubscribe-Post"), "List-Unsubscribe=One-Click")
+	})
+
+	t.Run("mailto only", func(t *testing.T) {
+		is := is.New(t)
+
+		m := newTestMessage().ListUnsubscribe("mailto:unsubscribe@example.com")
+		is.Equal(m.Header.Get("List-Unsubscribe"), "<mailto:unsubscribe@example.com>")
+		is.Equal(m.Header.Get("List-Unsubscribe-Post"), "") // nothing to POST to
+	})
+}
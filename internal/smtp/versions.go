@@ -0,0 +1,304 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoRollback is returned when rolling back a template
+// that has never had another version active.
+var ErrNoRollback = errors.New("no version to roll back to")
+
+// TemplateVersion is one saved version of a template. Versions
+// are never changed once saved, so a version number always
+// renders the same way.
+type TemplateVersion struct {
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// TemplateStore keeps every version of its templates, sending
+// the active one.
+type TemplateStore interface {
+	// Files returns the active version.
+	TemplateSource
+	// Put saves the files as a new version. It is only made active
+	// when the template has no active version, such as when it is new.
+	Put(ctx context.Context, name string, files *TemplateFiles) (*TemplateVersion, error)
+	// Version returns ErrTemplateNotFound if the template doesn't
+	// have the version.
+	Version(ctx context.Context, name string, version int) (*TemplateFiles, error)
+	// History returns ErrTemplateNotFound if there is no template with the name.
+	History(ctx context.Context, name string) (*TemplateHistory, error)
+	// Publish makes the version active.
+	Publish(ctx context.Context, name string, version int) error
+	// Rollback makes the version that was active before
+	// active again, returning it.
+	Rollback(ctx context.Context, name string) (int, error)
+	// Names lists the templates, in order.
+	Names(ctx context.Context) ([]string, error)
+}
+
+// TemplateHistory is a template's versions and which of them is
+// active, as kept by a TemplateStore.
+type TemplateHistory struct {
+	// Versions are oldest first.
+	Versions []TemplateVersion `json:"versions"`
+	Active   int               `json:"active"`
+	// Previous are the versions that were active before, the most
+	// recent last, for rolling back.
+	Previous []int `json:"previous,omitempty"`
+	// Latest is the last version number given out, which may not
+	// have been saved if saving it failed.
+	Latest int `json:"latest"`
+}
+
+// Reserve gives out the next version number, so the files can be
+// saved under it before the version is added.
+func (h *TemplateHistory) Reserve() int {
+	h.Latest++
+	return h.Latest
+}
+
+// Add adds the saved version, making it active if none is.
+func (h *TemplateHistory) Add(v TemplateVersion) {
+	h.Versions = append(h.Versions, v)
+	if h.Active == 0 {
+		h.Active = v.Version
+	}
+}
+
+// Has reports whether the version was saved.
+func (h *TemplateHistory) Has(version int) bool {
+	for _, v := range h.Versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish makes the version active.
+func (h *TemplateHistory) Publish(version int) error {
+	if !h.Has(version) {
+		return ErrTemplateNotFound
+	}
+	if h.Active != 0 && h.Active != version {
+		h.Previous = append(h.Previous, h.Active)
+	}
+	h.Active = version
+	return nil
+}
+
+// Rollback makes the previously active version active again.
+func (h *TemplateHistory) Rollback() (int, error) {
+	if len(h.Previous) == 0 {
+		return 0, ErrNoRollback
+	}
+	h.Active, h.Previous = h.Previous[len(h.Previous)-1], h.Previous[:len(h.Previous)-1]
+	return h.Active, nil
+}
+
+// LoadTemplateVersion loads a version of the named template from the
+// store and parses it, whether the version is published or not.
+func LoadTemplateVersion(ctx context.Context, store TemplateStore, name string, version int) (*Template, error) {
+	files, err := store.Version(ctx, name, version)
+	if errors.Is(err, ErrTemplateNotFound) {
+		return nil, &TemplateError{name, err}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("smtp.LoadTemplateVersion: %w", err)
+	}
+	return ParseTemplate(name, files)
+}
+
+// DiffTemplates compares the files of two versions of a template, line
+// by line, in the style of a unified diff without the hunk headers.
+// Files that are the same are left out.
+func DiffTemplates(a, b *TemplateFiles) string {
+	var sb strings.Builder
+	for _, f := range []struct {
+		name string
+		a, b string
+	}{
+		{TemplateSubject, a.Subject, b.Subject},
+		{TemplateHTML, a.HTML, b.HTML},
+		{TemplateMarkup, a.Markup, b.Markup},
+		{TemplateText, a.Text, b.Text},
+	} {
+		if f.a == f.b {
+			continue
+		}
+		sb.WriteString("--- a/" + f.name + "\n+++ b/" + f.name + "\n")
+		for _, line := range diffLines(splitLines(f.a), splitLines(f.b)) {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines is the longest common subsequence of the lines, with those
+// only in a marked "-" and those only in b marked "+". Templates are
+// small enough that the quadratic table doesn't matter.
+func diffLines(a, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
+
+var _ TemplateStore = (*MemoryTemplates)(nil)
+
+// MemoryTemplates keeps templates in memory, for tests.
+type MemoryTemplates struct {
+	mu      sync.Mutex
+	history map[string]*TemplateHistory
+	files   map[string]map[int]*TemplateFiles
+}
+
+func NewMemoryTemplates() *MemoryTemplates {
+	return &MemoryTemplates{history: make(map[string]*TemplateHistory), files: make(map[string]map[int]*TemplateFiles)}
+}
+
+func (t *MemoryTemplates) Files(ctx context.Context, name string) (*TemplateFiles, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.history[name]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	return t.version(name, h.Active)
+}
+
+func (t *MemoryTemplates) Put(ctx context.Context, name string, files *TemplateFiles) (*TemplateVersion, error) {
+	if _, err := ParseTemplate(name, files); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.history[name]
+	if !ok {
+		h = &TemplateHistory{}
+		t.history[name], t.files[name] = h, make(map[int]*TemplateFiles)
+	}
+
+	v := TemplateVersion{Name: name, Version: h.Reserve(), Created: time.Now()}
+	ff := *files
+	ff.Version = v.Version
+	t.files[name][v.Version] = &ff
+	h.Add(v)
+	return &v, nil
+}
+
+func (t *MemoryTemplates) Version(ctx context.Context, name string, version int) (*TemplateFiles, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version(name, version)
+}
+
+func (t *MemoryTemplates) version(name string, version int) (*TemplateFiles, error) {
+	files, ok := t.files[name][version]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	ff := *files
+	return &ff, nil
+}
+
+func (t *MemoryTemplates) History(ctx context.Context, name string) (*TemplateHistory, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.history[name]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	hh := *h
+	hh.Versions = append([]TemplateVersion(nil), h.Versions...)
+	hh.Previous = append([]int(nil), h.Previous...)
+	return &hh, nil
+}
+
+func (t *MemoryTemplates) Publish(ctx context.Context, name string, version int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.history[name]
+	if !ok {
+		return ErrTemplateNotFound
+	}
+	return h.Publish(version)
+}
+
+func (t *MemoryTemplates) Rollback(ctx context.Context, name string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.history[name]
+	if !ok {
+		return 0, ErrTemplateNotFound
+	}
+	return h.Rollback()
+}
+
+func (t *MemoryTemplates) Names(ctx context.Context) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.history))
+	for name := range t.history {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,63 @@
+package smtp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/adoublef/pinkpink/internal/smtp"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestMemoryTemplates(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	tmpls := smtp.NewMemoryTemplates()
+
+	v1, err := tmpls.Put(ctx, "welcome", &smtp.TemplateFiles{Subject: "Hi", Text: "one"})
+	is.NoErr(err) // put first version
+	v2, err := tmpls.Put(ctx, "welcome", &smtp.TemplateFiles{Subject: "Hi", Text: "two"})
+	is.NoErr(err) // put second version
+	is.Equal(v1.Version, 1)
+	is.Equal(v2.Version, 2)
+
+	// the first version is active until another is published
+	files, err := tmpls.Files(ctx, "welcome")
+	is.NoErr(err) // active files
+	is.Equal(files.Text, "one")
+
+	is.NoErr(tmpls.Publish(ctx, "welcome", 2)) // publish
+	files, err = tmpls.Files(ctx, "welcome")
+	is.NoErr(err) // active files
+	is.Equal(files.Version, 2)
+
+	v, err := tmpls.Rollback(ctx, "welcome")
+	is.NoErr(err) // rollback
+	is.Equal(v, 1)
+
+	_, err = tmpls.Rollback(ctx, "welcome")
+	is.True(errors.Is(err, smtp.ErrNoRollback))
+	is.True(errors.Is(tmpls.Publish(ctx, "welcome", 3), smtp.ErrTemplateNotFound))
+
+	h, err := tmpls.History(ctx, "welcome")
+	is.NoErr(err) // history
+	is.Equal(len(h.Versions), 2)
+	is.Equal(h.Active, 1)
+
+	// a version never changes
+	files, err = tmpls.Version(ctx, "welcome", 2)
+	is.NoErr(err) // old version
+	is.Equal(files.Text, "two")
+}
+
+func TestDiffTemplates(t *testing.T) {
+	is := is.New(t)
+
+	a := &smtp.TemplateFiles{Subject: "Hi", Text: "Hello\nWorld\nBye\n"}
+	b := &smtp.TemplateFiles{Subject: "Hi", Text: "Hello\nThere\nBye\n"}
+
+	want := "--- a/body.txt\n+++ b/body.txt\n Hello\n-World\n+There\n Bye\n"
+	is.Equal(smtp.DiffTemplates(a, b), want)
+	is.Equal(smtp.DiffTemplates(a, a), "") // nothing changed
+}